@@ -0,0 +1,211 @@
+package apng
+
+import (
+	"image"
+	"image/color"
+)
+
+// Analysis is the smallest lossless encoding of a set of frames, as chosen by
+// Analyze.
+type Analysis struct {
+	IHDR *Chunk_IHDR // The header, with Transparency set when a color key is used
+	PLTE *Chunk_PLTE // The palette, for paletted images
+	TRNS *Chunk_tRNS // The palette transparency or color key, if any; write this after PLTE
+
+	// Palette holds the colors of PLTE and TRNS, for paletted images.
+	Palette color.Palette
+
+	global *GlobalPalette
+}
+
+// Analyze scans every pixel of the frames and picks the smallest color type
+// and bit depth the encoder supports that represents all of them exactly:
+// grayscale rather than truecolor when every pixel is gray, no alpha channel
+// when every pixel is opaque or a single color key covers the transparent
+// ones, a palette when there are at most 256 colors, and 8 rather than 16 bits
+// when no sample needs the extra precision.  The IHDR's Width and Height are
+// those of the first frame, which is taken to be the full canvas.
+//
+// Write IHDR, then PLTE and TRNS when they are set, and pass each frame
+// through Convert before encoding it.
+func Analyze(frames ...image.Image) *Analysis {
+	s := newFrameStats()
+	for _, m := range frames {
+		s.scan(m)
+	}
+
+	a := &Analysis{
+		IHDR: &Chunk_IHDR{BitDepth: BitDepth_8},
+	}
+	if len(frames) > 0 {
+		b := frames[0].Bounds()
+		a.IHDR.Width, a.IHDR.Height = uint32(b.Dx()), uint32(b.Dy())
+	}
+	if !s.depth8 {
+		a.IHDR.BitDepth = BitDepth_16
+	}
+
+	// A gray image is no bigger than a paletted one, and needs no PLTE.
+	if s.gray && s.alpha != alphaPartial && a.IHDR.BitDepth == BitDepth_8 && a.useKey(ColorType_Grayscale, frames) {
+		return a
+	}
+	if s.depth8 && len(s.palette) <= 256 {
+		a.IHDR.ColorType = ColorType_Paletted
+		a.global = newGlobalPalette(s.palette)
+		a.Palette, a.PLTE, a.TRNS = a.global.Palette, a.global.PLTE, a.global.TRNS
+		return a
+	}
+
+	ct, cta := ColorType_TrueColor, ColorType_TrueColorAlpha
+	if s.gray {
+		ct, cta = ColorType_Grayscale, ColorType_GrayscaleAlpha
+	}
+	if s.alpha == alphaPartial || !a.useKey(ct, frames) {
+		a.IHDR.ColorType = cta
+	}
+	return a
+}
+
+// useKey sets the IHDR's ColorType to ct, which has no alpha channel, and
+// reports whether the frames can be encoded that way, possibly with a color
+// key.
+func (a *Analysis) useKey(ct ColorType, frames []image.Image) bool {
+	a.IHDR.ColorType = ct
+	trns, ok := a.IHDR.NewChunk_tRNS_Key(frames...)
+	if !ok {
+		return false
+	}
+	a.IHDR.Transparency, a.TRNS = trns, trns
+	return true
+}
+
+// Convert returns m in a form the encoder can write for the analyzed color
+// type.  For paletted images, this is an *image.Paletted using the analyzed
+// palette, as per GlobalPalette.Remap; otherwise m is returned unchanged.
+func (a *Analysis) Convert(m image.Image) (image.Image, error) {
+	if a.global == nil {
+		return m, nil
+	}
+	return a.global.Remap(m)
+}
+
+// paletteKey returns c as a non-alpha-premultiplied color, with every fully
+// transparent color mapped to the same key.  color.NRGBA values are widened
+// directly, since going through alpha-premultiplied form would lose their low
+// bits when they are translucent.  color.RGBA values are un-premultiplied to 8
+// bits first, as the encoder writes them, since un-premultiplying them to 16
+// bits gives values that need 16 bits.
+func paletteKey(c color.Color) color.NRGBA64 {
+	if rc, ok := c.(color.RGBA); ok {
+		c = color.NRGBAModel.Convert(rc)
+	}
+	n := toNRGBA64(c)
+	if n.A == 0 {
+		return color.NRGBA64{}
+	}
+	return n
+}
+
+// How much alpha a set of frames uses.
+const (
+	alphaOpaque = iota
+	alphaBinary // Only fully opaque and fully transparent pixels.
+	alphaPartial
+)
+
+// frameStats accumulates what Analyze needs to know about the pixels.
+type frameStats struct {
+	gray   bool
+	depth8 bool
+	alpha  int
+
+	// palette holds the distinct colors in order of first use, up to 257 of
+	// them so that overflowing a palette is detectable.
+	palette color.Palette
+	seen    map[color.NRGBA64]bool
+}
+
+func newFrameStats() *frameStats {
+	return &frameStats{
+		gray:   true,
+		depth8: true,
+		alpha:  alphaOpaque,
+		seen:   map[color.NRGBA64]bool{},
+	}
+}
+
+func (s *frameStats) scan(m image.Image) {
+	b := m.Bounds()
+	if p, ok := m.(*image.Paletted); ok {
+		// Only look at each palette entry once.
+		used := [256]bool{}
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			i := p.PixOffset(b.Min.X, y)
+			for _, ci := range p.Pix[i : i+b.Dx()] {
+				if !used[ci] {
+					used[ci] = true
+					s.add(paletteKey(p.Palette[ci]))
+				}
+			}
+		}
+		return
+	}
+	nrgba, _ := m.(*image.NRGBA)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			var c color.NRGBA64
+			if nrgba != nil {
+				p := nrgba.Pix[nrgba.PixOffset(x, y):]
+				c = color.NRGBA64{
+					R: uint16(p[0]) * 0x101,
+					G: uint16(p[1]) * 0x101,
+					B: uint16(p[2]) * 0x101,
+					A: uint16(p[3]) * 0x101,
+				}
+				if c.A == 0 {
+					c = color.NRGBA64{}
+				}
+			} else {
+				c = paletteKey(m.At(x, y))
+			}
+			s.add(c)
+		}
+	}
+}
+
+func (s *frameStats) add(c color.NRGBA64) {
+	if s.seen[c] {
+		return
+	}
+	// Once the palette overflows, colors are no longer remembered, so they
+	// are checked again each time they are used.
+	if len(s.palette) <= 256 {
+		s.seen[c] = true
+		s.palette = append(s.palette, color.NRGBA{
+			R: uint8(c.R >> 8),
+			G: uint8(c.G >> 8),
+			B: uint8(c.B >> 8),
+			A: uint8(c.A >> 8),
+		})
+	}
+	if c.R != c.G || c.G != c.B {
+		s.gray = false
+	}
+	if !is8(c.R) || !is8(c.G) || !is8(c.B) || !is8(c.A) {
+		s.depth8 = false
+	}
+	switch {
+	case c.A == 0xffff:
+	case c.A == 0:
+		if s.alpha == alphaOpaque {
+			s.alpha = alphaBinary
+		}
+	default:
+		s.alpha = alphaPartial
+	}
+}
+
+// is8 reports whether a 16 bit sample is exactly representable in 8 bits.
+func is8(v uint16) bool {
+	return v>>8 == v&0xff
+}
@@ -0,0 +1,88 @@
+package apng
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+// TestAnalyzeTranslucentPalette checks that translucent color.NRGBA palette
+// entries keep their 8 bit values, so the frames stay paletted.
+func TestAnalyzeTranslucentPalette(t *testing.T) {
+	p := color.Palette{
+		color.NRGBA{0x12, 0x34, 0x56, 0x78},
+		color.NRGBA{0xff, 0x00, 0x00, 0xff},
+		color.NRGBA{0x00, 0x00, 0x00, 0x00},
+	}
+	m := image.NewPaletted(image.Rect(0, 0, 3, 1), p)
+	m.Pix[0], m.Pix[1], m.Pix[2] = 0, 1, 2
+
+	a := Analyze(m)
+	if a.IHDR.ColorType != ColorType_Paletted || a.IHDR.BitDepth != BitDepth_8 {
+		t.Fatalf("got ColorType %d, BitDepth %d, want paletted with 8 bits", a.IHDR.ColorType, a.IHDR.BitDepth)
+	}
+	cm, err := a.Convert(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for x := 0; x < 3; x++ {
+		got := color.NRGBAModel.Convert(cm.At(x, 0))
+		if want := p[m.Pix[x]]; got != want {
+			t.Errorf("pixel %d: got %v, want %v", x, got, want)
+		}
+	}
+}
+
+// TestAnalyzeTranslucentRGBA checks that translucent pixels of an
+// *image.RGBA, as image/draw produces, are analyzed as the 8 bit colors the
+// encoder writes for them, rather than as 16 bit ones.
+func TestAnalyzeTranslucentRGBA(t *testing.T) {
+	r := image.Rect(0, 0, 4, 4)
+	m := image.NewRGBA(r)
+	n := image.NewNRGBA(r)
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 4; x++ {
+			c := color.NRGBA{uint8(60 * x), uint8(60 * y), 0x80, 0xff}
+			if x == 1 && y == 2 {
+				c.A = 0x80
+			}
+			m.Set(x, y, c)
+			n.Set(x, y, m.At(x, y))
+		}
+	}
+
+	for _, src := range []image.Image{m, n} {
+		a := Analyze(src)
+		if a.IHDR.ColorType != ColorType_Paletted || a.IHDR.BitDepth != BitDepth_8 {
+			t.Errorf("%T: got ColorType %d, BitDepth %d, want paletted with 8 bits", src, a.IHDR.ColorType, a.IHDR.BitDepth)
+			continue
+		}
+		cm, err := a.Convert(src)
+		if err != nil {
+			t.Fatalf("%T: %v", src, err)
+		}
+		for y := 0; y < 4; y++ {
+			for x := 0; x < 4; x++ {
+				if got, want := color.NRGBAModel.Convert(cm.At(x, y)), n.NRGBAAt(x, y); got != want {
+					t.Errorf("%T: pixel (%d, %d): got %v, want %v", src, x, y, got, want)
+				}
+			}
+		}
+	}
+}
+
+// TestAnalyzeTranslucentRGBAMany checks that an *image.RGBA with too many
+// colors for a palette is written with 8 bit truecolor and alpha, for which
+// the encoder has a fast path.
+func TestAnalyzeTranslucentRGBAMany(t *testing.T) {
+	m := image.NewRGBA(image.Rect(0, 0, 32, 32))
+	for y := 0; y < 32; y++ {
+		for x := 0; x < 32; x++ {
+			m.Set(x, y, color.NRGBA{uint8(8 * x), uint8(8 * y), 0x40, uint8(0x80 + 4*x)})
+		}
+	}
+	a := Analyze(m)
+	if a.IHDR.ColorType != ColorType_TrueColorAlpha || a.IHDR.BitDepth != BitDepth_8 {
+		t.Errorf("got ColorType %d, BitDepth %d, want truecolor with alpha and 8 bits", a.IHDR.ColorType, a.IHDR.BitDepth)
+	}
+}
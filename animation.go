@@ -0,0 +1,314 @@
+package apng
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"io"
+)
+
+// Animation is an APNG held in memory, as a canvas and a sequence of frames.
+type Animation struct {
+	Width, Height int    // Size of the canvas
+	NumPlays      uint32 // Number of times to loop the animation. 0 indicates infinite looping.
+
+	// Default is the default image shown by decoders without APNG support,
+	// when that is not the first frame.  It must be the size of the canvas.
+	// If Default is nil, the first frame is the default image, and must cover
+	// the whole canvas.
+	Default image.Image
+
+	Frames []Frame
+
+	// Chunks are ancillary chunks, such as eXIf or private chunks, to write
+	// before the image data.  Those that must come before PLTE, such as gAMA
+	// and iCCP, are written before it.  Chunks that belong to a frame go in
+	// the Frame's Chunks instead.
+	Chunks []*RawChunk
+}
+
+// Frame is one frame of an Animation.  The bounds of its image give the
+// frame's position and size within the canvas, as with image/gif.
+type Frame struct {
+	Image     image.Image
+	DelayNum  uint16    // Frame delay fraction numerator
+	DelayDen  uint16    // Frame delay fraction denominator; 0 is treated as 100
+	DisposeOp DisposeOp // Type of frame area disposal to be done after rendering this frame
+	BlendOp   BlendOp   // Type of frame area rendering for this frame
+
+	// Chunks are ancillary chunks that belong to the frame, such as private
+	// chunks with per-frame metadata.  They are written after the frame's
+	// fcTL, before its image data, and must not be chunks that have to come
+	// before PLTE.
+	Chunks []*RawChunk
+}
+
+// fcTL returns the frame control chunk for the frame.
+func (f *Frame) fcTL(seq uint32) *Chunk_fcTL {
+	b := f.Image.Bounds()
+	return &Chunk_fcTL{
+		SequenceNumber: seq,
+		Width:          uint32(b.Dx()),
+		Height:         uint32(b.Dy()),
+		XOffset:        uint32(b.Min.X),
+		YOffset:        uint32(b.Min.Y),
+		DelayNum:       f.DelayNum,
+		DelayDen:       f.DelayDen,
+		DisposeOp:      f.DisposeOp,
+		BlendOp:        f.BlendOp,
+	}
+}
+
+// Bounds returns the canvas rectangle, which has its origin at (0, 0).
+func (a *Animation) Bounds() image.Rectangle {
+	return image.Rect(0, 0, a.Width, a.Height)
+}
+
+// check verifies that the animation can be encoded.
+func (a *Animation) check() error {
+	canvas := a.Bounds()
+	if canvas.Empty() {
+		return FormatError(fmt.Sprintf("empty %dx%d canvas", a.Width, a.Height))
+	}
+	if len(a.Frames) == 0 {
+		return FormatError("animation has no frames")
+	}
+	if a.Default != nil && a.Default.Bounds() != canvas {
+		return FormatError(fmt.Sprintf("default image bounds %v are not the canvas %v", a.Default.Bounds(), canvas))
+	}
+	for i, f := range a.Frames {
+		b := f.Image.Bounds()
+		if b.Empty() || !b.In(canvas) {
+			return FormatError(fmt.Sprintf("frame %d bounds %v are not within the canvas %v", i, b, canvas))
+		}
+		if i == 0 && a.Default == nil && b != canvas {
+			return FormatError(fmt.Sprintf("frame 0 is the default image, but its bounds %v are not the canvas %v", b, canvas))
+		}
+		for _, c := range f.Chunks {
+			if beforePLTE[string(c.Type[:])] {
+				return FormatError(fmt.Sprintf("frame %d has a %s chunk, which must come before PLTE", i, c.Type))
+			}
+		}
+	}
+	return nil
+}
+
+// images returns the default image, if any, followed by the frame images.
+func (a *Animation) images() []image.Image {
+	var images []image.Image
+	if a.Default != nil {
+		images = append(images, a.Default)
+	}
+	for _, f := range a.Frames {
+		images = append(images, f.Image)
+	}
+	return images
+}
+
+// EncodeOptions controls how Encode writes an Animation.
+type EncodeOptions struct {
+	CompressionLevel CompressionLevel
+	Filter           FilterStrategy
+
+	// Quantize, if not nil, reduces every frame to a shared palette, which
+	// loses colors if there are more than fit.  Otherwise Encode uses Analyze
+	// to pick the smallest lossless color type and bit depth.
+	Quantize *QuantizeOptions
+}
+
+// Chunks that must come before PLTE, as per the PNG spec.
+var beforePLTE = map[string]bool{
+	"cHRM": true,
+	"cICP": true,
+	"gAMA": true,
+	"iCCP": true,
+	"mDCv": true,
+	"cLLI": true,
+	"sBIT": true,
+	"sRGB": true,
+}
+
+// chunkWriter writes chunks until the first error, which it keeps.
+type chunkWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (cw *chunkWriter) write(c io.WriterTo) {
+	if cw.err == nil {
+		_, cw.err = c.WriteTo(cw.w)
+	}
+}
+
+// encode writes the encoder's chunks.  Callers should not make an encoder
+// once there is an error, since each one starts encoding in the background.
+func (cw *chunkWriter) encode(e Encoder) {
+	for cw.err == nil && e.Next() {
+		cw.write(e.Chunk())
+	}
+	if cw.err != nil {
+		// Let the encoder finish, so that it does not block forever.
+		for e.Next() {
+		}
+		return
+	}
+	cw.err = e.Err()
+}
+
+// Encode writes the animation to w as an APNG.  A nil opts is the same as a
+// zero EncodeOptions.
+func Encode(w io.Writer, a *Animation, opts *EncodeOptions) error {
+	if opts == nil {
+		opts = &EncodeOptions{}
+	}
+	if err := a.check(); err != nil {
+		return err
+	}
+
+	images := a.images()
+	var ihdr *Chunk_IHDR
+	var plte *Chunk_PLTE
+	var trns *Chunk_tRNS
+	if opts.Quantize != nil {
+		g, paletted, err := Quantize(images, opts.Quantize)
+		if err != nil {
+			return err
+		}
+		ihdr = &Chunk_IHDR{BitDepth: BitDepth_8, ColorType: ColorType_Paletted}
+		plte, trns = g.PLTE, g.TRNS
+		for i, p := range paletted {
+			images[i] = p
+		}
+	} else {
+		an := Analyze(images...)
+		ihdr, plte, trns = an.IHDR, an.PLTE, an.TRNS
+		for i, m := range images {
+			m, err := an.Convert(m)
+			if err != nil {
+				return err
+			}
+			images[i] = m
+		}
+	}
+	ihdr.Width, ihdr.Height = uint32(a.Width), uint32(a.Height)
+
+	cw := &chunkWriter{w: w}
+	if _, err := io.WriteString(w, PngHeader); err != nil {
+		return err
+	}
+	cw.write(ihdr)
+	cw.write(&Chunk_acTL{NumFrames: uint32(len(a.Frames)), NumPlays: a.NumPlays})
+	for _, c := range a.Chunks {
+		if beforePLTE[string(c.Type[:])] {
+			cw.write(c)
+		}
+	}
+	if plte != nil {
+		cw.write(plte)
+	}
+	if trns != nil {
+		cw.write(trns)
+	}
+	for _, c := range a.Chunks {
+		if !beforePLTE[string(c.Type[:])] {
+			cw.write(c)
+		}
+	}
+	if cw.err != nil {
+		return cw.err
+	}
+
+	if a.Default != nil {
+		cw.encode(ihdr.newEncoder_IDAT(images[0], opts.CompressionLevel, opts.Filter))
+		images = images[1:]
+	}
+	seq := NewSequenceNumbers()
+	for i := range a.Frames {
+		fctl := a.Frames[i].fcTL(seq.Next())
+		cw.write(fctl)
+		for _, c := range a.Frames[i].Chunks {
+			cw.write(c)
+		}
+		if cw.err != nil {
+			return cw.err
+		}
+		if i == 0 && a.Default == nil {
+			cw.encode(ihdr.newEncoder_IDAT(images[i], opts.CompressionLevel, opts.Filter))
+		} else {
+			cw.encode(fctl.newEncoder_fdAT(ihdr, seq, images[i], opts.CompressionLevel, opts.Filter))
+		}
+	}
+	cw.write(&Chunk_IEND{})
+	return cw.err
+}
+
+// Crop shrinks each frame to the smallest rectangle that differs from the
+// frame before it, so that only changed pixels are encoded.  This applies to
+// frames that, like the one before them, cover the whole canvas with
+// DisposeOp_None and BlendOp_Source, as when every frame is a full rendering
+// of the canvas; other frames are left as they are.  A frame that does not
+// change anything is cropped to a single pixel.
+func (a *Animation) Crop() {
+	canvas := a.Bounds()
+	var prev image.Image // The canvas after the previous frame, if known
+	for i := range a.Frames {
+		f := &a.Frames[i]
+		m := f.Image
+		if m.Bounds() != canvas || f.BlendOp != BlendOp_Source {
+			prev = nil
+			continue
+		}
+		if prev != nil {
+			r := diffBounds(prev, m)
+			if r.Empty() {
+				r = image.Rect(0, 0, 1, 1)
+			}
+			f.Image = subImage(m, r)
+		}
+		prev = nil
+		if f.DisposeOp == DisposeOp_None {
+			prev = m
+		}
+	}
+}
+
+// diffBounds returns the smallest rectangle outside which a and b, which have
+// the same bounds, are the same.  All fully transparent colors are the same.
+func diffBounds(a, b image.Image) image.Rectangle {
+	r := image.Rectangle{}
+	bounds := b.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		x0, x1, ok := diffRow(a, b, y)
+		if ok {
+			r = r.Union(image.Rect(x0, y, x1, y+1))
+		}
+	}
+	return r
+}
+
+// diffRow returns the span of row y in which a and b differ, if they do.
+func diffRow(a, b image.Image, y int) (x0, x1 int, ok bool) {
+	bounds := b.Bounds()
+	if a, ok := a.(*image.NRGBA); ok {
+		if b, ok := b.(*image.NRGBA); ok {
+			i, j := a.PixOffset(bounds.Min.X, y), b.PixOffset(bounds.Min.X, y)
+			if bytes.Equal(a.Pix[i:i+4*bounds.Dx()], b.Pix[j:j+4*bounds.Dx()]) {
+				return 0, 0, false
+			}
+		}
+	}
+	same := func(x int) bool {
+		return paletteKey(a.At(x, y)) == paletteKey(b.At(x, y))
+	}
+	x0, x1 = bounds.Min.X, bounds.Max.X
+	for x0 < x1 && same(x0) {
+		x0++
+	}
+	if x0 == x1 {
+		return 0, 0, false
+	}
+	for same(x1 - 1) {
+		x1--
+	}
+	return x0, x1, true
+}
@@ -0,0 +1,221 @@
+package apng
+
+import (
+	"bytes"
+	"compress/zlib"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// testAnimation makes full canvas frames of a square moving over a gradient.
+func testAnimation(n int) *Animation {
+	a := &Animation{Width: 60, Height: 40, NumPlays: 2}
+	bg := testSource("OpaqueNRGBA", a.Bounds(), 1)
+	for i := 0; i < n; i++ {
+		m := image.NewNRGBA(a.Bounds())
+		draw.Draw(m, m.Bounds(), bg, image.Point{}, draw.Src)
+		draw.Draw(m, image.Rect(0, 0, 8, 8).Add(image.Pt(5*i, 3*i)), image.NewUniform(color.NRGBA{0, 0, 0xff, 0x80}), image.Point{}, draw.Src)
+		a.Frames = append(a.Frames, Frame{Image: m, DelayNum: uint16(i + 1), DelayDen: 50})
+	}
+	return a
+}
+
+func TestEncode(t *testing.T) {
+	exif := []byte("MM\x00\x2a\x00\x00\x00\x08\x00\x00")
+	for _, tc := range []struct {
+		name    string
+		crop    bool
+		deflt   bool
+		opts    *EncodeOptions
+		lossy   bool
+		chunks  []*RawChunk
+		wantPal bool
+	}{
+		{name: "Lossless"},
+		{name: "Crop", crop: true},
+		{name: "Default", deflt: true, crop: true},
+		{name: "Chunks", chunks: []*RawChunk{{Type: [4]byte{'e', 'X', 'I', 'f'}, Data: exif}, {Type: [4]byte{'g', 'A', 'M', 'A'}, Data: []byte{0, 1, 0x86, 0xa0}}}},
+		{name: "Quantize", crop: true, opts: &EncodeOptions{CompressionLevel: BestSpeed, Quantize: &QuantizeOptions{NumColors: 64}}, lossy: true, wantPal: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			a := testAnimation(5)
+			full := make([]image.Image, len(a.Frames))
+			for i, f := range a.Frames {
+				full[i] = f.Image
+			}
+			if tc.deflt {
+				a.Default = image.NewGray(a.Bounds())
+			}
+			if tc.crop {
+				a.Crop()
+				for i, f := range a.Frames[1:] {
+					if f.Image.Bounds() == a.Bounds() {
+						t.Errorf("frame %d not cropped", i+1)
+					}
+				}
+			}
+			a.Chunks = tc.chunks
+
+			buf := bytes.NewBuffer(nil)
+			if err := Encode(buf, a, tc.opts); err != nil {
+				t.Fatal(err)
+			}
+			if problems := Validate(bytes.NewReader(buf.Bytes())); problems != nil {
+				t.Fatal(problems)
+			}
+
+			var types []string
+			cr := NewChunkReader(bytes.NewReader(buf.Bytes()))
+			for cr.Next() {
+				types = append(types, string(cr.Chunk().Type[:]))
+			}
+			for i, c := range tc.chunks {
+				found := false
+				for j, typ := range types {
+					if typ == string(c.Type[:]) {
+						found = true
+						if c.Type == [4]byte{'g', 'A', 'M', 'A'} && types[j-1] != "acTL" {
+							t.Errorf("gAMA after %s", types[j-1])
+						}
+					}
+				}
+				if !found {
+					t.Errorf("chunk %d (%s) missing", i, c.Type)
+				}
+			}
+			if hasPLTE := bytes.Contains(buf.Bytes(), []byte("PLTE")); hasPLTE != tc.wantPal {
+				t.Errorf("PLTE: got %v, want %v", hasPLTE, tc.wantPal)
+			}
+
+			fctls, got := decodeFrames(t, buf.Bytes())
+			if len(got) != len(a.Frames) {
+				t.Fatalf("got %d frames, want %d", len(got), len(a.Frames))
+			}
+			for i, f := range a.Frames {
+				want := f.fcTL(fctls[i].SequenceNumber)
+				if *fctls[i] != *want {
+					t.Errorf("frame %d: got %+v, want %+v", i, *fctls[i], *want)
+				}
+				if !tc.lossy {
+					compareImages(t, got[i], subImage(full[i], f.Image.Bounds()), 0)
+				}
+			}
+		})
+	}
+}
+
+// TestEncodeFilter checks that EncodeOptions' Filter reaches the encoders:
+// FilterStrategy_None leaves every row unfiltered, and FilterStrategy_Adaptive
+// filters the rows of a noisy image.
+func TestEncodeFilter(t *testing.T) {
+	a := testAnimation(1)
+	for _, f := range []FilterStrategy{FilterStrategy_None, FilterStrategy_Adaptive} {
+		buf := bytes.NewBuffer(nil)
+		if err := Encode(buf, a, &EncodeOptions{Filter: f}); err != nil {
+			t.Fatal(err)
+		}
+		var idat []byte
+		cr := NewChunkReader(buf)
+		for cr.Next() {
+			if c := cr.Chunk(); string(c.Type[:]) == "IDAT" {
+				idat = append(idat, c.Data...)
+			}
+		}
+		if err := cr.Err(); err != nil {
+			t.Fatal(err)
+		}
+		zr, err := zlib.NewReader(bytes.NewReader(idat))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rows, err := io.ReadAll(zr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		filtered := 0
+		stride := len(rows) / a.Height
+		for y := 0; y < a.Height; y++ {
+			if rows[y*stride] != ftNone {
+				filtered++
+			}
+		}
+		if f == FilterStrategy_None && filtered != 0 || f == FilterStrategy_Adaptive && filtered == 0 {
+			t.Errorf("FilterStrategy %d: %d of %d rows filtered", f, filtered, a.Height)
+		}
+	}
+}
+
+func TestEncodeErrors(t *testing.T) {
+	m := image.NewNRGBA(image.Rect(0, 0, 10, 10))
+	for _, tc := range []struct {
+		name string
+		a    *Animation
+	}{
+		{"NoFrames", &Animation{Width: 10, Height: 10}},
+		{"EmptyCanvas", &Animation{Frames: []Frame{{Image: m}}}},
+		{"OutsideCanvas", &Animation{Width: 5, Height: 5, Default: image.NewNRGBA(image.Rect(0, 0, 5, 5)), Frames: []Frame{{Image: m}}}},
+		{"FirstFrameNotCanvas", &Animation{Width: 20, Height: 20, Frames: []Frame{{Image: m}}}},
+		{"DefaultNotCanvas", &Animation{Width: 20, Height: 20, Default: m, Frames: []Frame{{Image: m}}}},
+	} {
+		if err := Encode(bytes.NewBuffer(nil), tc.a, nil); err == nil {
+			t.Errorf("%s: no error", tc.name)
+		}
+	}
+}
+
+// failWriter fails once n bytes have been written.
+type failWriter struct {
+	n int
+}
+
+func (w *failWriter) Write(b []byte) (int, error) {
+	if len(b) > w.n {
+		n := w.n
+		w.n = 0
+		return n, io.ErrShortWrite
+	}
+	w.n -= len(b)
+	return len(b), nil
+}
+
+// TestEncodeWriteError checks that Encode and StreamEncoder return a write
+// error, and do not leave encoders blocked behind it.
+func TestEncodeWriteError(t *testing.T) {
+	r := image.Rect(0, 0, 300, 200)
+	a := &Animation{Width: 300, Height: 200}
+	for i := 0; i < 4; i++ {
+		a.Frames = append(a.Frames, Frame{Image: testSource("NRGBA", r, int64(i))})
+	}
+	before := runtime.NumGoroutine()
+	for _, n := range []int{0, 100, 50000, 300000} {
+		if err := Encode(&failWriter{n}, a, &EncodeOptions{CompressionLevel: NoCompression}); err == nil {
+			t.Errorf("Encode, failing after %d bytes: no error", n)
+		}
+
+		e, err := NewStreamEncoder(&failWriter{n}, &Chunk_IHDR{Width: 300, Height: 200, BitDepth: BitDepth_8, ColorType: ColorType_TrueColorAlpha}, &StreamOptions{NumFrames: 4, CompressionLevel: NoCompression})
+		if err != nil {
+			continue
+		}
+		for _, f := range a.Frames {
+			err = e.WriteFrame(f.Image)
+		}
+		if err == nil {
+			err = e.Close()
+		}
+		if err == nil {
+			t.Errorf("StreamEncoder, failing after %d bytes: no error", n)
+		}
+	}
+	// The encoders' goroutines finish soon after being drained.
+	for i := 0; runtime.NumGoroutine() > before; i++ {
+		if i == 100 {
+			t.Fatalf("%d goroutines left running, from %d", runtime.NumGoroutine(), before)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,206 @@
+package apng
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+)
+
+// opaque hides the concrete type of an image, forcing the generic m.At path.
+type opaque struct {
+	image.Image
+}
+
+// benchSource makes a size x size image of the named type, with gradients, a
+// few shapes and some noise so that it neither compresses trivially nor is
+// incompressible.  Unless alpha is set, every pixel is opaque, as the color
+// types without an alpha channel require.
+func benchSource(kind string, size int, alpha bool) image.Image {
+	r := image.Rect(0, 0, size, size)
+	rnd := rand.New(rand.NewSource(1))
+	master := image.NewNRGBA64(r)
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			c := color.NRGBA64{
+				R: uint16(x * 0xffff / size),
+				G: uint16(y * 0xffff / size),
+				B: uint16((x + y) * 0x7fff / size),
+				A: 0xffff,
+			}
+			if alpha && (x/16+y/16)%3 == 0 {
+				c.A = uint16(x * 0xffff / size)
+			}
+			if rnd.Intn(8) == 0 {
+				c.R ^= uint16(rnd.Intn(0x1000))
+			}
+			master.SetNRGBA64(x, y, c)
+		}
+	}
+
+	var m draw.Image
+	switch kind {
+	case "Gray":
+		m = image.NewGray(r)
+	case "Gray16":
+		m = image.NewGray16(r)
+	case "RGBA":
+		m = image.NewRGBA(r)
+	case "NRGBA":
+		m = image.NewNRGBA(r)
+	case "RGBA64":
+		m = image.NewRGBA64(r)
+	case "NRGBA64":
+		return master
+	case "Paletted":
+		m = image.NewPaletted(r, palette.Plan9)
+	case "YCbCr":
+		y := image.NewYCbCr(r, image.YCbCrSubsampleRatio420)
+		fillYCbCr(y, master)
+		return y
+	case "NYCbCrA":
+		y := image.NewNYCbCrA(r, image.YCbCrSubsampleRatio420)
+		fillYCbCr(&y.YCbCr, master)
+		for i := range y.A {
+			y.A[i] = uint8(master.Pix[8*i+6])
+		}
+		return y
+	case "Image":
+		return opaque{benchSource("NRGBA", size, alpha)}
+	default:
+		panic("unknown image type " + kind)
+	}
+	draw.Draw(m, r, master, image.Point{}, draw.Src)
+	return m
+}
+
+func fillYCbCr(m *image.YCbCr, src image.Image) {
+	b := m.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.NRGBAModel.Convert(src.At(x, y)).(color.NRGBA)
+			yy, cb, cr := color.RGBToYCbCr(c.R, c.G, c.B)
+			m.Y[m.YOffset(x, y)] = yy
+			m.Cb[m.COffset(x, y)] = cb
+			m.Cr[m.COffset(x, y)] = cr
+		}
+	}
+}
+
+var benchFormats = []struct {
+	name    string
+	ihdr    Chunk_IHDR
+	sources []string
+}{
+	{"G8", Chunk_IHDR{ColorType: ColorType_Grayscale, BitDepth: BitDepth_8}, []string{"Gray", "Gray16", "Image"}},
+	{"TC8", Chunk_IHDR{ColorType: ColorType_TrueColor, BitDepth: BitDepth_8}, []string{"RGBA", "NRGBA", "RGBA64", "NRGBA64", "YCbCr", "Image"}},
+	{"P8", Chunk_IHDR{ColorType: ColorType_Paletted, BitDepth: BitDepth_8}, []string{"Paletted"}},
+	{"TCA8", Chunk_IHDR{ColorType: ColorType_TrueColorAlpha, BitDepth: BitDepth_8}, []string{"NRGBA", "RGBA", "RGBA64", "NRGBA64", "YCbCr", "NYCbCrA", "Image"}},
+	{"G16", Chunk_IHDR{ColorType: ColorType_Grayscale, BitDepth: BitDepth_16}, []string{"Gray16", "Image"}},
+	{"TC16", Chunk_IHDR{ColorType: ColorType_TrueColor, BitDepth: BitDepth_16}, []string{"RGBA64", "NRGBA64", "Image"}},
+	{"TCA16", Chunk_IHDR{ColorType: ColorType_TrueColorAlpha, BitDepth: BitDepth_16}, []string{"NRGBA64", "RGBA64", "Image"}},
+}
+
+var benchLevels = []struct {
+	name string
+	cl   CompressionLevel
+}{
+	{"Default", DefaultCompression},
+	{"None", NoCompression},
+	{"BestSpeed", BestSpeed},
+	{"Best", BestCompression},
+}
+
+var benchSizes = []int{64, 512}
+
+// drain writes out every chunk of the encoder.
+func drain(b *testing.B, e Encoder) {
+	for e.Next() {
+		e.Chunk().WriteTo(ioutil.Discard)
+	}
+	if err := e.Err(); err != nil {
+		b.Fatal(err)
+	}
+}
+
+// benchEncoders runs newEncoder over every format, source type, size and
+// compression level.
+func benchEncoders(b *testing.B, newEncoder func(ihdr *Chunk_IHDR, m image.Image, cl CompressionLevel) Encoder) {
+	for _, f := range benchFormats {
+		for _, src := range f.sources {
+			for _, size := range benchSizes {
+				m := benchSource(src, size, f.ihdr.ColorType == ColorType_TrueColorAlpha)
+				ihdr := f.ihdr
+				ihdr.Width, ihdr.Height = uint32(size), uint32(size)
+				for _, l := range benchLevels {
+					name := fmt.Sprintf("%s/%s/%dx%d/%s", f.name, src, size, size, l.name)
+					b.Run(name, func(b *testing.B) {
+						b.ReportAllocs()
+						b.SetBytes(int64(size * size * int(ihdr.BitDepth) / 8 * channels(ihdr.ColorType)))
+						for i := 0; i < b.N; i++ {
+							drain(b, newEncoder(&ihdr, m, l.cl))
+						}
+					})
+				}
+			}
+		}
+	}
+}
+
+func channels(ct ColorType) int {
+	switch ct {
+	case ColorType_TrueColor:
+		return 3
+	case ColorType_GrayscaleAlpha:
+		return 2
+	case ColorType_TrueColorAlpha:
+		return 4
+	}
+	return 1
+}
+
+func BenchmarkEncoder_IDAT(b *testing.B) {
+	benchEncoders(b, func(ihdr *Chunk_IHDR, m image.Image, cl CompressionLevel) Encoder {
+		return ihdr.NewEncoder_IDAT(m, cl)
+	})
+}
+
+func BenchmarkEncoder_fdAT(b *testing.B) {
+	seq := NewSequenceNumbers()
+	benchEncoders(b, func(ihdr *Chunk_IHDR, m image.Image, cl CompressionLevel) Encoder {
+		return ihdr.NewEncoder_fdAT(seq, m, cl)
+	})
+}
+
+func BenchmarkFilter(b *testing.B) {
+	for _, bpp := range []int{1, 2, 3, 4, 6, 8} {
+		for _, content := range []string{"Gradient", "Noise"} {
+			b.Run(fmt.Sprintf("bpp%d/%s", bpp, content), func(b *testing.B) {
+				const width = 1024
+				rnd := rand.New(rand.NewSource(1))
+				var cr [nFilter][]byte
+				for i := range cr {
+					cr[i] = make([]byte, 1+bpp*width)
+					cr[i][0] = uint8(i)
+				}
+				pr := make([]byte, 1+bpp*width)
+				for i := 1; i < len(pr); i++ {
+					if content == "Noise" {
+						pr[i], cr[0][i] = uint8(rnd.Intn(256)), uint8(rnd.Intn(256))
+					} else {
+						pr[i], cr[0][i] = uint8(i/bpp), uint8(i/bpp+1)
+					}
+				}
+				b.SetBytes(int64(bpp * width))
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					filter(&cr, pr, bpp)
+				}
+			})
+		}
+	}
+}
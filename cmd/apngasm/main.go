@@ -0,0 +1,251 @@
+// Command apngasm assembles an APNG from a sequence of PNG frames.
+//
+// Usage:
+//
+//	apngasm -o out.png [flags] frames...
+//
+// Each argument is a PNG file, a glob pattern such as 'frames/*.png', or a
+// directory, which stands for every PNG file in it.  The frames of a pattern or
+// directory are sorted by name, with runs of digits compared as numbers, so
+// frame2.png comes before frame10.png.  Every frame must be the same size.
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/shutej/apng"
+)
+
+var (
+	output      = flag.String("o", "", "output APNG file")
+	delay       = flag.String("delay", "1/10", "delay of every frame, in seconds, as a fraction NUM/DEN")
+	delays      = flag.String("delays", "", "comma-separated delays NUM/DEN, one per animation frame, overriding -delay")
+	loops       = flag.Uint("loops", 0, "number of times to play the animation; 0 loops forever")
+	compression = flag.String("compression", "default", "compression level: default, none, speed or best")
+	crop        = flag.Bool("crop", true, "only encode the region of each frame that changed")
+	colors      = flag.Int("quantize", 0, "reduce to a palette of this many colors (2 to 256), which is lossy; 0 keeps every color")
+	dither      = flag.String("dither", "none", "dithering when quantizing: none, floyd-steinberg or ordered")
+	tolerance   = flag.Uint("tolerance", 0, "when quantizing, keep the previous frame's color where a channel changed by at most this much")
+	skipFirst   = flag.Bool("skip-first", false, "use the first frame only as the default image, not as part of the animation")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: apngasm -o out.png [flags] frames...\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if *output == "" || flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err := run(); err != nil {
+		fmt.Fprintf(os.Stderr, "apngasm: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	files, err := frameFiles(flag.Args())
+	if err != nil {
+		return err
+	}
+	numFrames := len(files)
+	if *skipFirst {
+		if numFrames < 2 {
+			return fmt.Errorf("-skip-first needs at least two frames")
+		}
+		numFrames--
+	}
+	frameDelays, err := parseDelays(numFrames)
+	if err != nil {
+		return err
+	}
+	opts, err := encodeOptions()
+	if err != nil {
+		return err
+	}
+
+	a := &apng.Animation{NumPlays: uint32(*loops)}
+	for i, name := range files {
+		m, err := readPNG(name)
+		if err != nil {
+			return err
+		}
+		b := m.Bounds()
+		if i == 0 {
+			a.Width, a.Height = b.Dx(), b.Dy()
+		} else if b.Dx() != a.Width || b.Dy() != a.Height {
+			return fmt.Errorf("%s: %dx%d frame, want %dx%d like %s", name, b.Dx(), b.Dy(), a.Width, a.Height, files[0])
+		}
+		if i == 0 && *skipFirst {
+			a.Default = m
+			continue
+		}
+		d := frameDelays[len(a.Frames)]
+		a.Frames = append(a.Frames, apng.Frame{
+			Image:    m,
+			DelayNum: d[0],
+			DelayDen: d[1],
+		})
+	}
+	if *crop {
+		a.Crop()
+	}
+
+	f, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	if err := apng.Encode(w, a, opts); err != nil {
+		f.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// frameFiles expands the arguments into frame file names.
+func frameFiles(args []string) ([]string, error) {
+	var files []string
+	for _, arg := range args {
+		if fi, err := os.Stat(arg); err == nil {
+			if !fi.IsDir() {
+				files = append(files, arg)
+				continue
+			}
+			arg = filepath.Join(arg, "*.png")
+		}
+		matches, err := filepath.Glob(arg)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", arg, err)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("%s: no frames", arg)
+		}
+		sort.Slice(matches, func(i, j int) bool { return naturalLess(matches[i], matches[j]) })
+		files = append(files, matches...)
+	}
+	return files, nil
+}
+
+// naturalLess compares a and b, treating runs of digits as numbers.
+func naturalLess(a, b string) bool {
+	for a != "" && b != "" {
+		da, db := digits(a), digits(b)
+		if da > 0 && db > 0 {
+			na, nb := strings.TrimLeft(a[:da], "0"), strings.TrimLeft(b[:db], "0")
+			if len(na) != len(nb) {
+				return len(na) < len(nb)
+			}
+			if na != nb {
+				return na < nb
+			}
+			a, b = a[da:], b[db:]
+			continue
+		}
+		if a[0] != b[0] {
+			return a[0] < b[0]
+		}
+		a, b = a[1:], b[1:]
+	}
+	return len(a) < len(b)
+}
+
+func digits(s string) int {
+	n := 0
+	for n < len(s) && '0' <= s[n] && s[n] <= '9' {
+		n++
+	}
+	return n
+}
+
+// parseDelays returns the delay of each of n frames.
+func parseDelays(n int) ([][2]uint16, error) {
+	d, err := parseDelay(*delay)
+	if err != nil {
+		return nil, err
+	}
+	out := make([][2]uint16, n)
+	for i := range out {
+		out[i] = d
+	}
+	if *delays == "" {
+		return out, nil
+	}
+	list := strings.Split(*delays, ",")
+	if len(list) != n {
+		return nil, fmt.Errorf("-delays has %d delays for %d frames", len(list), n)
+	}
+	for i, s := range list {
+		if out[i], err = parseDelay(strings.TrimSpace(s)); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// parseDelay parses a delay of the form NUM/DEN.
+func parseDelay(s string) ([2]uint16, error) {
+	num, den, ok := strings.Cut(s, "/")
+	if !ok {
+		return [2]uint16{}, fmt.Errorf("delay %q is not of the form NUM/DEN", s)
+	}
+	n, err := strconv.ParseUint(num, 10, 16)
+	if err != nil {
+		return [2]uint16{}, fmt.Errorf("delay %q: %v", s, err)
+	}
+	d, err := strconv.ParseUint(den, 10, 16)
+	if err != nil {
+		return [2]uint16{}, fmt.Errorf("delay %q: %v", s, err)
+	}
+	return [2]uint16{uint16(n), uint16(d)}, nil
+}
+
+func encodeOptions() (*apng.EncodeOptions, error) {
+	opts := &apng.EncodeOptions{}
+	var err error
+	if opts.CompressionLevel, err = apng.ParseCompressionLevel(*compression); err != nil {
+		return nil, err
+	}
+	if *colors == 0 {
+		return opts, nil
+	}
+	if *colors < 2 || *colors > 256 {
+		return nil, fmt.Errorf("-quantize %d is not between 2 and 256", *colors)
+	}
+	if *tolerance > 255 {
+		return nil, fmt.Errorf("-tolerance %d is more than 255", *tolerance)
+	}
+	opts.Quantize = &apng.QuantizeOptions{NumColors: *colors, Tolerance: uint8(*tolerance)}
+	if opts.Quantize.Dither, err = apng.ParseDither(*dither); err != nil {
+		return nil, err
+	}
+	return opts, nil
+}
+
+func readPNG(name string) (image.Image, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	m, err := png.Decode(bufio.NewReader(f))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return m, nil
+}
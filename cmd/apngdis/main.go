@@ -0,0 +1,191 @@
+// Command apngdis splits an APNG into numbered PNG frames.
+//
+// Usage:
+//
+//	apngdis [flags] in.png
+//
+// By default each frame is written as it is stored, at the size of its frame
+// control chunk.  With -composite, each frame is written as it is displayed,
+// at the size of the canvas, after applying the dispose and blend operators.
+// A sidecar file describes each frame's offsets, delay and operators, as JSON
+// or as text.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/shutej/apng"
+)
+
+var (
+	outDir    = flag.String("o", ".", "output directory")
+	prefix    = flag.String("prefix", "frame", "prefix of the output file names")
+	composite = flag.Bool("composite", false, "write fully composited frames rather than the stored sub-frames")
+	format    = flag.String("format", "json", "format of the sidecar file: json, text or none")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: apngdis [flags] in.png\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err := run(flag.Arg(0)); err != nil {
+		fmt.Fprintf(os.Stderr, "apngdis: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// sidecar describes the animation and its frames.
+type sidecar struct {
+	Width     int          `json:"width"`
+	Height    int          `json:"height"`
+	NumPlays  uint32       `json:"num_plays"`
+	Composite bool         `json:"composite"`
+	Default   string       `json:"default,omitempty"` // File of the default image, if it is not the first frame
+	Frames    []frameEntry `json:"frames"`
+}
+
+// frameEntry holds the fields of a frame's fcTL chunk.
+type frameEntry struct {
+	File      string `json:"file"`
+	Width     int    `json:"width"`
+	Height    int    `json:"height"`
+	XOffset   int    `json:"x_offset"`
+	YOffset   int    `json:"y_offset"`
+	DelayNum  uint16 `json:"delay_num"`
+	DelayDen  uint16 `json:"delay_den"`
+	DisposeOp string `json:"dispose_op"`
+	BlendOp   string `json:"blend_op"`
+}
+
+func run(name string) error {
+	switch *format {
+	case "json", "text", "none":
+	default:
+		return fmt.Errorf("unknown sidecar format %q", *format)
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	a, err := apng.Decode(bufio.NewReader(f))
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	if err := os.MkdirAll(*outDir, 0777); err != nil {
+		return err
+	}
+
+	s := &sidecar{
+		Width:     a.Width,
+		Height:    a.Height,
+		NumPlays:  a.NumPlays,
+		Composite: *composite,
+	}
+	digits := len(fmt.Sprint(len(a.Frames) - 1))
+	if digits < 3 {
+		digits = 3
+	}
+	if a.Default != nil {
+		s.Default = *prefix + "_default.png"
+		if err := writePNG(s.Default, a.Default); err != nil {
+			return err
+		}
+	}
+	for i, fr := range a.Frames {
+		b := fr.Image.Bounds()
+		s.Frames = append(s.Frames, frameEntry{
+			File:      fmt.Sprintf("%s%0*d.png", *prefix, digits, i),
+			Width:     b.Dx(),
+			Height:    b.Dy(),
+			XOffset:   b.Min.X,
+			YOffset:   b.Min.Y,
+			DelayNum:  fr.DelayNum,
+			DelayDen:  fr.DelayDen,
+			DisposeOp: fr.DisposeOp.String(),
+			BlendOp:   fr.BlendOp.String(),
+		})
+	}
+
+	if *composite {
+		c := a.NewCompositor()
+		for c.Next() {
+			if err := writePNG(s.Frames[c.Frame()].File, c.Image()); err != nil {
+				return err
+			}
+		}
+	} else {
+		// The encoded PNG holds just the frame's bounds.
+		for i, fr := range a.Frames {
+			if err := writePNG(s.Frames[i].File, fr.Image); err != nil {
+				return err
+			}
+		}
+	}
+
+	switch *format {
+	case "json":
+		return writeFile(*prefix+".json", func(w io.Writer) error {
+			e := json.NewEncoder(w)
+			e.SetIndent("", "  ")
+			return e.Encode(s)
+		})
+	case "text":
+		return writeFile(*prefix+".txt", s.writeText)
+	}
+	return nil
+}
+
+// writeText writes the sidecar as one line per frame of key=value pairs.
+func (s *sidecar) writeText(w io.Writer) error {
+	fmt.Fprintf(w, "width=%d height=%d num_plays=%d composite=%v\n", s.Width, s.Height, s.NumPlays, s.Composite)
+	if s.Default != "" {
+		fmt.Fprintf(w, "default=%s\n", s.Default)
+	}
+	for _, f := range s.Frames {
+		_, err := fmt.Fprintf(w, "file=%s width=%d height=%d x_offset=%d y_offset=%d delay=%d/%d dispose_op=%s blend_op=%s\n",
+			f.File, f.Width, f.Height, f.XOffset, f.YOffset, f.DelayNum, f.DelayDen, f.DisposeOp, f.BlendOp)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writePNG(name string, m image.Image) error {
+	return writeFile(name, func(w io.Writer) error {
+		return png.Encode(w, m)
+	})
+}
+
+// writeFile creates the named file in the output directory and writes it.
+func writeFile(name string, write func(w io.Writer) error) error {
+	f, err := os.Create(filepath.Join(*outDir, name))
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	if err := write(w); err != nil {
+		f.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,380 @@
+// Command apnginfo prints the chunk structure of a PNG or APNG.
+//
+// Usage:
+//
+//	apnginfo [-json] file.png...
+//
+// For every chunk it prints the type, offset, data length and whether the CRC
+// is valid, followed by the decoded fields of IHDR, acTL, fcTL and fdAT, the
+// number of PLTE and tRNS entries, and the keyword and text of tEXt, zTXt and
+// iTXt chunks.  With -json it prints one JSON object per file instead.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/shutej/apng"
+)
+
+var jsonOutput = flag.Bool("json", false, "print JSON rather than text")
+
+// maxText is the most decompressed text printed for a zTXt or iTXt chunk.
+const maxText = 1 << 20
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: apnginfo [-json] file.png...\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	w := bufio.NewWriter(os.Stdout)
+	status := 0
+	for _, name := range flag.Args() {
+		info := inspect(name)
+		if *jsonOutput {
+			e := json.NewEncoder(w)
+			e.SetIndent("", "  ")
+			if err := e.Encode(info); err != nil {
+				fmt.Fprintf(os.Stderr, "apnginfo: %s: %v\n", name, err)
+				os.Exit(1)
+			}
+		} else {
+			info.writeText(w)
+		}
+		if info.Error != "" {
+			status = 1
+		}
+	}
+	if err := w.Flush(); err != nil {
+		fmt.Fprintf(os.Stderr, "apnginfo: %v\n", err)
+		os.Exit(1)
+	}
+	os.Exit(status)
+}
+
+// fileInfo describes a file's chunks, and the error that stopped reading it,
+// if any.
+type fileInfo struct {
+	File   string       `json:"file"`
+	Chunks []*chunkInfo `json:"chunks"`
+	Error  string       `json:"error,omitempty"`
+}
+
+// chunkInfo describes a chunk.  Fields holds the decoded fields of known
+// chunk types, and Error why they could not be decoded.
+type chunkInfo struct {
+	Type     string `json:"type"`
+	Offset   int64  `json:"offset"`
+	Length   int    `json:"length"`
+	CRC      string `json:"crc"`
+	ValidCRC bool   `json:"valid_crc"`
+	Fields   fields `json:"fields,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// fields are the decoded fields of a chunk.
+type fields interface {
+	// String formats the fields on one line.
+	String() string
+}
+
+func inspect(name string) *fileInfo {
+	info := &fileInfo{File: name, Chunks: []*chunkInfo{}}
+	f, err := os.Open(name)
+	if err != nil {
+		info.Error = err.Error()
+		return info
+	}
+	defer f.Close()
+	cr := apng.NewChunkReader(bufio.NewReader(f))
+	for cr.Next() {
+		c := cr.Chunk()
+		ci := &chunkInfo{
+			Type:     string(c.Type[:]),
+			Offset:   cr.Offset(),
+			Length:   len(c.Data),
+			CRC:      fmt.Sprintf("%08x", cr.CRC()),
+			ValidCRC: cr.ValidCRC(),
+		}
+		if ci.Fields, err = decode(c); err != nil {
+			ci.Error = err.Error()
+		}
+		info.Chunks = append(info.Chunks, ci)
+	}
+	if err := cr.Err(); err != nil {
+		info.Error = fmt.Sprintf("offset %d: %v", cr.Offset(), err)
+	}
+	return info
+}
+
+func (info *fileInfo) writeText(w io.Writer) {
+	fmt.Fprintf(w, "%s:\n", info.File)
+	for _, c := range info.Chunks {
+		crc := "ok"
+		if !c.ValidCRC {
+			crc = "BAD"
+		}
+		fmt.Fprintf(w, "  %s  offset %d  length %d  crc %s %s\n", c.Type, c.Offset, c.Length, c.CRC, crc)
+		if c.Fields != nil {
+			fmt.Fprintf(w, "    %s\n", c.Fields)
+		}
+		if c.Error != "" {
+			fmt.Fprintf(w, "    error: %s\n", c.Error)
+		}
+	}
+	if info.Error != "" {
+		fmt.Fprintf(w, "  error: %s\n", info.Error)
+	}
+}
+
+// decode returns the fields of the chunk, or nil if its type is not one that
+// apnginfo decodes.
+func decode(c *apng.RawChunk) (fields, error) {
+	switch string(c.Type[:]) {
+	case "IHDR":
+		p, err := apng.ParseChunk_IHDR(c.Data)
+		if err != nil {
+			return nil, err
+		}
+		return &ihdrFields{
+			Width:             p.Width,
+			Height:            p.Height,
+			BitDepth:          uint8(p.BitDepth),
+			ColorType:         uint8(p.ColorType),
+			ColorTypeName:     colorTypes[p.ColorType],
+			CompressionMethod: uint8(p.CompressionMethod),
+			FilterMethod:      uint8(p.FilterMethod),
+			InterlaceMethod:   uint8(p.InterlaceMethod),
+		}, p.Validate()
+	case "PLTE":
+		if len(c.Data)%3 != 0 {
+			return nil, fmt.Errorf("length %d is not a multiple of 3", len(c.Data))
+		}
+		return &entriesFields{Entries: len(c.Data) / 3}, nil
+	case "tRNS":
+		return &entriesFields{Entries: len(c.Data)}, nil
+	case "acTL":
+		p, err := apng.ParseChunk_acTL(c.Data)
+		if err != nil {
+			return nil, err
+		}
+		return &actlFields{NumFrames: p.NumFrames, NumPlays: p.NumPlays}, nil
+	case "fcTL":
+		p, err := apng.ParseChunk_fcTL(c.Data)
+		if err != nil {
+			return nil, err
+		}
+		return &fctlFields{
+			SequenceNumber: p.SequenceNumber,
+			Width:          p.Width,
+			Height:         p.Height,
+			XOffset:        p.XOffset,
+			YOffset:        p.YOffset,
+			DelayNum:       p.DelayNum,
+			DelayDen:       p.DelayDen,
+			DisposeOp:      p.DisposeOp.String(),
+			BlendOp:        p.BlendOp.String(),
+		}, nil
+	case "fdAT":
+		p, err := apng.ParseChunk_fdAT(c.Data)
+		if err != nil {
+			return nil, err
+		}
+		return &fdatFields{SequenceNumber: p.SequenceNumber}, nil
+	case "tEXt":
+		return decodeText(c.Data)
+	case "zTXt":
+		return decodeCompressedText(c.Data)
+	case "iTXt":
+		return decodeInternationalText(c.Data)
+	}
+	return nil, nil
+}
+
+var colorTypes = map[apng.ColorType]string{
+	apng.ColorType_Grayscale:      "grayscale",
+	apng.ColorType_TrueColor:      "truecolor",
+	apng.ColorType_Paletted:       "paletted",
+	apng.ColorType_GrayscaleAlpha: "grayscale with alpha",
+	apng.ColorType_TrueColorAlpha: "truecolor with alpha",
+}
+
+type ihdrFields struct {
+	Width             uint32 `json:"width"`
+	Height            uint32 `json:"height"`
+	BitDepth          uint8  `json:"bit_depth"`
+	ColorType         uint8  `json:"color_type"`
+	ColorTypeName     string `json:"color_type_name,omitempty"`
+	CompressionMethod uint8  `json:"compression_method"`
+	FilterMethod      uint8  `json:"filter_method"`
+	InterlaceMethod   uint8  `json:"interlace_method"`
+}
+
+func (f *ihdrFields) String() string {
+	return fmt.Sprintf("%dx%d, bit depth %d, color type %d (%s), compression %d, filter %d, interlace %d",
+		f.Width, f.Height, f.BitDepth, f.ColorType, f.ColorTypeName, f.CompressionMethod, f.FilterMethod, f.InterlaceMethod)
+}
+
+// entriesFields is the size of a PLTE or tRNS chunk.  For tRNS, this is the
+// number of palette entries with alpha, or the length of the color key.
+type entriesFields struct {
+	Entries int `json:"entries"`
+}
+
+func (f *entriesFields) String() string {
+	return fmt.Sprintf("%d entries", f.Entries)
+}
+
+type actlFields struct {
+	NumFrames uint32 `json:"num_frames"`
+	NumPlays  uint32 `json:"num_plays"`
+}
+
+func (f *actlFields) String() string {
+	return fmt.Sprintf("%d frames, %d plays", f.NumFrames, f.NumPlays)
+}
+
+type fctlFields struct {
+	SequenceNumber uint32 `json:"sequence_number"`
+	Width          uint32 `json:"width"`
+	Height         uint32 `json:"height"`
+	XOffset        uint32 `json:"x_offset"`
+	YOffset        uint32 `json:"y_offset"`
+	DelayNum       uint16 `json:"delay_num"`
+	DelayDen       uint16 `json:"delay_den"`
+	DisposeOp      string `json:"dispose_op"`
+	BlendOp        string `json:"blend_op"`
+}
+
+func (f *fctlFields) String() string {
+	return fmt.Sprintf("sequence %d, %dx%d at (%d, %d), delay %d/%d, dispose %s, blend %s",
+		f.SequenceNumber, f.Width, f.Height, f.XOffset, f.YOffset, f.DelayNum, f.DelayDen, f.DisposeOp, f.BlendOp)
+}
+
+type fdatFields struct {
+	SequenceNumber uint32 `json:"sequence_number"`
+}
+
+func (f *fdatFields) String() string {
+	return fmt.Sprintf("sequence %d", f.SequenceNumber)
+}
+
+type textFields struct {
+	Keyword           string `json:"keyword"`
+	Compressed        bool   `json:"compressed,omitempty"`
+	Language          string `json:"language,omitempty"`
+	TranslatedKeyword string `json:"translated_keyword,omitempty"`
+	Text              string `json:"text"`
+}
+
+func (f *textFields) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%q", f.Keyword)
+	if f.Language != "" {
+		fmt.Fprintf(&b, " [%s]", f.Language)
+	}
+	if f.TranslatedKeyword != "" {
+		fmt.Fprintf(&b, " (%q)", f.TranslatedKeyword)
+	}
+	fmt.Fprintf(&b, ": %q", f.Text)
+	return b.String()
+}
+
+// decodeText decodes a tEXt chunk, whose keyword and text are Latin-1.
+func decodeText(b []byte) (fields, error) {
+	k, t, ok := bytes.Cut(b, []byte{0})
+	if !ok {
+		return nil, errors.New("no null separator after the keyword")
+	}
+	return &textFields{Keyword: latin1(k), Text: latin1(t)}, nil
+}
+
+// decodeCompressedText decodes a zTXt chunk, whose keyword and compressed text
+// are Latin-1.
+func decodeCompressedText(b []byte) (fields, error) {
+	k, rest, ok := bytes.Cut(b, []byte{0})
+	if !ok || len(rest) == 0 {
+		return nil, errors.New("no compression method after the keyword")
+	}
+	f := &textFields{Keyword: latin1(k), Compressed: true}
+	if rest[0] != 0 {
+		return f, fmt.Errorf("unknown compression method %d", rest[0])
+	}
+	t, err := inflate(rest[1:])
+	f.Text = latin1(t)
+	return f, err
+}
+
+// decodeInternationalText decodes an iTXt chunk, whose keyword is Latin-1 and
+// whose text, which may be compressed, is UTF-8.
+func decodeInternationalText(b []byte) (fields, error) {
+	k, rest, ok := bytes.Cut(b, []byte{0})
+	if !ok || len(rest) < 2 {
+		return nil, errors.New("no compression flag and method after the keyword")
+	}
+	f := &textFields{Keyword: latin1(k), Compressed: rest[0] != 0}
+	method := rest[1]
+	lang, rest, ok := bytes.Cut(rest[2:], []byte{0})
+	if !ok {
+		return f, errors.New("no null separator after the language tag")
+	}
+	tk, t, ok := bytes.Cut(rest, []byte{0})
+	if !ok {
+		return f, errors.New("no null separator after the translated keyword")
+	}
+	f.Language, f.TranslatedKeyword = string(lang), string(tk)
+	if f.Compressed {
+		if method != 0 {
+			return f, fmt.Errorf("unknown compression method %d", method)
+		}
+		var err error
+		if t, err = inflate(t); err != nil {
+			f.Text = string(t)
+			return f, err
+		}
+	}
+	f.Text = string(t)
+	if !utf8.Valid(t) {
+		return f, errors.New("text is not valid UTF-8")
+	}
+	return f, nil
+}
+
+// inflate decompresses zlib data, returning at most maxText bytes.
+func inflate(b []byte) ([]byte, error) {
+	r, err := zlib.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	t, err := io.ReadAll(io.LimitReader(r, maxText+1))
+	if err != nil {
+		return t, err
+	}
+	if len(t) > maxText {
+		return t[:maxText], fmt.Errorf("text is longer than %d bytes", maxText)
+	}
+	return t, nil
+}
+
+// latin1 converts ISO 8859-1 bytes to a string.
+func latin1(b []byte) string {
+	r := make([]rune, len(b))
+	for i, c := range b {
+		r[i] = rune(c)
+	}
+	return string(r)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"strings"
+	"testing"
+
+	"github.com/shutej/apng"
+)
+
+func compress(s string) string {
+	b := bytes.NewBuffer(nil)
+	w := zlib.NewWriter(b)
+	w.Write([]byte(s))
+	w.Close()
+	return b.String()
+}
+
+func TestDecodeText(t *testing.T) {
+	for _, tc := range []struct {
+		typ, data string
+		want      textFields
+		err       string // A substring of the error, if any
+	}{
+		{typ: "tEXt", data: "Title\x00Caf\xe9", want: textFields{Keyword: "Title", Text: "Café"}},
+		{typ: "tEXt", data: "Title\x00", want: textFields{Keyword: "Title"}},
+		{typ: "tEXt", data: "Title", err: "no null separator"},
+		{typ: "zTXt", data: "Comment\x00\x00" + compress("na\xefve"), want: textFields{Keyword: "Comment", Compressed: true, Text: "naïve"}},
+		{typ: "zTXt", data: "Comment\x00\x01" + compress("x"), want: textFields{Keyword: "Comment", Compressed: true}, err: "unknown compression method 1"},
+		{typ: "zTXt", data: "Comment\x00", err: "no compression method"},
+		{typ: "zTXt", data: "Comment\x00\x00not zlib", want: textFields{Keyword: "Comment", Compressed: true}, err: "zlib"},
+		{typ: "zTXt", data: "Comment\x00\x00" + compress(strings.Repeat("a", maxText+1)), want: textFields{Keyword: "Comment", Compressed: true, Text: strings.Repeat("a", maxText)}, err: "longer than"},
+		{typ: "iTXt", data: "Title\x00\x00\x00fr\x00Titre\x00Caf\xc3\xa9", want: textFields{Keyword: "Title", Language: "fr", TranslatedKeyword: "Titre", Text: "Café"}},
+		{typ: "iTXt", data: "Title\x00\x01\x00en\x00\x00" + compress("h\xc3\xa9"), want: textFields{Keyword: "Title", Compressed: true, Language: "en", Text: "hé"}},
+		{typ: "iTXt", data: "Title\x00\x01\x02\x00\x00x", want: textFields{Keyword: "Title", Compressed: true}, err: "unknown compression method 2"},
+		{typ: "iTXt", data: "Title\x00\x00\x00\x00\x00\xff", want: textFields{Keyword: "Title", Text: "\xff"}, err: "not valid UTF-8"},
+		{typ: "iTXt", data: "Title\x00\x00", err: "no compression flag"},
+		{typ: "iTXt", data: "Title\x00\x00\x00en", want: textFields{Keyword: "Title"}, err: "after the language tag"},
+		{typ: "iTXt", data: "Title\x00\x00\x00en\x00Titre", want: textFields{Keyword: "Title"}, err: "after the translated keyword"},
+	} {
+		c := &apng.RawChunk{Data: []byte(tc.data)}
+		copy(c.Type[:], tc.typ)
+		f, err := decode(c)
+		if tc.err == "" && err != nil || tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)) {
+			t.Errorf("%s %q: got error %v, want %q", tc.typ, tc.data, err, tc.err)
+		}
+		var got textFields
+		if f != nil {
+			got = *f.(*textFields)
+		}
+		if got != tc.want {
+			t.Errorf("%s %q: got %+v, want %+v", tc.typ, tc.data, got, tc.want)
+		}
+	}
+}
+
+func TestTextFieldsString(t *testing.T) {
+	f := &textFields{Keyword: "Title", Language: "fr", TranslatedKeyword: "Titre", Text: "Café"}
+	if got, want := f.String(), `"Title" [fr] ("Titre"): "Café"`; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,113 @@
+// Command apngopt re-optimizes PNG and APNG files.
+//
+// Usage:
+//
+//	apngopt [flags] in.png...
+//
+// Each in.png is written to in_opt.png, or with a single input to the file
+// given by -o, and the sizes before and after are printed.  The frames are
+// re-composited and re-encoded with the smallest frame regions, dispose and
+// blend operators, filter strategy and compression level.  Unless -quantize is
+// given, this is lossless, and a file that cannot be made smaller is copied as
+// it is.
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/shutej/apng"
+)
+
+var (
+	output = flag.String("o", "", "output file, for a single input")
+	fast   = flag.Bool("fast", false, "only try the default compression level and filter strategy")
+	colors = flag.Int("quantize", 0, "reduce to a palette of this many colors (2 to 256), which is lossy; 0 keeps every color")
+	dither = flag.String("dither", "none", "dithering when quantizing: none, floyd-steinberg or ordered")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: apngopt [flags] in.png...\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 || *output != "" && flag.NArg() > 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	opts, err := optimizeOptions()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "apngopt: %v\n", err)
+		os.Exit(2)
+	}
+
+	status := 0
+	for _, name := range flag.Args() {
+		out := *output
+		if out == "" {
+			ext := filepath.Ext(name)
+			out = strings.TrimSuffix(name, ext) + "_opt" + ext
+		}
+		res, err := optimize(name, out, opts)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "apngopt: %s: %v\n", name, err)
+			status = 1
+			continue
+		}
+		note := ""
+		if res.Unchanged {
+			note = ", copied unchanged"
+		}
+		fmt.Printf("%s: %d -> %d bytes (%+.1f%%)%s\n", out, res.InputSize, res.OutputSize,
+			100*float64(res.OutputSize-res.InputSize)/float64(res.InputSize), note)
+	}
+	os.Exit(status)
+}
+
+func optimizeOptions() (*apng.OptimizeOptions, error) {
+	opts := &apng.OptimizeOptions{Fast: *fast}
+	if *colors == 0 {
+		return opts, nil
+	}
+	if *colors < 2 || *colors > 256 {
+		return nil, fmt.Errorf("-quantize %d is not between 2 and 256", *colors)
+	}
+	opts.Quantize = &apng.QuantizeOptions{NumColors: *colors}
+	var err error
+	if opts.Quantize.Dither, err = apng.ParseDither(*dither); err != nil {
+		return nil, err
+	}
+	return opts, nil
+}
+
+func optimize(name, out string, opts *apng.OptimizeOptions) (*apng.OptimizeResult, error) {
+	if out == name {
+		return nil, fmt.Errorf("output would overwrite the input")
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	g, err := os.Create(out)
+	if err != nil {
+		return nil, err
+	}
+	w := bufio.NewWriter(g)
+	res, err := apng.Optimize(bufio.NewReader(f), w, opts)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		g.Close()
+		os.Remove(out)
+		return nil, err
+	}
+	return res, g.Close()
+}
@@ -0,0 +1,91 @@
+// Command gif2apng converts animated GIFs to APNGs.
+//
+// Usage:
+//
+//	gif2apng [flags] in.gif...
+//
+// Each in.gif is written to in.png, or with a single input to the file given
+// by -o.  The frames keep their timing, disposal, transparency and loop count.
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"image/gif"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/shutej/apng"
+)
+
+var (
+	output      = flag.String("o", "", "output APNG file, for a single input")
+	compression = flag.String("compression", "default", "compression level: default, none, speed or best")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: gif2apng [flags] in.gif...\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 || *output != "" && flag.NArg() > 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	cl, err := apng.ParseCompressionLevel(*compression)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "gif2apng: %v\n", err)
+		os.Exit(2)
+	}
+	opts := &apng.EncodeOptions{CompressionLevel: cl}
+
+	status := 0
+	for _, name := range flag.Args() {
+		out := *output
+		if out == "" {
+			out = strings.TrimSuffix(name, filepath.Ext(name)) + ".png"
+		}
+		if err := convert(name, out, opts); err != nil {
+			fmt.Fprintf(os.Stderr, "gif2apng: %s: %v\n", name, err)
+			status = 1
+		}
+	}
+	os.Exit(status)
+}
+
+func convert(name, out string, opts *apng.EncodeOptions) error {
+	if out == name {
+		return fmt.Errorf("output would overwrite the input")
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	g, err := gif.DecodeAll(bufio.NewReader(f))
+	f.Close()
+	if err != nil {
+		return err
+	}
+	a, err := apng.FromGIF(g)
+	if err != nil {
+		return err
+	}
+
+	f, err = os.Create(out)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	if err := apng.Encode(w, a, opts); err != nil {
+		f.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
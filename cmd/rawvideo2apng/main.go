@@ -0,0 +1,160 @@
+// Command rawvideo2apng encodes raw video frames as an APNG, one frame at a
+// time, so that it can take video piped from ffmpeg:
+//
+//	ffmpeg -i in.mov -f rawvideo -pix_fmt rgba - | rawvideo2apng -size 1280x720 -rate 30000/1001 -o out.png
+//
+// Usage:
+//
+//	rawvideo2apng -size WxH -o out.png [flags] [in.raw]
+//
+// Frames are read from in.raw, or from standard input.  To write to standard
+// output with -o -, which cannot seek back to fill in the number of frames,
+// give the number with -frames.
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/shutej/apng"
+)
+
+var (
+	output      = flag.String("o", "", "output APNG file, or - for standard output")
+	size        = flag.String("size", "", "frame size WxH")
+	rate        = flag.String("rate", "30", "frame rate, in frames per second, as N or N/D")
+	pixFmt      = flag.String("pix_fmt", "rgba", "pixel format: rgba, rgb24, gray or rgba64be")
+	frames      = flag.Uint("frames", 0, "number of frames; needed when writing to standard output")
+	loops       = flag.Uint("loops", 0, "number of times to play the animation; 0 loops forever")
+	compression = flag.String("compression", "default", "compression level: default, none, speed or best")
+	crop        = flag.Bool("crop", true, "only encode the region of each frame that changed")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: rawvideo2apng -size WxH -o out.png [flags] [in.raw]\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if *output == "" || *size == "" || flag.NArg() > 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err := run(); err != nil {
+		fmt.Fprintf(os.Stderr, "rawvideo2apng: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	w, h, err := parseSize(*size)
+	if err != nil {
+		return err
+	}
+	format, err := apng.ParsePixelFormat(*pixFmt)
+	if err != nil {
+		return err
+	}
+	opts := &apng.StreamOptions{
+		NumFrames: uint32(*frames),
+		NumPlays:  uint32(*loops),
+		Crop:      *crop,
+	}
+	// The delay of each frame is the reciprocal of the frame rate.
+	if opts.DelayDen, opts.DelayNum, err = parseRate(*rate); err != nil {
+		return err
+	}
+	if opts.CompressionLevel, err = apng.ParseCompressionLevel(*compression); err != nil {
+		return err
+	}
+
+	var in io.Reader = os.Stdin
+	if flag.NArg() == 1 {
+		f, err := os.Open(flag.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	if *output == "-" {
+		if *frames == 0 {
+			return fmt.Errorf("-frames is needed to write to standard output")
+		}
+		return encode(os.Stdout, in, format, w, h, opts)
+	}
+	f, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+	if err := encode(f, in, format, w, h, opts); err != nil {
+		// Do not leave a partial APNG behind.
+		f.Close()
+		os.Remove(*output)
+		return err
+	}
+	return f.Close()
+}
+
+// encode reads raw w x h frames from in and writes them to out as an APNG.
+func encode(out io.Writer, in io.Reader, format apng.PixelFormat, w, h int, opts *apng.StreamOptions) error {
+	e, err := apng.NewStreamEncoder(out, format.NewChunk_IHDR(w, h), opts)
+	if err != nil {
+		return err
+	}
+	rv := apng.NewRawVideoReader(bufio.NewReaderSize(in, 1<<20), format, w, h)
+	for rv.Next() {
+		if err := e.WriteFrame(rv.Image()); err != nil {
+			return err
+		}
+	}
+	if err := rv.Err(); err != nil {
+		return err
+	}
+	return e.Close()
+}
+
+// parseSize parses a frame size of the form WxH.
+func parseSize(s string) (int, int, error) {
+	ws, hs, ok := strings.Cut(s, "x")
+	if !ok {
+		return 0, 0, fmt.Errorf("size %q is not of the form WxH", s)
+	}
+	w, err := strconv.Atoi(ws)
+	if err != nil {
+		return 0, 0, fmt.Errorf("size %q: %v", s, err)
+	}
+	h, err := strconv.Atoi(hs)
+	if err != nil {
+		return 0, 0, fmt.Errorf("size %q: %v", s, err)
+	}
+	if w <= 0 || h <= 0 {
+		return 0, 0, fmt.Errorf("size %q is empty", s)
+	}
+	return w, h, nil
+}
+
+// parseRate parses a frame rate of the form N or N/D.
+func parseRate(s string) (uint16, uint16, error) {
+	num, den, ok := strings.Cut(s, "/")
+	if !ok {
+		den = "1"
+	}
+	n, err := strconv.ParseUint(num, 10, 16)
+	if err != nil {
+		return 0, 0, fmt.Errorf("rate %q: %v", s, err)
+	}
+	d, err := strconv.ParseUint(den, 10, 16)
+	if err != nil {
+		return 0, 0, fmt.Errorf("rate %q: %v", s, err)
+	}
+	if n == 0 || d == 0 {
+		return 0, 0, fmt.Errorf("rate %q is not positive", s)
+	}
+	return uint16(n), uint16(d), nil
+}
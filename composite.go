@@ -0,0 +1,147 @@
+package apng
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+)
+
+// Compositor renders the frames of an Animation onto a canvas in turn, as an
+// APNG decoder displays them.  Like an Encoder, call Next to advance to each
+// frame before using Image.
+type Compositor struct {
+	a      *Animation
+	next   int // Index of the next frame
+	canvas draw.Image
+
+	// What to do to the canvas before rendering the next frame: the area
+	// and operator of the current frame, and the area's previous contents
+	// for DisposeOp_Previous.
+	dispose     DisposeOp
+	disposeRect image.Rectangle
+	saved       draw.Image
+}
+
+// NewCompositor makes a new compositor for the animation.  The canvas starts
+// fully transparent, and holds 16 bits per channel if any frame image does.
+func (a *Animation) NewCompositor() *Compositor {
+	var canvas draw.Image = image.NewNRGBA(a.Bounds())
+	for _, f := range a.Frames {
+		if is16(f.Image) {
+			canvas = image.NewNRGBA64(a.Bounds())
+			break
+		}
+	}
+	return &Compositor{a: a, canvas: canvas}
+}
+
+// is16 reports whether m holds more than 8 bits per channel.
+func is16(m image.Image) bool {
+	switch m.(type) {
+	case *image.Gray16, *image.RGBA64, *image.NRGBA64:
+		return true
+	}
+	return false
+}
+
+// Next renders the next frame, after disposing of the current one, and reports
+// whether there was one.
+func (c *Compositor) Next() bool {
+	if c.next >= len(c.a.Frames) {
+		return false
+	}
+	switch c.dispose {
+	case DisposeOp_Background:
+		draw.Draw(c.canvas, c.disposeRect, image.Transparent, image.Point{}, draw.Src)
+	case DisposeOp_Previous:
+		copyImage(c.canvas, c.disposeRect, c.saved)
+	}
+
+	f := &c.a.Frames[c.next]
+	r := f.Image.Bounds().Intersect(c.canvas.Bounds())
+	c.dispose, c.disposeRect = f.DisposeOp, r
+	if c.dispose == DisposeOp_Previous {
+		if c.next == 0 {
+			// As per the APNG spec.
+			c.dispose = DisposeOp_Background
+		} else {
+			c.saved = c.newImage(r)
+			copyImage(c.saved, r, c.canvas)
+		}
+	}
+	if f.BlendOp == BlendOp_Over {
+		blendOver(c.canvas, r, f.Image)
+	} else {
+		copyImage(c.canvas, r, f.Image)
+	}
+	c.next++
+	return true
+}
+
+// Image returns the canvas after the current frame.  The canvas is changed by
+// the next call to Next, so copy it to keep it.
+func (c *Compositor) Image() image.Image {
+	return c.canvas
+}
+
+// Frame returns the index of the current frame.
+func (c *Compositor) Frame() int {
+	return c.next - 1
+}
+
+func (c *Compositor) newImage(r image.Rectangle) draw.Image {
+	if _, ok := c.canvas.(*image.NRGBA64); ok {
+		return image.NewNRGBA64(r)
+	}
+	return image.NewNRGBA(r)
+}
+
+// copyImage replaces the pixels of dst within r with those of src.  Unlike
+// draw.Draw, it keeps the exact values of non-alpha-premultiplied colors when
+// dst can hold them.
+func copyImage(dst draw.Image, r image.Rectangle, src image.Image) {
+	if d, ok := dst.(*image.NRGBA); ok {
+		if s, ok := src.(*image.NRGBA); ok {
+			for y := r.Min.Y; y < r.Max.Y; y++ {
+				i, j := d.PixOffset(r.Min.X, y), s.PixOffset(r.Min.X, y)
+				copy(d.Pix[i:i+4*r.Dx()], s.Pix[j:j+4*r.Dx()])
+			}
+			return
+		}
+	}
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			dst.Set(x, y, src.At(x, y))
+		}
+	}
+}
+
+// blendOver composites src over dst within r.
+func blendOver(dst draw.Image, r image.Rectangle, src image.Image) {
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			sc := src.At(x, y)
+			sr, sg, sb, sa := sc.RGBA()
+			switch sa {
+			case 0:
+				continue
+			case 0xffff:
+				dst.Set(x, y, sc)
+				continue
+			}
+			dr, dg, db, da := dst.At(x, y).RGBA()
+			if da == 0 {
+				// Keep the exact color, as for opaque pixels.
+				dst.Set(x, y, sc)
+				continue
+			}
+			a := 0xffff - sa
+			dst.Set(x, y, color.RGBA64{
+				R: uint16(sr + dr*a/0xffff),
+				G: uint16(sg + dg*a/0xffff),
+				B: uint16(sb + db*a/0xffff),
+				A: uint16(sa + da*a/0xffff),
+			})
+		}
+	}
+}
@@ -0,0 +1,279 @@
+package apng
+
+import (
+	"image"
+	"image/color"
+)
+
+// rowConverter returns a function that converts row y of m to the bytes for
+// cb, reading m's pixel buffer directly rather than going through m.At, or nil
+// if there is no such fast path for m and cb.  The results match the generic
+// conversions in writeImage, except that non-alpha-premultiplied sources
+// converted to an alpha color type keep their exact values rather than going
+// through a premultiplied round trip.  Like writeImage, the function returns
+// an error for pixels without alpha that cb cannot represent, as per
+// alphaError.
+func rowConverter(m image.Image, cb int, key []byte) func(dst []byte, y int) error {
+	b := m.Bounds()
+	w := b.Dx()
+	switch m := m.(type) {
+	case *image.Gray16:
+		switch cb {
+		case cbG8:
+			return func(dst []byte, y int) error {
+				pix := m.Pix[m.PixOffset(b.Min.X, y):]
+				for x := 0; x < w; x++ {
+					dst[x] = pix[2*x]
+				}
+				return nil
+			}
+		case cbG16:
+			return func(dst []byte, y int) error {
+				j := m.PixOffset(b.Min.X, y)
+				copy(dst, m.Pix[j:j+2*w])
+				return nil
+			}
+		case cbGA8:
+			return func(dst []byte, y int) error {
+				pix := m.Pix[m.PixOffset(b.Min.X, y):]
+				for x := 0; x < w; x++ {
+					dst[2*x+0] = pix[2*x]
+					dst[2*x+1] = 0xff
+				}
+				return nil
+			}
+		case cbGA16:
+			return func(dst []byte, y int) error {
+				pix := m.Pix[m.PixOffset(b.Min.X, y):]
+				for x := 0; x < w; x++ {
+					dst[4*x+0] = pix[2*x+0]
+					dst[4*x+1] = pix[2*x+1]
+					dst[4*x+2] = 0xff
+					dst[4*x+3] = 0xff
+				}
+				return nil
+			}
+		}
+
+	case *image.RGBA:
+		switch cb {
+		case cbTCA8:
+			return func(dst []byte, y int) error {
+				j := m.PixOffset(b.Min.X, y)
+				unpremultiplyRow(dst[:4*w], m.Pix[j:j+4*w])
+				return nil
+			}
+		}
+
+	case *image.RGBA64:
+		switch cb {
+		case cbTC8:
+			return func(dst []byte, y int) error {
+				pix := m.Pix[m.PixOffset(b.Min.X, y):]
+				for x := 0; x < w; x++ {
+					s, d := pix[8*x:8*x+8], dst[3*x:3*x+3]
+					a := uint32(s[6])<<8 | uint32(s[7])
+					if err := alphaError(b.Min.X+x, y, a, key); err != nil {
+						return err
+					}
+					if a == 0 {
+						d[0], d[1], d[2] = key[1], key[3], key[5]
+						continue
+					}
+					d[0], d[1], d[2] = s[0], s[2], s[4]
+				}
+				return nil
+			}
+		case cbTC16:
+			return func(dst []byte, y int) error {
+				pix := m.Pix[m.PixOffset(b.Min.X, y):]
+				for x := 0; x < w; x++ {
+					s, d := pix[8*x:8*x+8], dst[6*x:6*x+6]
+					a := uint32(s[6])<<8 | uint32(s[7])
+					if err := alphaError(b.Min.X+x, y, a, key); err != nil {
+						return err
+					}
+					if a == 0 {
+						copy(d, key)
+						continue
+					}
+					copy(d, s[:6])
+				}
+				return nil
+			}
+		case cbTCA8:
+			return func(dst []byte, y int) error {
+				pix := m.Pix[m.PixOffset(b.Min.X, y):]
+				for x := 0; x < w; x++ {
+					c := unpremultiply64(pix[8*x : 8*x+8])
+					d := dst[4*x : 4*x+4]
+					d[0], d[1], d[2], d[3] = uint8(c.R>>8), uint8(c.G>>8), uint8(c.B>>8), uint8(c.A>>8)
+				}
+				return nil
+			}
+		case cbTCA16:
+			return func(dst []byte, y int) error {
+				pix := m.Pix[m.PixOffset(b.Min.X, y):]
+				for x := 0; x < w; x++ {
+					putNRGBA64(dst[8*x:8*x+8], unpremultiply64(pix[8*x:8*x+8]))
+				}
+				return nil
+			}
+		}
+
+	case *image.NRGBA64:
+		switch cb {
+		case cbTC8:
+			return func(dst []byte, y int) error {
+				pix := m.Pix[m.PixOffset(b.Min.X, y):]
+				for x := 0; x < w; x++ {
+					s, d := pix[8*x:8*x+8], dst[3*x:3*x+3]
+					c := premultiply64(s)
+					if err := alphaError(b.Min.X+x, y, uint32(c.A), key); err != nil {
+						return err
+					}
+					if c.A == 0 {
+						d[0], d[1], d[2] = key[1], key[3], key[5]
+						continue
+					}
+					d[0], d[1], d[2] = uint8(c.R>>8), uint8(c.G>>8), uint8(c.B>>8)
+				}
+				return nil
+			}
+		case cbTC16:
+			return func(dst []byte, y int) error {
+				pix := m.Pix[m.PixOffset(b.Min.X, y):]
+				for x := 0; x < w; x++ {
+					s, d := pix[8*x:8*x+8], dst[6*x:6*x+6]
+					c := premultiply64(s)
+					if err := alphaError(b.Min.X+x, y, uint32(c.A), key); err != nil {
+						return err
+					}
+					if c.A == 0 {
+						copy(d, key)
+						continue
+					}
+					d[0], d[1] = uint8(c.R>>8), uint8(c.R)
+					d[2], d[3] = uint8(c.G>>8), uint8(c.G)
+					d[4], d[5] = uint8(c.B>>8), uint8(c.B)
+				}
+				return nil
+			}
+		case cbTCA8:
+			return func(dst []byte, y int) error {
+				pix := m.Pix[m.PixOffset(b.Min.X, y):]
+				for x := 0; x < w; x++ {
+					s, d := pix[8*x:8*x+8], dst[4*x:4*x+4]
+					d[0], d[1], d[2], d[3] = s[0], s[2], s[4], s[6]
+				}
+				return nil
+			}
+		case cbTCA16:
+			return func(dst []byte, y int) error {
+				j := m.PixOffset(b.Min.X, y)
+				copy(dst, m.Pix[j:j+8*w])
+				return nil
+			}
+		}
+
+	case *image.YCbCr:
+		switch cb {
+		case cbTC8, cbTCA8:
+			bpp := 3
+			if cb == cbTCA8 {
+				bpp = 4
+			}
+			return func(dst []byte, y int) error {
+				for x := 0; x < w; x++ {
+					yi, ci := m.YOffset(b.Min.X+x, y), m.COffset(b.Min.X+x, y)
+					d := dst[bpp*x : bpp*x+bpp]
+					d[0], d[1], d[2] = color.YCbCrToRGB(m.Y[yi], m.Cb[ci], m.Cr[ci])
+					if bpp == 4 {
+						d[3] = 0xff
+					}
+				}
+				return nil
+			}
+		}
+
+	case *image.NYCbCrA:
+		switch cb {
+		case cbTCA8:
+			return func(dst []byte, y int) error {
+				for x := 0; x < w; x++ {
+					yi, ci := m.YOffset(b.Min.X+x, y), m.COffset(b.Min.X+x, y)
+					ai := m.AOffset(b.Min.X+x, y)
+					d := dst[4*x : 4*x+4]
+					d[0], d[1], d[2] = color.YCbCrToRGB(m.Y[yi], m.Cb[ci], m.Cr[ci])
+					d[3] = m.A[ai]
+				}
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+// unpremultiplyRow converts a row of alpha-premultiplied pixels, as stored in
+// an image.RGBA, to non-alpha-premultiplied ones in dst, in the same way as
+// color.NRGBAModel.  dst and src must be the same length.
+func unpremultiplyRow(dst, src []byte) {
+	for i := 0; i+4 <= len(src) && i+4 <= len(dst); i += 4 {
+		s := src[i : i+4 : i+4]
+		d := dst[i : i+4 : i+4]
+		switch a := uint32(s[3]); a {
+		case 0xff:
+			d[0], d[1], d[2], d[3] = s[0], s[1], s[2], 0xff
+		case 0:
+			d[0], d[1], d[2], d[3] = 0, 0, 0, 0
+		default:
+			// color.NRGBAModel works on 16 bit values, computing
+			// (r*0x101*0xffff)/(a*0x101)>>8, in which the 0x101 factors cancel.
+			d[0] = uint8(uint32(s[0]) * 0xffff / a >> 8)
+			d[1] = uint8(uint32(s[1]) * 0xffff / a >> 8)
+			d[2] = uint8(uint32(s[2]) * 0xffff / a >> 8)
+			d[3] = uint8(a)
+		}
+	}
+}
+
+// premultiply64 converts the big-endian non-alpha-premultiplied pixel s, as
+// stored in an image.NRGBA64, to alpha-premultiplied form.
+func premultiply64(s []byte) color.RGBA64 {
+	r := uint32(s[0])<<8 | uint32(s[1])
+	g := uint32(s[2])<<8 | uint32(s[3])
+	b := uint32(s[4])<<8 | uint32(s[5])
+	a := uint32(s[6])<<8 | uint32(s[7])
+	return color.RGBA64{
+		R: uint16(r * a / 0xffff),
+		G: uint16(g * a / 0xffff),
+		B: uint16(b * a / 0xffff),
+		A: uint16(a),
+	}
+}
+
+// unpremultiply64 converts the big-endian alpha-premultiplied pixel s, as
+// stored in an image.RGBA64, to non-alpha-premultiplied form, in the same way
+// as color.NRGBA64Model.
+func unpremultiply64(s []byte) color.NRGBA64 {
+	r := uint32(s[0])<<8 | uint32(s[1])
+	g := uint32(s[2])<<8 | uint32(s[3])
+	b := uint32(s[4])<<8 | uint32(s[5])
+	a := uint32(s[6])<<8 | uint32(s[7])
+	switch a {
+	case 0xffff:
+	case 0:
+		r, g, b = 0, 0, 0
+	default:
+		r, g, b = r*0xffff/a, g*0xffff/a, b*0xffff/a
+	}
+	return color.NRGBA64{R: uint16(r), G: uint16(g), B: uint16(b), A: uint16(a)}
+}
+
+// putNRGBA64 writes c big-endian, as PNG stores it.
+func putNRGBA64(d []byte, c color.NRGBA64) {
+	d[0], d[1] = uint8(c.R>>8), uint8(c.R)
+	d[2], d[3] = uint8(c.G>>8), uint8(c.G)
+	d[4], d[5] = uint8(c.B>>8), uint8(c.B)
+	d[6], d[7] = uint8(c.A>>8), uint8(c.A)
+}
@@ -0,0 +1,257 @@
+package apng
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+)
+
+// Decode reads an APNG from r.  A PNG without an acTL chunk is read as an
+// animation of a single frame.  Ancillary chunks other than tRNS, such as eXIf
+// and private chunks, are kept, except for bKGD, hIST and sBIT, which depend
+// on the color type or palette.  Those after a frame's fcTL and before the next
+// are kept in that Frame's Chunks, so that Encode writes them back with the
+// frame, and the others in the Animation's Chunks.  Each frame's image
+// data is decoded with image/png, so frame images have the types image/png
+// returns, with bounds that place them on the canvas.
+func Decode(r io.Reader) (*Animation, error) {
+	d := &decoder{}
+	cr := NewChunkReader(r)
+	for cr.Next() {
+		c := cr.Chunk()
+		if !cr.ValidCRC() {
+			return nil, FormatError(fmt.Sprintf("%s: CRC mismatch", c.Type))
+		}
+		if err := d.chunk(c); err != nil {
+			return nil, err
+		}
+		if d.end {
+			break
+		}
+	}
+	if err := cr.Err(); err != nil {
+		return nil, err
+	}
+	return d.animation()
+}
+
+// decodedFrame is a frame's control chunk, and its image data and ancillary
+// chunks so far.
+type decodedFrame struct {
+	fctl   *Chunk_fcTL
+	data   []byte
+	chunks []*RawChunk
+}
+
+type decoder struct {
+	ihdr   *Chunk_IHDR
+	header []io.WriterTo // PLTE and tRNS, for each frame's standalone PNG
+	actl   *Chunk_acTL
+	chunks []*RawChunk
+
+	idat        []byte
+	idatDone    bool // Whether a chunk other than IDAT has followed IDAT
+	idatIsFrame bool // Whether an fcTL came before IDAT
+	frames      []*decodedFrame
+	end         bool
+}
+
+func (d *decoder) chunk(c *RawChunk) error {
+	name := string(c.Type[:])
+	if d.ihdr == nil && name != "IHDR" {
+		return FormatError("first chunk is not IHDR")
+	}
+	if len(d.idat) > 0 && name != "IDAT" {
+		d.idatDone = true
+	}
+	switch name {
+	case "IHDR", "PLTE", "acTL", "fcTL", "fdAT", "IEND":
+	case "IDAT":
+		if d.idatDone {
+			return FormatError("IDAT chunks are not consecutive")
+		}
+		d.idat = append(d.idat, c.Data...)
+		if len(d.frames) > 0 {
+			d.idatIsFrame = true
+		}
+		return nil
+	case "tRNS":
+		d.header = append(d.header, c)
+		return nil
+	case "bKGD", "hIST", "sBIT":
+		// These depend on the color type or palette, which Encode may
+		// change.
+		return nil
+	default:
+		if !c.Ancillary() {
+			return UnsupportedError("critical chunk " + name)
+		}
+		if len(d.frames) > 0 && !beforePLTE[name] {
+			f := d.frames[len(d.frames)-1]
+			f.chunks = append(f.chunks, c)
+		} else {
+			d.chunks = append(d.chunks, c)
+		}
+		return nil
+	}
+
+	p, err := c.Parse()
+	if err != nil {
+		return err
+	}
+	switch p := p.(type) {
+	case *Chunk_IHDR:
+		if d.ihdr != nil {
+			return FormatError("more than one IHDR chunk")
+		}
+		if err := p.Validate(); err != nil {
+			return err
+		}
+		d.ihdr = p
+	case *Chunk_PLTE:
+		d.header = append(d.header, p)
+	case *Chunk_acTL:
+		if len(d.idat) > 0 {
+			return FormatError("acTL after IDAT")
+		}
+		d.actl = p
+	case *Chunk_fcTL:
+		if err := p.Validate(d.ihdr); err != nil {
+			return err
+		}
+		d.frames = append(d.frames, &decodedFrame{fctl: p})
+	case *Chunk_fdAT:
+		if len(d.idat) == 0 {
+			return FormatError("fdAT before IDAT")
+		}
+		if len(d.frames) == 0 || d.idatIsFrame && len(d.frames) == 1 {
+			return FormatError("fdAT without a preceding fcTL")
+		}
+		f := d.frames[len(d.frames)-1]
+		f.data = append(f.data, p.Chunk_IDAT...)
+	case *Chunk_IEND:
+		d.end = true
+	}
+	return nil
+}
+
+func (d *decoder) animation() (*Animation, error) {
+	if d.ihdr == nil {
+		return nil, FormatError("missing IHDR")
+	}
+	if len(d.idat) == 0 {
+		return nil, FormatError("missing IDAT")
+	}
+	a := &Animation{
+		Width:  int(d.ihdr.Width),
+		Height: int(d.ihdr.Height),
+		Chunks: d.chunks,
+	}
+	m, err := d.decodeImage(d.ihdr.Width, d.ihdr.Height, d.idat)
+	if err != nil {
+		return nil, err
+	}
+
+	// Without acTL, or with a malformed animation, decoders show the
+	// default image.
+	if d.actl == nil || len(d.frames) == 0 {
+		for _, f := range d.frames {
+			a.Chunks = append(a.Chunks, f.chunks...)
+		}
+		a.Frames = []Frame{{Image: m}}
+		return a, nil
+	}
+	a.NumPlays = d.actl.NumPlays
+	if d.actl.NumFrames != uint32(len(d.frames)) {
+		return nil, FormatError(fmt.Sprintf("acTL has %d frames, but there are %d fcTL chunks", d.actl.NumFrames, len(d.frames)))
+	}
+	if !d.idatIsFrame {
+		a.Default = m
+	}
+	for i, f := range d.frames {
+		fm := m
+		if i > 0 || !d.idatIsFrame {
+			if len(f.data) == 0 {
+				return nil, FormatError(fmt.Sprintf("frame %d has no image data", i))
+			}
+			if fm, err = d.decodeImage(f.fctl.Width, f.fctl.Height, f.data); err != nil {
+				return nil, fmt.Errorf("frame %d: %v", i, err)
+			}
+		} else if f.fctl.XOffset != 0 || f.fctl.YOffset != 0 || f.fctl.Width != d.ihdr.Width || f.fctl.Height != d.ihdr.Height {
+			return nil, FormatError("frame 0 is the default image but does not cover it")
+		}
+		a.Frames = append(a.Frames, Frame{
+			Image:     translate(fm, image.Pt(int(f.fctl.XOffset), int(f.fctl.YOffset))),
+			DelayNum:  f.fctl.DelayNum,
+			DelayDen:  f.fctl.DelayDen,
+			DisposeOp: f.fctl.DisposeOp,
+			BlendOp:   f.fctl.BlendOp,
+			Chunks:    f.chunks,
+		})
+	}
+	return a, nil
+}
+
+// decodeImage decodes image data of the given size by repackaging it as a
+// standalone PNG for image/png.
+func (d *decoder) decodeImage(width, height uint32, data []byte) (image.Image, error) {
+	buf := bytes.NewBuffer(nil)
+	buf.WriteString(PngHeader)
+	ihdr := *d.ihdr
+	ihdr.Width, ihdr.Height = width, height
+	cw := &chunkWriter{w: buf}
+	// Chunk_IHDR refuses to write interlaced headers, which image/png reads.
+	cw.write(&RawChunk{Type: [4]byte{'I', 'H', 'D', 'R'}, Data: ihdr.data()})
+	for _, c := range d.header {
+		cw.write(c)
+	}
+	cw.write(Chunk_IDAT(data))
+	cw.write(&Chunk_IEND{})
+	if cw.err != nil {
+		return nil, cw.err
+	}
+	return png.Decode(buf)
+}
+
+// translate moves m, whose bounds start at (0, 0), to start at p instead.
+func translate(m image.Image, p image.Point) image.Image {
+	if p == (image.Point{}) {
+		return m
+	}
+	switch m := m.(type) {
+	case *image.Gray:
+		m.Rect = m.Rect.Add(p)
+	case *image.Gray16:
+		m.Rect = m.Rect.Add(p)
+	case *image.RGBA:
+		m.Rect = m.Rect.Add(p)
+	case *image.RGBA64:
+		m.Rect = m.Rect.Add(p)
+	case *image.NRGBA:
+		m.Rect = m.Rect.Add(p)
+	case *image.NRGBA64:
+		m.Rect = m.Rect.Add(p)
+	case *image.Paletted:
+		m.Rect = m.Rect.Add(p)
+	default:
+		return &translated{m, p}
+	}
+	return m
+}
+
+// translated is an image moved by an offset.
+type translated struct {
+	image.Image
+	p image.Point
+}
+
+func (t *translated) Bounds() image.Rectangle {
+	return t.Image.Bounds().Add(t.p)
+}
+
+func (t *translated) At(x, y int) color.Color {
+	return t.Image.At(x-t.p.X, y-t.p.Y)
+}
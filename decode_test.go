@@ -0,0 +1,271 @@
+package apng
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+)
+
+func TestDecode(t *testing.T) {
+	a := testAnimation(6)
+	full := make([]image.Image, len(a.Frames))
+	for i, f := range a.Frames {
+		full[i] = f.Image
+	}
+	a.Crop()
+	a.Default = testSource("Gray", a.Bounds(), 4)
+	a.Chunks = []*RawChunk{{Type: [4]byte{'p', 'r', 'V', 't'}, Data: []byte("frame metadata")}}
+	buf := bytes.NewBuffer(nil)
+	if err := Encode(buf, a, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := Decode(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Width != a.Width || got.Height != a.Height || got.NumPlays != a.NumPlays {
+		t.Errorf("got %dx%d, %d plays, want %dx%d, %d plays", got.Width, got.Height, got.NumPlays, a.Width, a.Height, a.NumPlays)
+	}
+	if len(got.Chunks) != 1 || got.Chunks[0].Type != a.Chunks[0].Type || !bytes.Equal(got.Chunks[0].Data, a.Chunks[0].Data) {
+		t.Errorf("got chunks %v, want %v", got.Chunks, a.Chunks)
+	}
+	if got.Default == nil {
+		t.Fatal("no default image")
+	}
+	compareImages(t, got.Default, a.Default, 0)
+	if len(got.Frames) != len(a.Frames) {
+		t.Fatalf("got %d frames, want %d", len(got.Frames), len(a.Frames))
+	}
+	for i, f := range got.Frames {
+		want := a.Frames[i]
+		if f.Image.Bounds() != want.Image.Bounds() {
+			t.Errorf("frame %d: bounds %v, want %v", i, f.Image.Bounds(), want.Image.Bounds())
+			continue
+		}
+		if f.DelayNum != want.DelayNum || f.DelayDen != want.DelayDen || f.DisposeOp != want.DisposeOp || f.BlendOp != want.BlendOp {
+			t.Errorf("frame %d: got %+v, want %+v", i, f, want)
+		}
+		b := f.Image.Bounds()
+		compareImages(t, translate(cloneNRGBA(f.Image), b.Min.Mul(-1)), want.Image, 0)
+	}
+
+	// Compositing the cropped frames gives back the full ones.
+	c := got.NewCompositor()
+	for c.Next() {
+		compareImages(t, c.Image(), full[c.Frame()], 0)
+	}
+}
+
+// cloneNRGBA copies m into an *image.NRGBA with the same bounds.
+func cloneNRGBA(m image.Image) *image.NRGBA {
+	b := m.Bounds()
+	n := image.NewNRGBA(b)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			n.Set(x, y, m.At(x, y))
+		}
+	}
+	return n
+}
+
+func TestDecodePNG(t *testing.T) {
+	m := testSource("NRGBA64", image.Rect(0, 0, 9, 7), 5)
+	buf := bytes.NewBuffer(nil)
+	if err := png.Encode(buf, m); err != nil {
+		t.Fatal(err)
+	}
+	a, err := Decode(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Default != nil || len(a.Frames) != 1 {
+		t.Fatalf("got default %v and %d frames, want one frame", a.Default != nil, len(a.Frames))
+	}
+	compareImages(t, a.Frames[0].Image, m, 0)
+}
+
+func TestDecodeErrors(t *testing.T) {
+	a := testAnimation(3)
+	a.Crop()
+	buf := bytes.NewBuffer(nil)
+	if err := Encode(buf, a, nil); err != nil {
+		t.Fatal(err)
+	}
+	b := buf.Bytes()
+
+	badCRC := append([]byte(nil), b...)
+	badCRC[len(PngHeader)+8+13] ^= 1 // IHDR CRC
+	for name, data := range map[string][]byte{
+		"Empty":     nil,
+		"NotPNG":    []byte("GIF89a"),
+		"Truncated": b[:len(b)/2],
+		"BadCRC":    badCRC,
+	} {
+		if _, err := Decode(bytes.NewReader(data)); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
+
+func TestCompositor(t *testing.T) {
+	red := color.NRGBA{0xff, 0, 0, 0xff}
+	blue := color.NRGBA{0, 0, 0xff, 0x80}
+	green := color.NRGBA{0, 0xff, 0, 0xff}
+	uniform := func(c color.Color, r image.Rectangle) image.Image {
+		m := image.NewNRGBA(r)
+		for i := 0; i < len(m.Pix); i += 4 {
+			m.Pix[i], m.Pix[i+1], m.Pix[i+2], m.Pix[i+3] = c.(color.NRGBA).R, c.(color.NRGBA).G, c.(color.NRGBA).B, c.(color.NRGBA).A
+		}
+		return m
+	}
+	a := &Animation{Width: 4, Height: 4, Frames: []Frame{
+		{Image: uniform(red, image.Rect(0, 0, 4, 4))},
+		{Image: uniform(blue, image.Rect(1, 1, 3, 3)), BlendOp: BlendOp_Over, DisposeOp: DisposeOp_Previous},
+		{Image: uniform(green, image.Rect(0, 0, 1, 1)), DisposeOp: DisposeOp_Background},
+		{Image: uniform(blue, image.Rect(3, 3, 4, 4)), BlendOp: BlendOp_Source},
+	}}
+	// The expected color at (0, 0), (1, 1) and (3, 3) after each frame.
+	over := color.NRGBAModel.Convert(color.RGBA64{
+		R: 0xffff * 0x7f7f / 0xffff,
+		B: 0x8080,
+		A: 0xffff,
+	})
+	want := [][3]color.Color{
+		{red, red, red},
+		{red, over, red},
+		{green, red, red},
+		{color.NRGBA{}, red, blue},
+	}
+	c := a.NewCompositor()
+	for c.Next() {
+		for j, p := range []image.Point{{0, 0}, {1, 1}, {3, 3}} {
+			if !sameColor(c.Image().At(p.X, p.Y), want[c.Frame()][j], 0x101) {
+				t.Errorf("frame %d, %v: got %v, want %v", c.Frame(), p, c.Image().At(p.X, p.Y), want[c.Frame()][j])
+			}
+		}
+	}
+	if c.Frame() != len(a.Frames)-1 {
+		t.Errorf("composited %d frames, want %d", c.Frame()+1, len(a.Frames))
+	}
+}
+
+// TestCompositorOverTransparent checks that a translucent frame blended over
+// transparent pixels keeps its exact colors, as it would with BlendOp_Source,
+// rather than going through alpha-premultiplied form, which loses the low bits
+// of 16 bit colors.
+func TestCompositorOverTransparent(t *testing.T) {
+	c0 := color.NRGBA64{0x1234, 0x5678, 0x9abc, 0x0800}
+	m := image.NewNRGBA64(image.Rect(1, 1, 3, 3))
+	for y := 1; y < 3; y++ {
+		for x := 1; x < 3; x++ {
+			m.SetNRGBA64(x, y, c0)
+		}
+	}
+	a := &Animation{Width: 4, Height: 4, Frames: []Frame{
+		{Image: image.NewNRGBA64(image.Rect(0, 0, 4, 4))},
+		{Image: m, BlendOp: BlendOp_Over},
+	}}
+	buf := bytes.NewBuffer(nil)
+	if err := Encode(buf, a, nil); err != nil {
+		t.Fatal(err)
+	}
+	d, err := Decode(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.Frames) != 2 || d.Frames[1].BlendOp != BlendOp_Over {
+		t.Fatalf("decoded %d frames, want 2 with the second blended over", len(d.Frames))
+	}
+	c := d.NewCompositor()
+	for c.Next() {
+	}
+	for _, p := range []image.Point{{1, 1}, {2, 2}} {
+		if got := color.NRGBA64Model.Convert(c.Image().At(p.X, p.Y)); got != c0 {
+			t.Errorf("%v: got %v, want %v", p, got, c0)
+		}
+	}
+	if got := color.NRGBA64Model.Convert(c.Image().At(0, 0)); got != (color.NRGBA64{}) {
+		t.Errorf("(0, 0): got %v, want transparent", got)
+	}
+}
+
+// TestDecodeFrameChunks checks that ancillary chunks after a frame's fcTL stay
+// with that frame through Decode and Encode, and that Encode writes them right
+// after the fcTL.
+func TestDecodeFrameChunks(t *testing.T) {
+	prvt := func(s string) *RawChunk {
+		return &RawChunk{Type: [4]byte{'p', 'r', 'V', 't'}, Data: []byte(s)}
+	}
+	for _, deflt := range []bool{false, true} {
+		a := testAnimation(4)
+		a.Crop()
+		if deflt {
+			a.Default = testSource("Gray", a.Bounds(), 4)
+		}
+		a.Chunks = []*RawChunk{prvt("animation")}
+		a.Frames[0].Chunks = []*RawChunk{prvt("frame 0")}
+		a.Frames[2].Chunks = []*RawChunk{prvt("frame 2a"), prvt("frame 2b")}
+
+		// Decoding and encoding again keeps the chunks where they were.
+		b := bytes.NewBuffer(nil)
+		if err := Encode(b, a, nil); err != nil {
+			t.Fatal(err)
+		}
+		got, err := Decode(bytes.NewReader(b.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b2 := bytes.NewBuffer(nil)
+		if err := Encode(b2, got, nil); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b.Bytes(), b2.Bytes()) {
+			t.Errorf("default=%v: encoding the decoded animation gives different bytes", deflt)
+		}
+
+		want := []string{"animation"}
+		for i, f := range got.Frames {
+			for _, c := range f.Chunks {
+				want = append(want, string(c.Data))
+			}
+			if n := len(a.Frames[i].Chunks); len(f.Chunks) != n {
+				t.Errorf("default=%v: frame %d has %d chunks, want %d", deflt, i, len(f.Chunks), n)
+			}
+		}
+		if len(got.Chunks) != 1 || string(got.Chunks[0].Data) != "animation" {
+			t.Errorf("default=%v: got animation chunks %v", deflt, got.Chunks)
+		}
+
+		// Each frame's chunks follow its fcTL.
+		var order []string
+		cr := NewChunkReader(bytes.NewReader(b.Bytes()))
+		var last string
+		for cr.Next() {
+			c := cr.Chunk()
+			switch string(c.Type[:]) {
+			case "fcTL":
+				last = "fcTL"
+			case "prVt":
+				if s := string(c.Data); s != "animation" && last != "fcTL" && last != "prVt" {
+					t.Errorf("default=%v: %q follows %s", deflt, s, last)
+				}
+				order = append(order, string(c.Data))
+				last = "prVt"
+			default:
+				last = string(c.Type[:])
+			}
+		}
+		if len(order) != len(want) {
+			t.Fatalf("default=%v: got chunks %q, want %q", deflt, order, want)
+		}
+		for i := range order {
+			if order[i] != want[i] {
+				t.Errorf("default=%v: got chunks %q, want %q", deflt, order, want)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package apng
+
+import (
+	"math/big"
+	"time"
+)
+
+// maxDelay is the largest numerator or denominator of a frame delay.
+const maxDelay = 1<<16 - 1
+
+// NewDelay returns the frame delay fraction, with a numerator and denominator
+// that each fit in a uint16, nearest to d.  Durations that are negative or
+// longer than 65535 seconds are clamped.
+func NewDelay(d time.Duration) (num, den uint16) {
+	return NewDelayRat(big.NewRat(int64(d), int64(time.Second)))
+}
+
+// NewDelayRat returns the frame delay fraction nearest to x seconds, as per
+// NewDelay.  This is exact for rational frame rates such as 24000/1001 frames
+// per second, whose frames last 1001/24000 seconds.
+func NewDelayRat(x *big.Rat) (num, den uint16) {
+	if x.Sign() <= 0 {
+		return 0, 1
+	}
+	if x.Cmp(big.NewRat(maxDelay, 1)) >= 0 {
+		return maxDelay, 1
+	}
+	n, d := bestFraction(x, maxDelay)
+	return uint16(n), uint16(d)
+}
+
+// DelayDuration returns the frame delay num/den seconds as a duration, rounded
+// to the nearest nanosecond.  A den of 0 is treated as 100, as per the APNG
+// spec.
+func DelayDuration(num, den uint16) time.Duration {
+	if den == 0 {
+		den = 100
+	}
+	return time.Duration((int64(num)*int64(time.Second) + int64(den)/2) / int64(den))
+}
+
+// bestFraction returns the fraction nearest to x, which must be in (0, max),
+// whose numerator and denominator are at most max.  It walks the continued
+// fraction of x, and at the point where the convergents get too big, tries the
+// largest semiconvergent that is not.
+func bestFraction(x *big.Rat, max int64) (int64, int64) {
+	p, q := new(big.Int).Set(x.Num()), new(big.Int).Set(x.Denom())
+	// h and k are the numerators and denominators of the last two
+	// convergents.
+	h0, h1, k0, k1 := int64(0), int64(1), int64(1), int64(0)
+	a, r := new(big.Int), new(big.Int)
+	for q.Sign() != 0 {
+		a.QuoRem(p, q, r)
+		// Any term over max makes the next convergent too big.
+		ai := max + 1
+		if a.IsInt64() && a.Int64() <= max {
+			ai = a.Int64()
+		}
+		h2, k2 := ai*h1+h0, ai*k1+k0
+		if h2 > max || k2 > max {
+			// The largest t with t*h1+h0 and t*k1+k0 in range.  Since
+			// x < max, k1 is not 0 here, but h1 is when x < 1.
+			t := (max - k0) / k1
+			if h1 > 0 {
+				if th := (max - h0) / h1; th < t {
+					t = th
+				}
+			}
+			// A semiconvergent with t >= ai/2 can be better than the
+			// last convergent; compare them.
+			if 2*t >= ai && t > 0 {
+				hs, ks := t*h1+h0, t*k1+k0
+				if closer(x, hs, ks, h1, k1) {
+					return hs, ks
+				}
+			}
+			break
+		}
+		h0, h1, k0, k1 = h1, h2, k1, k2
+		p, q, r = q, r, p
+	}
+	return h1, k1
+}
+
+// closer reports whether a/b is closer to x than c/d.
+func closer(x *big.Rat, a, b, c, d int64) bool {
+	e1 := new(big.Rat).Sub(x, big.NewRat(a, b))
+	e2 := new(big.Rat).Sub(x, big.NewRat(c, d))
+	return e1.Abs(e1).Cmp(e2.Abs(e2)) < 0
+}
+
+// Timeline turns frame timestamps into frame delays.  It keeps the exact sum
+// of the delays it has returned, and gives each frame the delay nearest to the
+// time left until the frame's end, so that rounding errors do not add up over
+// a long animation: every frame ends as close to its timestamp as a single
+// delay can get it.  The zero Timeline starts at time 0.
+type Timeline struct {
+	elapsed big.Rat // Sum of the delays so far, in seconds
+}
+
+// Until returns the delay of the next frame, which ends end after the start
+// of the animation.  The end of a frame is the start of the next.
+func (t *Timeline) Until(end time.Duration) (num, den uint16) {
+	return t.UntilRat(big.NewRat(int64(end), int64(time.Second)))
+}
+
+// UntilPTS returns the delay of the next frame, which ends at the presentation
+// timestamp pts in a time base of timeBaseNum/timeBaseDen seconds, as used by
+// video containers and ffmpeg.  For frames at a constant rate of R/S frames
+// per second, frame i ends at pts i+1 in a time base of S/R.
+func (t *Timeline) UntilPTS(pts, timeBaseNum, timeBaseDen int64) (num, den uint16) {
+	end := new(big.Rat).SetFrac(big.NewInt(pts), big.NewInt(timeBaseDen))
+	return t.UntilRat(end.Mul(end, big.NewRat(timeBaseNum, 1)))
+}
+
+// UntilRat returns the delay of the next frame, which ends end seconds after
+// the start of the animation.
+func (t *Timeline) UntilRat(end *big.Rat) (num, den uint16) {
+	num, den = NewDelayRat(new(big.Rat).Sub(end, &t.elapsed))
+	t.elapsed.Add(&t.elapsed, big.NewRat(int64(num), int64(den)))
+	return num, den
+}
+
+// Elapsed returns the sum of the delays returned so far, in seconds.
+func (t *Timeline) Elapsed() *big.Rat {
+	return new(big.Rat).Set(&t.elapsed)
+}
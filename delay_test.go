@@ -0,0 +1,105 @@
+package apng
+
+import (
+	"math/big"
+	"testing"
+	"time"
+)
+
+func TestNewDelay(t *testing.T) {
+	for _, tc := range []struct {
+		d        time.Duration
+		num, den uint16
+	}{
+		{0, 0, 1},
+		{-time.Second, 0, 1},
+		{time.Second / 10, 1, 10},
+		{40 * time.Millisecond, 1, 25},
+		{41708333, 1001, 24000}, // 24000/1001 frames per second, to the nanosecond
+		{time.Second / 70000, 1, 65535},
+		{time.Second / 200000, 0, 1},
+		{20 * time.Hour, 65535, 1},
+		{time.Duration(65534.5 * float64(time.Second)), 65534, 1},
+	} {
+		num, den := NewDelay(tc.d)
+		if num != tc.num || den != tc.den {
+			t.Errorf("NewDelay(%v) = %d/%d, want %d/%d", tc.d, num, den, tc.num, tc.den)
+		}
+	}
+	if num, den := NewDelayRat(big.NewRat(1001, 30000)); num != 1001 || den != 30000 {
+		t.Errorf("NewDelayRat(1001/30000) = %d/%d", num, den)
+	}
+	if d := DelayDuration(1001, 30000); d != 33366667 {
+		t.Errorf("DelayDuration(1001, 30000) = %v", d)
+	}
+	if d := DelayDuration(7, 0); d != 70*time.Millisecond {
+		t.Errorf("DelayDuration(7, 0) = %v", d)
+	}
+}
+
+// TestBestFraction checks bestFraction against a brute-force search over
+// denominators.
+func TestBestFraction(t *testing.T) {
+	const max = 200
+	for _, x := range []*big.Rat{
+		big.NewRat(314159, 100000),
+		big.NewRat(1, 3),
+		big.NewRat(1, 401),
+		big.NewRat(1, 399),
+		big.NewRat(199999, 1000),
+		big.NewRat(271828, 100000),
+		big.NewRat(5, 1000),
+		big.NewRat(1234567, 7654321),
+	} {
+		n, d := bestFraction(x, max)
+		best := new(big.Rat).Sub(x, big.NewRat(n, d))
+		best.Abs(best)
+		for k := int64(1); k <= max; k++ {
+			// The nearest numerator for denominator k.
+			h := new(big.Rat).Mul(x, big.NewRat(k, 1))
+			for _, h := range []int64{new(big.Int).Quo(h.Num(), h.Denom()).Int64(), new(big.Int).Quo(h.Num(), h.Denom()).Int64() + 1} {
+				if h > max {
+					continue
+				}
+				e := new(big.Rat).Sub(x, big.NewRat(h, k))
+				if e.Abs(e).Cmp(best) < 0 {
+					t.Errorf("bestFraction(%v) = %d/%d, but %d/%d is closer", x, n, d, h, k)
+				}
+			}
+		}
+	}
+}
+
+func TestTimeline(t *testing.T) {
+	// Frames of 1/65537 s, which is not a delay a uint16 fraction can hold.
+	const frames = 10000
+	var tl Timeline
+	for i := int64(1); i <= frames; i++ {
+		tl.UntilPTS(i, 1, 65537)
+		// Each frame ends within the error of a single delay.
+		e := new(big.Rat).Sub(tl.Elapsed(), big.NewRat(i, 65537))
+		if e.Abs(e).Cmp(big.NewRat(1, 2*65535)) > 0 {
+			t.Fatalf("frame %d ends %v s off", i, e.FloatString(9))
+		}
+	}
+
+	// Rates that fit are exact.
+	tl = Timeline{}
+	for i := int64(1); i <= 1000; i++ {
+		if num, den := tl.UntilPTS(i, 1001, 24000); num != 1001 || den != 24000 {
+			t.Fatalf("frame %d: got %d/%d", i, num, den)
+		}
+	}
+
+	// Timestamps in nanoseconds at 29.97 frames per second.
+	tl = Timeline{}
+	var total time.Duration
+	for i := 1; i <= 3000; i++ {
+		end := time.Duration(int64(i) * 1001 * int64(time.Second) / 30000)
+		num, den := tl.Until(end)
+		total += DelayDuration(num, den)
+		if diff := total - end; diff < -time.Millisecond || diff > time.Millisecond {
+			t.Fatalf("frame %d: total %v, want %v", i, total, end)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package apng
+
+import (
+	"fmt"
+	"image"
+	"math/big"
+)
+
+// The editing operations below change an Animation in place.  Encode numbers
+// the fcTL and fdAT chunks afresh, so edited animations need no renumbering.
+// To change the loop count, set NumPlays.
+
+// Flatten replaces each frame with the whole canvas as displayed after it,
+// with DisposeOp_None and BlendOp_Source, so that no frame depends on the
+// frames before it.  Call Crop afterwards to encode only what changes.
+func (a *Animation) Flatten() {
+	a.flatten(len(a.Frames))
+}
+
+// flatten flattens the first n frames.
+func (a *Animation) flatten(n int) {
+	frames := make([]image.Image, 0, n)
+	c := a.NewCompositor()
+	for len(frames) < n && c.Next() {
+		frames = append(frames, cloneImage(c.Image()))
+	}
+	for i, m := range frames {
+		f := &a.Frames[i]
+		f.Image, f.DisposeOp, f.BlendOp = m, DisposeOp_None, BlendOp_Source
+	}
+}
+
+// cloneImage copies a compositor's canvas.
+func cloneImage(m image.Image) image.Image {
+	switch m := m.(type) {
+	case *image.NRGBA:
+		return &image.NRGBA{Pix: append([]uint8(nil), m.Pix...), Stride: m.Stride, Rect: m.Rect}
+	case *image.NRGBA64:
+		return &image.NRGBA64{Pix: append([]uint8(nil), m.Pix...), Stride: m.Stride, Rect: m.Rect}
+	}
+	panic("apng: unexpected canvas type")
+}
+
+// Trim keeps only frames start to end-1.  If that drops frames from the
+// start, the frames kept are flattened, so that they display as they did,
+// and cropped.
+func (a *Animation) Trim(start, end int) error {
+	if start < 0 || end > len(a.Frames) || start >= end {
+		return FormatError(fmt.Sprintf("frames %d to %d are not a range of the %d frames", start, end, len(a.Frames)))
+	}
+	if start > 0 {
+		a.flatten(end)
+	}
+	a.Frames = a.Frames[start:end:end]
+	if start > 0 {
+		a.Crop()
+	}
+	return nil
+}
+
+// Reverse reverses the order of the frames, each of which keeps its delay.
+// The frames are flattened, so that each displays as it did, and cropped.
+func (a *Animation) Reverse() {
+	a.Flatten()
+	for i, j := 0, len(a.Frames)-1; i < j; i, j = i+1, j-1 {
+		a.Frames[i], a.Frames[j] = a.Frames[j], a.Frames[i]
+	}
+	a.Crop()
+}
+
+// Retime multiplies every frame delay by num/den, so that a factor of 2/1
+// plays the animation at half speed.  Each frame starts as near as a delay
+// fraction allows to the scaled time it started at before, as per Timeline,
+// so the total duration scales exactly where possible.
+func (a *Animation) Retime(num, den int64) error {
+	if num < 0 || den <= 0 {
+		return FormatError(fmt.Sprintf("invalid delay factor %d/%d", num, den))
+	}
+	factor := big.NewRat(num, den)
+	var t Timeline
+	end, d := new(big.Rat), new(big.Rat)
+	for i := range a.Frames {
+		f := &a.Frames[i]
+		dd := int64(f.DelayDen)
+		if dd == 0 {
+			dd = 100
+		}
+		end.Add(end, d.SetFrac64(int64(f.DelayNum), dd))
+		f.DelayNum, f.DelayDen = t.UntilRat(d.Mul(end, factor))
+	}
+	return nil
+}
+
+// Append adds the frames of b, which must have the same canvas size, to the
+// end of a.  b's frames display as they do in b: if b's first frame does not
+// replace the whole canvas, or uses DisposeOp_Previous, which is treated as
+// DisposeOp_Background only on the first frame, b's frames are flattened and
+// cropped first.  a keeps its default image, loop count and chunks.
+func (a *Animation) Append(b *Animation) error {
+	if a.Width != b.Width || a.Height != b.Height {
+		return FormatError(fmt.Sprintf("cannot append a %dx%d animation to a %dx%d one", b.Width, b.Height, a.Width, a.Height))
+	}
+	if len(b.Frames) == 0 {
+		return nil
+	}
+	frames := b.Frames
+	if f := frames[0]; f.Image.Bounds() != b.Bounds() || f.BlendOp != BlendOp_Source || f.DisposeOp == DisposeOp_Previous {
+		c := &Animation{Width: b.Width, Height: b.Height, Frames: append([]Frame(nil), frames...)}
+		c.Flatten()
+		c.Crop()
+		frames = c.Frames
+	}
+	a.Frames = append(a.Frames, frames...)
+	return nil
+}
@@ -0,0 +1,135 @@
+package apng
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"testing"
+)
+
+// editAnimation returns an animation whose frames depend on each other through
+// every dispose and blend operator.
+func editAnimation() *Animation {
+	uniform := func(c color.NRGBA, r image.Rectangle) image.Image {
+		m := image.NewNRGBA(r)
+		for i := 0; i < len(m.Pix); i += 4 {
+			m.Pix[i], m.Pix[i+1], m.Pix[i+2], m.Pix[i+3] = c.R, c.G, c.B, c.A
+		}
+		return m
+	}
+	return &Animation{Width: 6, Height: 5, NumPlays: 4, Frames: []Frame{
+		{Image: uniform(color.NRGBA{0xff, 0, 0, 0xff}, image.Rect(0, 0, 6, 5)), DelayNum: 1, DelayDen: 10},
+		{Image: uniform(color.NRGBA{0, 0, 0xff, 0x80}, image.Rect(1, 1, 4, 3)), DelayNum: 2, DelayDen: 10, BlendOp: BlendOp_Over, DisposeOp: DisposeOp_Previous},
+		{Image: uniform(color.NRGBA{0, 0xff, 0, 0xff}, image.Rect(0, 0, 2, 2)), DelayNum: 3, DelayDen: 10, DisposeOp: DisposeOp_Background},
+		{Image: uniform(color.NRGBA{0, 0xff, 0xff, 0x40}, image.Rect(2, 2, 6, 5)), DelayNum: 4, DelayDen: 0, BlendOp: BlendOp_Over},
+		{Image: uniform(color.NRGBA{0xff, 0xff, 0, 0xff}, image.Rect(3, 0, 5, 1)), DelayNum: 5, DelayDen: 10},
+	}}
+}
+
+// renders returns the canvas after each frame of a.
+func renders(a *Animation) []image.Image {
+	var out []image.Image
+	c := a.NewCompositor()
+	for c.Next() {
+		out = append(out, cloneImage(c.Image()))
+	}
+	return out
+}
+
+// checkRenders checks that a displays the images, and can be encoded.
+func checkRenders(t *testing.T, a *Animation, want []image.Image) {
+	t.Helper()
+	got := renders(a)
+	if len(got) != len(want) {
+		t.Fatalf("got %d frames, want %d", len(got), len(want))
+	}
+	for i := range got {
+		compareImages(t, got[i], want[i], 0)
+	}
+	if err := Encode(bytes.NewBuffer(nil), a, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTrim(t *testing.T) {
+	for _, r := range [][2]int{{0, 5}, {0, 2}, {1, 4}, {2, 3}, {4, 5}} {
+		a := editAnimation()
+		want := renders(a)[r[0]:r[1]]
+		if err := a.Trim(r[0], r[1]); err != nil {
+			t.Fatal(err)
+		}
+		checkRenders(t, a, want)
+		for i, f := range a.Frames {
+			if f.DelayNum != uint16(r[0]+i+1) {
+				t.Errorf("trim %v, frame %d: got delay %d/%d", r, i, f.DelayNum, f.DelayDen)
+			}
+		}
+	}
+	a := editAnimation()
+	for _, r := range [][2]int{{-1, 2}, {3, 3}, {2, 6}} {
+		if err := a.Trim(r[0], r[1]); err == nil {
+			t.Errorf("trim %v: no error", r)
+		}
+	}
+}
+
+func TestReverse(t *testing.T) {
+	a := editAnimation()
+	want := renders(a)
+	for i, j := 0, len(want)-1; i < j; i, j = i+1, j-1 {
+		want[i], want[j] = want[j], want[i]
+	}
+	a.Reverse()
+	checkRenders(t, a, want)
+	for i, f := range a.Frames {
+		if f.DelayNum != uint16(len(a.Frames)-i) {
+			t.Errorf("frame %d: got delay %d/%d", i, f.DelayNum, f.DelayDen)
+		}
+	}
+}
+
+func TestRetime(t *testing.T) {
+	a := editAnimation()
+	if err := a.Retime(3, 2); err != nil {
+		t.Fatal(err)
+	}
+	want := [][2]uint16{{3, 20}, {3, 10}, {9, 20}, {3, 50}, {3, 4}}
+	for i, f := range a.Frames {
+		if f.DelayNum != want[i][0] || f.DelayDen != want[i][1] {
+			t.Errorf("frame %d: got delay %d/%d, want %d/%d", i, f.DelayNum, f.DelayDen, want[i][0], want[i][1])
+		}
+	}
+	if err := a.Retime(1, 0); err == nil {
+		t.Error("no error for a zero denominator")
+	}
+}
+
+func TestAppend(t *testing.T) {
+	a, b := editAnimation(), editAnimation()
+	if err := b.Trim(0, 4); err != nil {
+		t.Fatal(err)
+	}
+	// b's first frame must be drawn on a transparent canvas.
+	b.Frames[0].Image = b.Frames[0].Image.(*image.NRGBA).SubImage(image.Rect(1, 1, 5, 4))
+	b.Default = image.NewGray(b.Bounds())
+	want := append(renders(a), renders(b)...)
+	if err := a.Append(b); err != nil {
+		t.Fatal(err)
+	}
+	checkRenders(t, a, want)
+
+	// Frames that replace the canvas are appended as they are.
+	a, b = editAnimation(), editAnimation()
+	want = append(renders(a), renders(b)...)
+	if err := a.Append(b); err != nil {
+		t.Fatal(err)
+	}
+	checkRenders(t, a, want)
+	if a.Frames[6].Image != b.Frames[1].Image {
+		t.Error("frames copied needlessly")
+	}
+
+	if err := a.Append(&Animation{Width: 5, Height: 5}); err == nil {
+		t.Error("no error for a different canvas size")
+	}
+}
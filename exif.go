@@ -0,0 +1,59 @@
+package apng
+
+import (
+	"io"
+)
+
+// TIFF byte order marks, each followed by the magic number 42 in that order.
+const (
+	tiffHeaderLittleEndian = "II\x2a\x00"
+	tiffHeaderBigEndian    = "MM\x00\x2a"
+)
+
+const sizeOfTIFFHeader = 8
+
+// Chunk_eXIf is the EXIF metadata chunk, as per the PNG extensions spec.
+// Write this after IHDR but before any image data.
+type Chunk_eXIf struct {
+	data []byte
+}
+
+// NewChunk_eXIf makes a new EXIF chunk from raw EXIF bytes.  The bytes must
+// start with a TIFF header (without the "Exif\x00\x00" JPEG APP1 prefix) whose
+// first IFD offset lies within the data.
+func NewChunk_eXIf(b []byte) (*Chunk_eXIf, error) {
+	if err := checkTIFFHeader(b); err != nil {
+		return nil, err
+	}
+	return &Chunk_eXIf{data: b}, nil
+}
+
+// Bytes returns the raw EXIF bytes, starting with the TIFF header.
+func (c *Chunk_eXIf) Bytes() []byte {
+	return c.data
+}
+
+// WriteTo encodes the EXIF chunk to the io.Writer.  This supports the
+// io.WriterTo interface.
+func (c *Chunk_eXIf) WriteTo(w io.Writer) (int64, error) {
+	return writeChunkTo("eXIf", c.data, w)
+}
+
+func checkTIFFHeader(b []byte) error {
+	if len(b) < sizeOfTIFFHeader {
+		return FormatError("eXIf: too short for a TIFF header")
+	}
+	var ifd uint32
+	switch string(b[:4]) {
+	case tiffHeaderLittleEndian:
+		ifd = uint32(b[4]) | uint32(b[5])<<8 | uint32(b[6])<<16 | uint32(b[7])<<24
+	case tiffHeaderBigEndian:
+		ifd = readUint32(b[4:8])
+	default:
+		return FormatError("eXIf: bad TIFF byte order mark")
+	}
+	if ifd < sizeOfTIFFHeader || uint64(ifd) >= uint64(len(b)) {
+		return FormatError("eXIf: IFD offset out of range")
+	}
+	return nil
+}
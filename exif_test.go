@@ -0,0 +1,42 @@
+package apng
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestNewChunk_eXIf(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		data string
+		ok   bool
+	}{
+		{"LittleEndian", "II\x2a\x00\x08\x00\x00\x00\x00\x00", true},
+		{"BigEndian", "MM\x00\x2a\x00\x00\x00\x08\x00\x00", true},
+		{"Empty", "", false},
+		{"Short", "II\x2a\x00\x08\x00", false},
+		{"BadByteOrder", "IM\x2a\x00\x08\x00\x00\x00\x00\x00", false},
+		{"LittleEndianBigMagic", "II\x00\x2a\x08\x00\x00\x00\x00\x00", false},
+		{"BigEndianLittleMagic", "MM\x2a\x00\x00\x00\x00\x08\x00\x00", false},
+		{"JPEGPrefix", "Exif\x00\x00II\x2a\x00\x08\x00\x00\x00\x00\x00", false},
+		{"IFDInHeader", "II\x2a\x00\x04\x00\x00\x00\x00\x00", false},
+		{"IFDAtEnd", "II\x2a\x00\x0a\x00\x00\x00\x00\x00", false},
+		{"IFDPastEnd", "MM\x00\x2a\xff\xff\xff\xff\x00\x00", false},
+	} {
+		c, err := NewChunk_eXIf([]byte(tc.data))
+		switch {
+		case tc.ok && err != nil:
+			t.Errorf("%s: %v", tc.name, err)
+		case !tc.ok && err == nil:
+			t.Errorf("%s: no error", tc.name)
+		case !tc.ok:
+			if _, ok := err.(FormatError); !ok {
+				t.Errorf("%s: got %T, want FormatError", tc.name, err)
+			}
+		default:
+			if !bytes.Equal(c.Bytes(), []byte(tc.data)) {
+				t.Errorf("%s: Bytes returned %q", tc.name, c.Bytes())
+			}
+		}
+	}
+}
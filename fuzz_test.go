@@ -0,0 +1,208 @@
+package apng
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"testing"
+)
+
+// fuzzImage builds an image of one of the types the encoder handles, of the
+// given size, filling its pixels from pix.
+func fuzzImage(kind uint8, w, h int, pix []byte) image.Image {
+	r := image.Rect(0, 0, w, h)
+	fill := func(dst []byte) {
+		if len(pix) == 0 {
+			return
+		}
+		for i := range dst {
+			dst[i] = pix[i%len(pix)]
+		}
+	}
+	switch kind % 10 {
+	case 0:
+		m := image.NewGray(r)
+		fill(m.Pix)
+		return m
+	case 1:
+		m := image.NewGray16(r)
+		fill(m.Pix)
+		return m
+	case 2:
+		m := image.NewRGBA(r)
+		fill(m.Pix)
+		return m
+	case 3:
+		m := image.NewNRGBA(r)
+		fill(m.Pix)
+		return m
+	case 4:
+		m := image.NewRGBA64(r)
+		fill(m.Pix)
+		return m
+	case 5:
+		m := image.NewNRGBA64(r)
+		fill(m.Pix)
+		return m
+	case 6:
+		p := color.Palette{}
+		for i := 0; i+4 <= len(pix) && len(p) < 256; i += 4 {
+			p = append(p, color.NRGBA{pix[i], pix[i+1], pix[i+2], pix[i+3]})
+		}
+		if len(p) == 0 {
+			p = append(p, color.Black)
+		}
+		m := image.NewPaletted(r, p)
+		fill(m.Pix)
+		// image.Paletted's At panics on indices beyond the palette.
+		for i := range m.Pix {
+			m.Pix[i] = uint8(int(m.Pix[i]) % len(p))
+		}
+		return m
+	case 7:
+		m := image.NewYCbCr(r, image.YCbCrSubsampleRatio420)
+		fill(m.Y)
+		fill(m.Cb)
+		fill(m.Cr)
+		return m
+	case 8:
+		m := image.NewNYCbCrA(r, image.YCbCrSubsampleRatio422)
+		fill(m.Y)
+		fill(m.Cb)
+		fill(m.Cr)
+		fill(m.A)
+		return m
+	}
+	return opaque{fuzzImage(3, w, h, pix)}
+}
+
+// FuzzEncoder feeds arbitrary sizes, pixels and IHDR fields to the encoders.
+// They must not panic, and whatever they accept must decode.
+func FuzzEncoder(f *testing.F) {
+	f.Add(uint8(3), uint8(4), uint8(3), uint8(ColorType_TrueColorAlpha), uint8(BitDepth_8), int8(DefaultCompression), []byte{1, 2, 3, 4, 5})
+	f.Add(uint8(6), uint8(7), uint8(2), uint8(ColorType_Paletted), uint8(BitDepth_8), int8(BestSpeed), []byte{0, 0, 0, 0xff, 0xff, 0xff, 0xff, 0x80})
+	f.Add(uint8(2), uint8(1), uint8(1), uint8(ColorType_Paletted), uint8(BitDepth_8), int8(NoCompression), []byte{0})
+	f.Add(uint8(1), uint8(9), uint8(5), uint8(ColorType_Grayscale), uint8(BitDepth_16), int8(BestCompression), []byte{0xff, 0x00, 0x12})
+	f.Add(uint8(5), uint8(0), uint8(3), uint8(ColorType_TrueColor), uint8(BitDepth_16), int8(DefaultCompression), []byte{})
+	f.Add(uint8(7), uint8(5), uint8(5), uint8(ColorType_GrayscaleAlpha), uint8(BitDepth_4), int8(DefaultCompression), []byte{0x80})
+	f.Fuzz(func(t *testing.T, kind, w, h, ct, bd uint8, cl int8, pix []byte) {
+		// Keep images small, but allow empty ones.
+		m := fuzzImage(kind, int(w%65), int(h%65), pix)
+		ihdr := &Chunk_IHDR{
+			Width:     uint32(w % 65),
+			Height:    uint32(h % 65),
+			BitDepth:  BitDepth(bd),
+			ColorType: ColorType(ct),
+		}
+		level := CompressionLevel(cl)
+		if level < BestCompression {
+			level = DefaultCompression
+		}
+
+		buf := bytes.NewBuffer(nil)
+		buf.WriteString(PngHeader)
+		if _, err := ihdr.WriteTo(buf); err != nil {
+			// Invalid headers must still be rejected by the encoder.
+			drainEncoder(ihdr.NewEncoder_IDAT(m, level))
+			return
+		}
+		if p, ok := m.(*image.Paletted); ok && ihdr.ColorType == ColorType_Paletted {
+			NewChunk_PLTE(p.Palette).WriteTo(buf)
+		}
+		e := ihdr.NewEncoder_IDAT(m, level)
+		for e.Next() {
+			e.Chunk().WriteTo(buf)
+		}
+		if e.Err() != nil {
+			return
+		}
+		(&Chunk_IEND{}).WriteTo(buf)
+		if _, err := png.Decode(buf); err != nil {
+			t.Fatalf("%+v: %T: %v", *ihdr, m, err)
+		}
+
+		// A frame at an offset within the canvas, taken from the full image.
+		fctl := &Chunk_fcTL{
+			Width:    ihdr.Width / 2,
+			Height:   ihdr.Height / 2,
+			XOffset:  ihdr.Width / 4,
+			YOffset:  ihdr.Height / 4,
+			DelayDen: 100,
+		}
+		drainEncoder(fctl.NewEncoder_fdAT(ihdr, NewSequenceNumbers(), m, level))
+		drainEncoder(ihdr.NewEncoder_fdAT(NewSequenceNumbers(), m, level))
+	})
+}
+
+func drainEncoder(e Encoder) {
+	for e.Next() {
+		e.Chunk().WriteTo(io.Discard)
+	}
+}
+
+// FuzzValidate feeds arbitrary bytes to the validator and the chunk reader,
+// which must not panic.  Every chunk that parses must write back out as the
+// same bytes.
+func FuzzValidate(f *testing.F) {
+	f.Add([]byte(PngHeader))
+	f.Add([]byte("not a PNG file"))
+	f.Fuzz(func(t *testing.T, b []byte) {
+		Validate(bytes.NewReader(b))
+
+		cr := NewChunkReader(bytes.NewReader(b))
+		for cr.Next() {
+			c := cr.Chunk()
+			if int64(len(c.Data)) > int64(len(b)) {
+				t.Fatalf("%s: %d bytes of data from a %d byte stream", c.Type, len(c.Data), len(b))
+			}
+			p, err := c.Parse()
+			if err != nil {
+				continue
+			}
+			want, got := bytes.NewBuffer(nil), bytes.NewBuffer(nil)
+			if _, err := c.WriteTo(want); err != nil {
+				continue
+			}
+			if _, err := p.WriteTo(got); err != nil {
+				continue
+			}
+			if !bytes.Equal(got.Bytes(), want.Bytes()) {
+				t.Fatalf("%s: %T writes %x, want %x", c.Type, p, got.Bytes(), want.Bytes())
+			}
+		}
+	})
+}
+
+// FuzzDecode feeds arbitrary bytes to the decoder, seeded with the same corpus
+// as FuzzValidate.  It must not panic, and whatever it accepts must composite,
+// and encode again as an animation that decodes to as many frames.
+func FuzzDecode(f *testing.F) {
+	f.Add([]byte(PngHeader))
+	f.Fuzz(func(t *testing.T, b []byte) {
+		// Keep the canvas small, as the frames are allocated in full.
+		if cfg, err := png.DecodeConfig(bytes.NewReader(b)); err == nil && cfg.Width*cfg.Height > 1<<16 {
+			return
+		}
+		a, err := Decode(bytes.NewReader(b))
+		if err != nil {
+			return
+		}
+		c := a.NewCompositor()
+		for c.Next() {
+		}
+
+		buf := bytes.NewBuffer(nil)
+		if err := Encode(buf, a, nil); err != nil {
+			t.Fatalf("re-encoding %dx%d with %d frames: %v", a.Width, a.Height, len(a.Frames), err)
+		}
+		got, err := Decode(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got.Frames) != len(a.Frames) {
+			t.Fatalf("got %d frames, want %d", len(got.Frames), len(a.Frames))
+		}
+	})
+}
@@ -0,0 +1,203 @@
+package apng
+
+import (
+	"image"
+	"image/draw"
+	"image/gif"
+	"math/big"
+)
+
+// FromGIF converts an animated GIF, as read by gif.DecodeAll, to an
+// Animation.  Each frame keeps its position, its delay of g.Delay[i]
+// hundredths of a second, and its disposal method: gif.DisposalBackground
+// becomes DisposeOp_Background, which clears the frame's area to transparent as
+// browsers do rather than to the GIF background color, and gif.DisposalPrevious
+// becomes DisposeOp_Previous.  Frames whose palette has a transparent color
+// use BlendOp_Over, so that the previous frame shows through.  A first frame
+// that does not cover the canvas is padded with transparent pixels.
+//
+// The frame images keep their own palettes.  Encode merges them into one
+// shared palette, with a tRNS entry for the transparent colors, if there are
+// at most 256 colors in all, and otherwise writes truecolor.
+//
+// g.LoopCount is mapped to NumPlays: -1, which plays the GIF once, becomes 1;
+// 0, which loops forever, stays 0; and n, which repeats the GIF n times after
+// the first, becomes n+1.
+func FromGIF(g *gif.GIF) (*Animation, error) {
+	if len(g.Image) == 0 {
+		return nil, FormatError("GIF has no frames")
+	}
+	a := &Animation{
+		Width:  g.Config.Width,
+		Height: g.Config.Height,
+	}
+	if a.Width == 0 || a.Height == 0 {
+		// As with image/gif, a missing screen size is that of the frames.
+		var r image.Rectangle
+		for _, m := range g.Image {
+			r = r.Union(m.Bounds())
+		}
+		a.Width, a.Height = r.Max.X, r.Max.Y
+	}
+	switch {
+	case g.LoopCount < 0:
+		a.NumPlays = 1
+	case g.LoopCount > 0:
+		a.NumPlays = uint32(g.LoopCount) + 1
+	}
+
+	canvas := a.Bounds()
+	for i, m := range g.Image {
+		f := Frame{Image: m, DelayDen: 100}
+		if i < len(g.Delay) {
+			f.DelayNum = uint16(g.Delay[i])
+		}
+		if i < len(g.Disposal) {
+			switch g.Disposal[i] {
+			case gif.DisposalBackground:
+				f.DisposeOp = DisposeOp_Background
+			case gif.DisposalPrevious:
+				f.DisposeOp = DisposeOp_Previous
+			}
+		}
+		if hasTransparent(m) {
+			f.BlendOp = BlendOp_Over
+		}
+		if i == 0 && m.Bounds() != canvas {
+			// The canvas starts out transparent, so blending makes no
+			// difference.
+			n := image.NewNRGBA(canvas)
+			draw.Draw(n, m.Bounds().Intersect(canvas), m, m.Bounds().Min, draw.Src)
+			f.Image, f.BlendOp = n, BlendOp_Source
+		}
+		a.Frames = append(a.Frames, f)
+	}
+	return a, nil
+}
+
+// hasTransparent reports whether the palette of m has a color that is not
+// fully opaque.
+func hasTransparent(m *image.Paletted) bool {
+	for _, c := range m.Palette {
+		if _, _, _, a := c.RGBA(); a != 0xffff {
+			return true
+		}
+	}
+	return false
+}
+
+// GIFOptions controls how ToGIF converts an Animation.
+type GIFOptions struct {
+	Dither Dither // Dithering method used when a frame has more than 256 colors
+}
+
+// ToGIF converts an animation to a GIF, which gif.EncodeAll can write.  The
+// frames are composited onto the canvas as an APNG decoder displays them, and
+// each is then quantized to a palette of its own of at most 256 colors.  GIF
+// transparency is all or nothing, so pixels that are less than half opaque
+// become the palette's transparent color, which gif.EncodeAll writes as the
+// transparency index, and the rest become fully opaque.  If no frame has
+// transparent pixels, each GIF frame holds only the area that changed;
+// otherwise each holds the whole canvas and is disposed of with
+// gif.DisposalBackground, which clears it.  The default image is not part of
+// the animation, and is left out.
+//
+// Delays are rounded to hundredths of a second so that each frame starts at
+// the nearest hundredth to its exact start time, which keeps rounding errors
+// from accumulating over the animation.  NumPlays is mapped to LoopCount as
+// FromGIF maps it the other way.
+func ToGIF(a *Animation, opts *GIFOptions) (*gif.GIF, error) {
+	if opts == nil {
+		opts = &GIFOptions{}
+	}
+	if err := a.check(); err != nil {
+		return nil, err
+	}
+	g := &gif.GIF{
+		Config: image.Config{Width: a.Width, Height: a.Height},
+	}
+	switch a.NumPlays {
+	case 0:
+	case 1:
+		g.LoopCount = -1
+	default:
+		g.LoopCount = int(a.NumPlays - 1)
+	}
+
+	frames := make([]*image.NRGBA, 0, len(a.Frames))
+	opaque := true
+	c := a.NewCompositor()
+	for c.Next() {
+		m, o := binaryAlpha(c.Image())
+		frames = append(frames, m)
+		opaque = opaque && o
+	}
+
+	qopts := &QuantizeOptions{Dither: opts.Dither}
+	var elapsed, t big.Rat // Exact start time of the next frame, in seconds
+	for i, m := range frames {
+		var sub image.Image = m
+		disposal := byte(gif.DisposalBackground)
+		if opaque {
+			disposal = gif.DisposalNone
+			if i > 0 {
+				r := diffBounds(frames[i-1], m)
+				if r.Empty() {
+					r = image.Rect(0, 0, 1, 1)
+				}
+				sub = m.SubImage(r)
+			}
+		}
+		_, p, err := Quantize([]image.Image{sub}, qopts)
+		if err != nil {
+			return nil, err
+		}
+		g.Image = append(g.Image, p[0])
+		g.Disposal = append(g.Disposal, disposal)
+
+		f := &a.Frames[i]
+		den := int64(f.DelayDen)
+		if den == 0 {
+			den = 100
+		}
+		start := centiseconds(&elapsed)
+		elapsed.Add(&elapsed, t.SetFrac64(int64(f.DelayNum), den))
+		d := centiseconds(&elapsed) - start
+		if d > 0xffff {
+			// The most a GIF can hold.
+			d = 0xffff
+		}
+		g.Delay = append(g.Delay, int(d))
+	}
+	return g, nil
+}
+
+// binaryAlpha returns a copy of m in which pixels that are less than half
+// opaque are transparent black and the rest are opaque, and reports whether
+// every pixel is opaque.
+func binaryAlpha(m image.Image) (*image.NRGBA, bool) {
+	b := m.Bounds()
+	n := image.NewNRGBA(b)
+	opaque := true
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := nrgbaAt(m, x, y)
+			if c.A < 0x80 {
+				opaque = false
+				continue
+			}
+			c.A = 0xff
+			n.SetNRGBA(x, y, c)
+		}
+	}
+	return n, opaque
+}
+
+// centiseconds returns t seconds in hundredths of a second, rounded to the
+// nearest, with halves rounded up.
+func centiseconds(t *big.Rat) int64 {
+	n := new(big.Int).Mul(t.Num(), big.NewInt(200))
+	n.Add(n, t.Denom())
+	n.Quo(n, new(big.Int).Mul(t.Denom(), big.NewInt(2)))
+	return n.Int64()
+}
@@ -0,0 +1,259 @@
+package apng
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"testing"
+)
+
+// testGIF returns a 4x4 GIF whose frames exercise each disposal method and
+// transparency, after a round trip through image/gif.
+func testGIF(t *testing.T, loopCount int) *gif.GIF {
+	red := color.RGBA{0xff, 0, 0, 0xff}
+	green := color.RGBA{0, 0xff, 0, 0xff}
+	blue := color.RGBA{0, 0, 0xff, 0xff}
+	frame := func(r image.Rectangle, p color.Palette, pix ...uint8) *image.Paletted {
+		m := image.NewPaletted(r, p)
+		copy(m.Pix, pix)
+		return m
+	}
+	g := &gif.GIF{
+		Image: []*image.Paletted{
+			frame(image.Rect(0, 0, 4, 4), color.Palette{red, green}),
+			frame(image.Rect(1, 1, 3, 3), color.Palette{color.RGBA{}, blue}, 1, 0, 0, 0),
+			frame(image.Rect(0, 0, 2, 2), color.Palette{green}),
+			frame(image.Rect(2, 2, 4, 4), color.Palette{blue}),
+		},
+		Delay:     []int{10, 5, 0, 250},
+		Disposal:  []byte{gif.DisposalNone, gif.DisposalPrevious, gif.DisposalBackground, 0},
+		LoopCount: loopCount,
+	}
+	buf := bytes.NewBuffer(nil)
+	if err := gif.EncodeAll(buf, g); err != nil {
+		t.Fatal(err)
+	}
+	g, err := gif.DecodeAll(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return g
+}
+
+func TestFromGIF(t *testing.T) {
+	a, err := FromGIF(testGIF(t, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Width != 4 || a.Height != 4 || a.NumPlays != 0 || len(a.Frames) != 4 {
+		t.Fatalf("got %dx%d, %d plays, %d frames", a.Width, a.Height, a.NumPlays, len(a.Frames))
+	}
+	want := []Frame{
+		{DelayNum: 10, DelayDen: 100, DisposeOp: DisposeOp_None, BlendOp: BlendOp_Source},
+		{DelayNum: 5, DelayDen: 100, DisposeOp: DisposeOp_Previous, BlendOp: BlendOp_Over},
+		{DelayNum: 0, DelayDen: 100, DisposeOp: DisposeOp_Background, BlendOp: BlendOp_Source},
+		{DelayNum: 250, DelayDen: 100, DisposeOp: DisposeOp_None, BlendOp: BlendOp_Source},
+	}
+	for i, f := range a.Frames {
+		w := want[i]
+		if f.DelayNum != w.DelayNum || f.DelayDen != w.DelayDen || f.DisposeOp != w.DisposeOp || f.BlendOp != w.BlendOp {
+			t.Errorf("frame %d: got delay %d/%d, ops %d/%d, want %d/%d, %d/%d", i,
+				f.DelayNum, f.DelayDen, f.DisposeOp, f.BlendOp, w.DelayNum, w.DelayDen, w.DisposeOp, w.BlendOp)
+		}
+	}
+
+	// The APNG displays as the GIF does, once encoded with a shared palette.
+	buf := bytes.NewBuffer(nil)
+	if err := Encode(buf, a, nil); err != nil {
+		t.Fatal(err)
+	}
+	a, err = Decode(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := a.Frames[0].Image.(*image.Paletted); !ok {
+		t.Errorf("got %T, want a paletted image", a.Frames[0].Image)
+	}
+	red := color.NRGBA{0xff, 0, 0, 0xff}
+	green := color.NRGBA{0, 0xff, 0, 0xff}
+	blue := color.NRGBA{0, 0, 0xff, 0xff}
+	// The expected color at (0, 0), (1, 1) and (2, 2) after each frame.
+	colors := [][3]color.Color{
+		{red, red, red},
+		{red, blue, red},
+		{green, green, red},
+		{color.NRGBA{}, color.NRGBA{}, blue},
+	}
+	c := a.NewCompositor()
+	for c.Next() {
+		for j, p := range []image.Point{{0, 0}, {1, 1}, {2, 2}} {
+			if !sameColor(c.Image().At(p.X, p.Y), colors[c.Frame()][j], 0) {
+				t.Errorf("frame %d, %v: got %v, want %v", c.Frame(), p, c.Image().At(p.X, p.Y), colors[c.Frame()][j])
+			}
+		}
+	}
+}
+
+func TestFromGIFLoopCount(t *testing.T) {
+	for _, tc := range []struct {
+		loopCount int
+		numPlays  uint32
+	}{
+		{-1, 1},
+		{0, 0},
+		{1, 2},
+		{9, 10},
+	} {
+		a, err := FromGIF(testGIF(t, tc.loopCount))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a.NumPlays != tc.numPlays {
+			t.Errorf("LoopCount %d: got NumPlays %d, want %d", tc.loopCount, a.NumPlays, tc.numPlays)
+		}
+	}
+}
+
+func TestFromGIFPadding(t *testing.T) {
+	p := color.Palette{color.RGBA{0xff, 0, 0, 0xff}}
+	g := &gif.GIF{
+		Image:  []*image.Paletted{image.NewPaletted(image.Rect(1, 1, 2, 3), p)},
+		Delay:  []int{7},
+		Config: image.Config{Width: 3, Height: 3},
+	}
+	a, err := FromGIF(g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := a.Frames[0].Image
+	if m.Bounds() != a.Bounds() {
+		t.Fatalf("got bounds %v, want the canvas %v", m.Bounds(), a.Bounds())
+	}
+	if _, _, _, alpha := m.At(0, 0).RGBA(); alpha != 0 {
+		t.Errorf("padding has alpha %#x, want 0", alpha)
+	}
+	if !sameColor(m.At(1, 2), p[0], 0) {
+		t.Errorf("got %v, want %v", m.At(1, 2), p[0])
+	}
+	if err := Encode(bytes.NewBuffer(nil), a, nil); err != nil {
+		t.Error(err)
+	}
+	if _, err := FromGIF(&gif.GIF{}); err == nil {
+		t.Error("no error for a GIF without frames")
+	}
+}
+
+// gifAnimation returns an animation of a few colors, so that converting it to
+// a GIF loses nothing but partial transparency.
+func gifAnimation(transparent bool) *Animation {
+	a := &Animation{Width: 12, Height: 8, NumPlays: 3}
+	bg := color.NRGBA{0x20, 0x40, 0x60, 0xff}
+	if transparent {
+		bg = color.NRGBA{}
+	}
+	for i := 0; i < 4; i++ {
+		m := image.NewNRGBA(a.Bounds())
+		for y := 0; y < a.Height; y++ {
+			for x := 0; x < a.Width; x++ {
+				m.SetNRGBA(x, y, bg)
+				if x >= 2*i && x < 2*i+3 && y >= i && y < i+3 {
+					m.SetNRGBA(x, y, color.NRGBA{0xff, uint8(0x40 * i), 0, 0xc0})
+				}
+			}
+		}
+		a.Frames = append(a.Frames, Frame{Image: m, DelayNum: 1, DelayDen: 30})
+	}
+	return a
+}
+
+func TestToGIF(t *testing.T) {
+	for _, transparent := range []bool{false, true} {
+		a := gifAnimation(transparent)
+		a.Crop()
+		g, err := ToGIF(a, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := bytes.NewBuffer(nil)
+		if err := gif.EncodeAll(buf, g); err != nil {
+			t.Fatal(err)
+		}
+		if g, err = gif.DecodeAll(buf); err != nil {
+			t.Fatal(err)
+		}
+		if g.LoopCount != 2 {
+			t.Errorf("transparent %v: got LoopCount %d, want 2", transparent, g.LoopCount)
+		}
+		if got, want := g.Delay, []int{3, 4, 3, 3}; !equalInts(got, want) {
+			t.Errorf("transparent %v: got delays %v, want %v", transparent, got, want)
+		}
+		for i, m := range g.Image {
+			full := m.Bounds() == a.Bounds()
+			if transparent && (!full || g.Disposal[i] != gif.DisposalBackground) {
+				t.Errorf("frame %d: got bounds %v and disposal %d, want the canvas and background", i, m.Bounds(), g.Disposal[i])
+			}
+			if !transparent && i > 0 && full {
+				t.Errorf("frame %d: not cropped", i)
+			}
+		}
+
+		// The GIF displays as the animation does, with binary alpha.
+		b, err := FromGIF(g)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, got := a.NewCompositor(), b.NewCompositor()
+		for want.Next() && got.Next() {
+			m, _ := binaryAlpha(want.Image())
+			compareImages(t, got.Image(), m, 0)
+		}
+		if got.Frame() != len(a.Frames)-1 {
+			t.Errorf("transparent %v: got %d frames, want %d", transparent, got.Frame()+1, len(a.Frames))
+		}
+	}
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestToGIFLoopCount(t *testing.T) {
+	for numPlays, loopCount := range map[uint32]int{0: 0, 1: -1, 2: 1, 10: 9} {
+		a := gifAnimation(false)
+		a.NumPlays = numPlays
+		g, err := ToGIF(a, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if g.LoopCount != loopCount {
+			t.Errorf("NumPlays %d: got LoopCount %d, want %d", numPlays, g.LoopCount, loopCount)
+		}
+	}
+}
+
+func TestToGIFQuantize(t *testing.T) {
+	a := testAnimation(3)
+	for _, d := range []Dither{Dither_None, Dither_FloydSteinberg, Dither_Ordered} {
+		g, err := ToGIF(a, &GIFOptions{Dither: d})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, m := range g.Image {
+			if len(m.Palette) > 256 {
+				t.Errorf("dither %d, frame %d: %d colors", d, i, len(m.Palette))
+			}
+		}
+		if err := gif.EncodeAll(bytes.NewBuffer(nil), g); err != nil {
+			t.Errorf("dither %d: %v", d, err)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package apng
+
+import (
+	"bytes"
+	"image"
+	"image/draw"
+	"io"
+)
+
+// OptimizeOptions controls how Optimize re-encodes an APNG.
+type OptimizeOptions struct {
+	// Quantize, if not nil, reduces the frames to a shared palette, which
+	// loses colors if there are more than fit.
+	Quantize *QuantizeOptions
+
+	// Fast, if set, encodes once with DefaultCompression and
+	// FilterStrategy_Adaptive, rather than with every combination of
+	// DefaultCompression and BestCompression and each filter strategy.
+	Fast bool
+}
+
+// OptimizeResult is what Optimize did.
+type OptimizeResult struct {
+	InputSize  int64 // Size of the input, in bytes
+	OutputSize int64 // Size of the output, in bytes
+
+	// Unchanged is set if re-encoding did not make the APNG smaller, so the
+	// input was written as it was.  It is never set when quantizing, whose
+	// output is written even if it is larger, since it is what was asked for.
+	Unchanged bool
+
+	// The settings of the smallest re-encoding, whether or not it was used.
+	CompressionLevel CompressionLevel
+	Filter           FilterStrategy
+}
+
+// Optimize reads a PNG or APNG from r and writes it to w re-encoded to be as
+// small as it can make it, like apngopt.  It composites the frames, then
+// chooses for each frame the dispose operator of the frame before it, and the
+// region and blend operator, that give the smallest image data: the region is
+// only what differs from the canvas the frame is drawn on, and with
+// BlendOp_Over, the pixels within it that do not change are transparent, which
+// compresses well.  It then encodes the animation with the smallest lossless
+// color type, as per Analyze, or quantized as per opts, with the compression
+// level and filter strategy that give the smallest output.  Ancillary chunks
+// that Decode keeps, such as eXIf, are kept.  If the result is no smaller than
+// the input, the input is written unchanged, unless opts.Quantize is set, in
+// which case the quantized result is always written.  A nil opts is the same as
+// a zero OptimizeOptions.
+func Optimize(r io.Reader, w io.Writer, opts *OptimizeOptions) (*OptimizeResult, error) {
+	if opts == nil {
+		opts = &OptimizeOptions{}
+	}
+	in, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	a, err := Decode(bytes.NewReader(in))
+	if err != nil {
+		return nil, err
+	}
+	a.Flatten()
+	if err := a.optimizeFrames(); err != nil {
+		return nil, err
+	}
+
+	levels := []CompressionLevel{DefaultCompression, BestCompression}
+	filters := []FilterStrategy{FilterStrategy_Adaptive, FilterStrategy_None}
+	if opts.Fast {
+		levels, filters = levels[:1], filters[:1]
+	}
+	res := &OptimizeResult{InputSize: int64(len(in))}
+	var best []byte
+	for _, cl := range levels {
+		for _, f := range filters {
+			buf := bytes.NewBuffer(nil)
+			eopts := &EncodeOptions{CompressionLevel: cl, Filter: f, Quantize: opts.Quantize}
+			if err := Encode(buf, a, eopts); err != nil {
+				return nil, err
+			}
+			if best == nil || buf.Len() < len(best) {
+				best = buf.Bytes()
+				res.CompressionLevel, res.Filter = cl, f
+			}
+		}
+	}
+	if len(best) >= len(in) && opts.Quantize == nil {
+		best = in
+		res.Unchanged = true
+	}
+	res.OutputSize = int64(len(best))
+	if _, err := w.Write(best); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// optimizeFrames chooses the region, blend operator and preceding dispose
+// operator of each frame of a flattened animation, after the first, that
+// encode it in the fewest bytes.
+func (a *Animation) optimizeFrames() error {
+	if len(a.Frames) < 2 {
+		return nil
+	}
+	targets := make([]image.Image, len(a.Frames))
+	for i, f := range a.Frames {
+		targets[i] = f.Image
+	}
+	// BlendOp_Over makes pixels transparent, which costs an alpha channel if
+	// the frames do not already need some way to show transparency.
+	an := Analyze(targets...)
+	allowOver := an.IHDR.ColorType == ColorType_GrayscaleAlpha || an.IHDR.ColorType == ColorType_TrueColorAlpha ||
+		an.IHDR.Transparency != nil || an.IHDR.ColorType == ColorType_Paletted && len(an.Palette) < 256
+
+	var base image.Image = blankLike(targets[0], a.Bounds()) // What frame i-1 was drawn on
+	prevRect := a.Bounds()                                   // Region of frame i-1
+	for i := 1; i < len(targets); i++ {
+		var best struct {
+			dispose DisposeOp
+			blend   BlendOp
+			base, m image.Image
+			size    int
+		}
+		best.size = -1
+		for _, d := range []DisposeOp{DisposeOp_None, DisposeOp_Background, DisposeOp_Previous} {
+			// The canvas frame i is drawn on, after disposing of frame
+			// i-1.
+			var b image.Image
+			switch d {
+			case DisposeOp_None:
+				b = targets[i-1]
+			case DisposeOp_Background:
+				c := cloneImage(targets[i-1]).(draw.Image)
+				draw.Draw(c, prevRect, image.Transparent, image.Point{}, draw.Src)
+				b = c
+			case DisposeOp_Previous:
+				if i == 1 {
+					// This is DisposeOp_Background on the first frame.
+					continue
+				}
+				b = base
+			}
+			r := diffBounds(b, targets[i])
+			if r.Empty() {
+				r = image.Rect(0, 0, 1, 1)
+			}
+			for _, blend := range []BlendOp{BlendOp_Source, BlendOp_Over} {
+				var m image.Image
+				switch {
+				case blend == BlendOp_Source:
+					m = subImage(targets[i], r)
+				case !allowOver:
+					continue
+				default:
+					if m = overImage(b, targets[i], r); m == nil {
+						continue
+					}
+				}
+				size, err := encodedSize(m)
+				if err != nil {
+					return err
+				}
+				if best.size < 0 || size < best.size {
+					best.dispose, best.blend, best.base, best.m, best.size = d, blend, b, m, size
+				}
+			}
+		}
+		a.Frames[i-1].DisposeOp = best.dispose
+		a.Frames[i].Image, a.Frames[i].BlendOp = best.m, best.blend
+		base, prevRect = best.base, best.m.Bounds()
+	}
+	return nil
+}
+
+// blankLike returns a fully transparent image with bounds r, of the same type
+// as m, which is a compositor's canvas.
+func blankLike(m image.Image, r image.Rectangle) draw.Image {
+	if _, ok := m.(*image.NRGBA64); ok {
+		return image.NewNRGBA64(r)
+	}
+	return image.NewNRGBA(r)
+}
+
+// overImage returns the image that, drawn with BlendOp_Over on b, gives t
+// within r: t where it differs from b, and transparent elsewhere.  It returns
+// nil if there is no such image, because t has a translucent pixel where b is
+// not fully transparent.
+func overImage(b, t image.Image, r image.Rectangle) image.Image {
+	m := blankLike(t, r)
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			tc := paletteKey(t.At(x, y))
+			bc := paletteKey(b.At(x, y))
+			switch {
+			case tc == bc:
+			case tc.A == 0xffff || bc.A == 0:
+				m.Set(x, y, tc)
+			default:
+				return nil
+			}
+		}
+	}
+	return m
+}
+
+// encodedSize estimates the size of m's image data, by encoding it quickly
+// with the smallest lossless color type for m alone.
+func encodedSize(m image.Image) (int, error) {
+	an := Analyze(m)
+	m, err := an.Convert(m)
+	if err != nil {
+		return 0, err
+	}
+	w := &countWriter{}
+	cw := &chunkWriter{w: w}
+	cw.encode(an.IHDR.NewEncoder_IDAT(m, BestSpeed))
+	return w.n, cw.err
+}
+
+// countWriter counts the bytes written to it.
+type countWriter struct {
+	n int
+}
+
+func (w *countWriter) Write(b []byte) (int, error) {
+	w.n += len(b)
+	return len(b), nil
+}
@@ -0,0 +1,122 @@
+package apng
+
+import (
+	"bytes"
+	"image"
+	"testing"
+)
+
+func TestOptimize(t *testing.T) {
+	exif := []byte("MM\x00\x2a\x00\x00\x00\x08\x00\x00")
+	for _, tc := range []struct {
+		name string
+		a    *Animation
+		opts *OptimizeOptions
+	}{
+		{"Opaque", testAnimation(6), nil},
+		{"Transparent", editAnimation(), nil},
+		{"Fast", testAnimation(4), &OptimizeOptions{Fast: true}},
+		{"Quantize", testAnimation(4), &OptimizeOptions{Quantize: &QuantizeOptions{NumColors: 32}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			a := tc.a
+			a.Chunks = []*RawChunk{{Type: [4]byte{'e', 'X', 'I', 'f'}, Data: exif}}
+			a.Frames[1].Chunks = []*RawChunk{{Type: [4]byte{'p', 'r', 'V', 't'}, Data: []byte("frame 1")}}
+			want := renders(a)
+			in := bytes.NewBuffer(nil)
+			// Every frame is whole, as it is displayed.
+			b := &Animation{Width: a.Width, Height: a.Height, NumPlays: a.NumPlays, Chunks: a.Chunks}
+			for i, f := range a.Frames {
+				f.Image, f.DisposeOp, f.BlendOp = want[i], DisposeOp_None, BlendOp_Source
+				b.Frames = append(b.Frames, f)
+			}
+			if err := Encode(in, b, &EncodeOptions{CompressionLevel: BestSpeed}); err != nil {
+				t.Fatal(err)
+			}
+			inLen := in.Len()
+
+			out := bytes.NewBuffer(nil)
+			res, err := Optimize(in, out, tc.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.InputSize != int64(inLen) || res.OutputSize != int64(out.Len()) {
+				t.Errorf("got sizes %d -> %d, want %d -> %d", res.InputSize, res.OutputSize, inLen, out.Len())
+			}
+			if res.Unchanged || res.OutputSize >= res.InputSize {
+				t.Errorf("not smaller: %d -> %d bytes", res.InputSize, res.OutputSize)
+			}
+			for _, p := range Validate(bytes.NewReader(out.Bytes())) {
+				if p.Severity == Severity_Error {
+					t.Error(p)
+				}
+			}
+
+			got, err := Decode(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.NumPlays != a.NumPlays || len(got.Chunks) != 1 || !bytes.Equal(got.Chunks[0].Data, exif) {
+				t.Errorf("got %d plays and chunks %v", got.NumPlays, got.Chunks)
+			}
+			if c := got.Frames[1].Chunks; len(c) != 1 || string(c[0].Data) != "frame 1" {
+				t.Errorf("got frame 1 chunks %v", c)
+			}
+			lossy := tc.opts != nil && tc.opts.Quantize != nil
+			if _, ok := got.Frames[0].Image.(*image.Paletted); lossy && !ok {
+				t.Errorf("got %T, want a paletted image", got.Frames[0].Image)
+			}
+			for i, m := range renders(got) {
+				if !lossy {
+					compareImages(t, m, want[i], 0)
+				}
+				if f := got.Frames[i]; f.DelayNum != a.Frames[i].DelayNum || f.DelayDen != a.Frames[i].DelayDen {
+					t.Errorf("frame %d: got delay %d/%d", i, f.DelayNum, f.DelayDen)
+				}
+			}
+		})
+	}
+}
+
+func TestOptimizeUnchanged(t *testing.T) {
+	a := editAnimation()
+	in := bytes.NewBuffer(nil)
+	if err := Encode(in, a, nil); err != nil {
+		t.Fatal(err)
+	}
+	once := bytes.NewBuffer(nil)
+	if _, err := Optimize(in, once, nil); err != nil {
+		t.Fatal(err)
+	}
+	// Optimizing again gains nothing, so the input is kept.
+	twice := bytes.NewBuffer(nil)
+	res, err := Optimize(bytes.NewReader(once.Bytes()), twice, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Unchanged || res.OutputSize != res.InputSize {
+		t.Errorf("got %+v, want the input unchanged", res)
+	}
+	if !bytes.Equal(twice.Bytes(), once.Bytes()) {
+		t.Errorf("wrote %d bytes, not the %d bytes of input", twice.Len(), once.Len())
+	}
+}
+
+func TestOptimizeFrames(t *testing.T) {
+	// A square moves over a still background: the best frames hold just the
+	// square's old and new positions.
+	a := testAnimation(4)
+	if err := a.optimizeFrames(); err != nil {
+		t.Fatal(err)
+	}
+	for i, f := range a.Frames[1:] {
+		if r := f.Image.Bounds(); r.Dx() > 16 || r.Dy() > 16 {
+			t.Errorf("frame %d: got bounds %v", i+1, r)
+		}
+	}
+	c := a.NewCompositor()
+	full := testAnimation(4)
+	for c.Next() {
+		compareImages(t, c.Image(), full.Frames[c.Frame()].Image, 0)
+	}
+}
@@ -0,0 +1,114 @@
+package apng
+
+import (
+	"errors"
+	"image"
+	"image/color"
+)
+
+// ErrTooManyColors is returned when frames use more colors than fit in a
+// palette.
+var ErrTooManyColors = errors.New("apng: more than 256 colors")
+
+// ErrColorNotInPalette is returned by GlobalPalette.Remap when an image uses a
+// color that the palette does not have.
+var ErrColorNotInPalette = errors.New("apng: color not in palette")
+
+// GlobalPalette is a palette shared by every frame of a paletted APNG.
+type GlobalPalette struct {
+	Palette color.Palette
+	PLTE    *Chunk_PLTE // Write this after IHDR
+	TRNS    *Chunk_tRNS // Write this after PLTE; nil if every color is opaque
+
+	index map[color.NRGBA64]uint8
+}
+
+// NewGlobalPalette builds the palette of every color used by the frames, or
+// returns ErrTooManyColors if there are more than 256 of them.  All fully
+// transparent colors share one entry.  Colors that are not fully opaque come
+// first, so that TRNS only needs to cover them.
+func NewGlobalPalette(frames ...image.Image) (*GlobalPalette, error) {
+	s := newFrameStats()
+	for _, m := range frames {
+		s.scan(m)
+	}
+	if len(s.palette) > 256 {
+		return nil, ErrTooManyColors
+	}
+	return newGlobalPalette(s.palette), nil
+}
+
+func newGlobalPalette(p color.Palette) *GlobalPalette {
+	// Stable partition of the colors into translucent, then opaque.
+	sorted := make(color.Palette, 0, len(p))
+	for _, c := range p {
+		if _, _, _, a := c.RGBA(); a != 0xffff {
+			sorted = append(sorted, c)
+		}
+	}
+	opaque := len(sorted) == 0
+	for _, c := range p {
+		if _, _, _, a := c.RGBA(); a == 0xffff {
+			sorted = append(sorted, c)
+		}
+	}
+
+	g := &GlobalPalette{
+		Palette: sorted,
+		PLTE:    NewChunk_PLTE(sorted),
+		index:   make(map[color.NRGBA64]uint8, len(sorted)),
+	}
+	if !opaque {
+		g.TRNS = NewChunk_tRNS(sorted)
+	}
+	for i, c := range sorted {
+		g.index[paletteKey(c)] = uint8(i)
+	}
+	return g
+}
+
+// Remap converts m to an *image.Paletted using the global palette.  It returns
+// ErrColorNotInPalette if m uses a color that is not in the palette, for
+// instance because m was not one of the frames the palette was built from.
+func (g *GlobalPalette) Remap(m image.Image) (*image.Paletted, error) {
+	return g.remap(m, paletteKey)
+}
+
+// remap is Remap, looking up each color of m by key(c) in the palette, whose
+// entries are looked up by paletteKey.
+func (g *GlobalPalette) remap(m image.Image, key func(color.Color) color.NRGBA64) (*image.Paletted, error) {
+	b := m.Bounds()
+	p := image.NewPaletted(b, g.Palette)
+	if src, ok := m.(*image.Paletted); ok {
+		// Translate each source palette entry once.
+		var table [256]uint8
+		var known [256]bool
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			i, j := p.PixOffset(b.Min.X, y), src.PixOffset(b.Min.X, y)
+			for _, ci := range src.Pix[j : j+b.Dx()] {
+				if !known[ci] {
+					di, ok := g.index[key(src.Palette[ci])]
+					if !ok {
+						return nil, ErrColorNotInPalette
+					}
+					table[ci], known[ci] = di, true
+				}
+				p.Pix[i] = table[ci]
+				i++
+			}
+		}
+		return p, nil
+	}
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		i := p.PixOffset(b.Min.X, y)
+		for x := b.Min.X; x < b.Max.X; x++ {
+			di, ok := g.index[key(m.At(x, y))]
+			if !ok {
+				return nil, ErrColorNotInPalette
+			}
+			p.Pix[i] = di
+			i++
+		}
+	}
+	return p, nil
+}
@@ -0,0 +1,85 @@
+package apng
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestNewChunk_tRNS(t *testing.T) {
+	red := color.NRGBA{0xff, 0, 0, 0xff}
+	for _, tc := range []struct {
+		name string
+		p    color.Palette
+		want []byte
+	}{
+		{"Trailing", color.Palette{color.NRGBA{1, 2, 3, 0x40}, color.Transparent, red, red}, []byte{0x40, 0}},
+		{"Middle", color.Palette{red, color.Transparent, red}, []byte{0xff, 0}},
+		{"Opaque", color.Palette{red, red}, []byte{0xff}},
+		{"Empty", color.Palette{}, []byte{}},
+	} {
+		if got := NewChunk_tRNS(tc.p).Bytes(); !bytes.Equal(got, tc.want) {
+			t.Errorf("%s: got %x, want %x", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestNewGlobalPaletteTooManyColors(t *testing.T) {
+	m := image.NewNRGBA(image.Rect(0, 0, 16, 16))
+	for i := 0; i < len(m.Pix); i += 4 {
+		m.Pix[i], m.Pix[i+3] = uint8(i/4), 0xff
+	}
+	if _, err := NewGlobalPalette(m); err != nil {
+		t.Fatalf("256 colors: %v", err)
+	}
+	m2 := image.NewNRGBA(image.Rect(0, 0, 1, 1))
+	m2.SetNRGBA(0, 0, color.NRGBA{0, 1, 0, 0xff})
+	if _, err := NewGlobalPalette(m, m2); err != ErrTooManyColors {
+		t.Errorf("257 colors: got %v, want ErrTooManyColors", err)
+	}
+}
+
+func TestRemap(t *testing.T) {
+	r := image.Rect(0, 0, 2, 1)
+	m := image.NewNRGBA(r)
+	m.SetNRGBA(0, 0, color.NRGBA{0xff, 0, 0, 0xff})
+	m.SetNRGBA(1, 0, color.NRGBA{0, 0, 0xff, 0x80})
+	g, err := NewGlobalPalette(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := g.Remap(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for x := 0; x < 2; x++ {
+		if got, want := color.NRGBAModel.Convert(p.At(x, 0)), m.NRGBAAt(x, 0); got != want {
+			t.Errorf("pixel %d: got %v, want %v", x, got, want)
+		}
+	}
+
+	other := image.NewNRGBA(r)
+	other.SetNRGBA(1, 0, color.NRGBA{0, 0xff, 0, 0xff})
+	if _, err := g.Remap(other); err != ErrColorNotInPalette {
+		t.Errorf("color not in the palette: got %v, want ErrColorNotInPalette", err)
+	}
+	otherPaletted := image.NewPaletted(r, color.Palette{color.NRGBA{0, 0xff, 0, 0xff}})
+	if _, err := g.Remap(otherPaletted); err != ErrColorNotInPalette {
+		t.Errorf("paletted color not in the palette: got %v, want ErrColorNotInPalette", err)
+	}
+}
+
+// TestEncoderPalettedUnsupported checks that the paletted encoder refuses an
+// image without a palette, which must be remapped first.
+func TestEncoderPalettedUnsupported(t *testing.T) {
+	m := image.NewNRGBA(image.Rect(0, 0, 2, 2))
+	ihdr := &Chunk_IHDR{Width: 2, Height: 2, BitDepth: BitDepth_8, ColorType: ColorType_Paletted}
+	e := ihdr.NewEncoder_IDAT(m, DefaultCompression)
+	if e.Next() {
+		t.Fatal("got a chunk")
+	}
+	if _, ok := e.Err().(UnsupportedError); !ok {
+		t.Errorf("got %v, want an UnsupportedError", e.Err())
+	}
+}
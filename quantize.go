@@ -0,0 +1,387 @@
+package apng
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"sort"
+)
+
+// Dither is the dithering method used when quantizing to a palette.
+type Dither int
+
+const (
+	Dither_None           = Dither(0) // Each pixel takes the nearest palette color
+	Dither_FloydSteinberg = Dither(1) // Error diffusion, as per image/draw
+	Dither_Ordered        = Dither(2) // 8x8 Bayer matrix
+)
+
+// dithers maps dithering methods to the names the commands use.
+var dithers = map[Dither]string{
+	Dither_None:           "none",
+	Dither_FloydSteinberg: "floyd-steinberg",
+	Dither_Ordered:        "ordered",
+}
+
+// ParseDither returns the dithering method with the given name: "none",
+// "floyd-steinberg" or "ordered".
+func ParseDither(s string) (Dither, error) {
+	for d, name := range dithers {
+		if name == s {
+			return d, nil
+		}
+	}
+	return 0, UnsupportedError("dithering " + s)
+}
+
+// String returns the name of the dithering method.
+func (d Dither) String() string {
+	if name, ok := dithers[d]; ok {
+		return name
+	}
+	return fmt.Sprintf("Dither(%d)", int(d))
+}
+
+// QuantizeOptions controls how Quantize reduces frames to a palette.
+type QuantizeOptions struct {
+	NumColors int    // Number of palette colors, from 2 to 256; 0 means 256
+	Dither    Dither // Dithering method
+
+	// Tolerance is the largest difference in any channel between a pixel and
+	// the color its palette index was chosen for, at the same position in an
+	// earlier frame, for which the pixel keeps the previous frame's index.
+	// This stops dithering patterns shimmering in areas that do not change.
+	// Pixels that do not change at all always keep their index.
+	Tolerance uint8
+}
+
+// Quantize reduces the frames to a shared palette of at most opts.NumColors
+// colors, using median cut over the colors of all frames, including alpha.
+// If the frames already use few enough colors, the palette is exact and no
+// dithering is done.  The returned frames use the palette and can be passed
+// straight to NewEncoder_IDAT and NewEncoder_fdAT with a paletted IHDR.
+// Colors are reduced to 8 bits per channel first, as a PLTE holds them.
+func Quantize(frames []image.Image, opts *QuantizeOptions) (*GlobalPalette, []*image.Paletted, error) {
+	if opts == nil {
+		opts = &QuantizeOptions{}
+	}
+	n := opts.NumColors
+	if n <= 0 || n > 256 {
+		n = 256
+	}
+	if n < 2 {
+		n = 2
+	}
+
+	h := histogram{}
+	for _, m := range frames {
+		h.add(m)
+	}
+	if len(h) <= n {
+		p := make(color.Palette, 0, len(h))
+		for c := range h {
+			p = append(p, c)
+		}
+		// Map iteration order is random; keep the output deterministic.
+		sort.Slice(p, func(i, j int) bool { return lessNRGBA(p[i].(color.NRGBA), p[j].(color.NRGBA)) })
+		g := newGlobalPalette(p)
+		out := make([]*image.Paletted, len(frames))
+		for i, m := range frames {
+			// Look colors up as the histogram counted them.
+			var err error
+			out[i], err = g.remap(m, func(c color.Color) color.NRGBA64 {
+				return paletteKey(color.NRGBAModel.Convert(c))
+			})
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		return g, out, nil
+	}
+
+	g := newGlobalPalette(h.medianCut(n))
+	q := &quantizer{g: g, opts: opts, cache: map[color.NRGBA]uint8{}}
+	out := make([]*image.Paletted, len(frames))
+	var ref *image.NRGBA
+	for i, m := range frames {
+		out[i] = q.dither(m)
+		var prev *image.Paletted
+		if i > 0 {
+			prev = out[i-1]
+		}
+		ref = q.stabilize(out[i], m, prev, ref)
+	}
+	return g, out, nil
+}
+
+// histogram counts the non-alpha-premultiplied colors of the frames.  All
+// fully transparent colors are counted as transparent black.
+type histogram map[color.NRGBA]int
+
+func (h histogram) add(m image.Image) {
+	b := m.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			h[nrgbaAt(m, x, y)]++
+		}
+	}
+}
+
+func nrgbaAt(m image.Image, x, y int) color.NRGBA {
+	var c color.NRGBA
+	if nrgba, ok := m.(*image.NRGBA); ok {
+		c = nrgba.NRGBAAt(x, y)
+	} else {
+		c = color.NRGBAModel.Convert(m.At(x, y)).(color.NRGBA)
+	}
+	if c.A == 0 {
+		return color.NRGBA{}
+	}
+	return c
+}
+
+func lessNRGBA(a, b color.NRGBA) bool {
+	if a.A != b.A {
+		return a.A < b.A
+	}
+	if a.R != b.R {
+		return a.R < b.R
+	}
+	if a.G != b.G {
+		return a.G < b.G
+	}
+	return a.B < b.B
+}
+
+// A cutColor is a histogram entry in alpha-premultiplied form, so that colors
+// which are nearly transparent count as close together.
+type cutColor struct {
+	c [4]int // R, G, B, A
+	n int
+}
+
+// A cutBox is a set of colors that median cut may split further.
+type cutBox []cutColor
+
+// widest returns the channel with the largest range of values, and that range.
+func (b cutBox) widest() (int, int) {
+	best, bestRange := 0, -1
+	for ch := 0; ch < 4; ch++ {
+		lo, hi := b[0].c[ch], b[0].c[ch]
+		for _, cc := range b[1:] {
+			if cc.c[ch] < lo {
+				lo = cc.c[ch]
+			}
+			if cc.c[ch] > hi {
+				hi = cc.c[ch]
+			}
+		}
+		if hi-lo > bestRange {
+			best, bestRange = ch, hi-lo
+		}
+	}
+	return best, bestRange
+}
+
+func (b cutBox) count() int {
+	n := 0
+	for _, cc := range b {
+		n += cc.n
+	}
+	return n
+}
+
+// mean returns the pixel-weighted average color of the box.
+func (b cutBox) mean() color.NRGBA {
+	var sum [4]int
+	n := b.count()
+	for _, cc := range b {
+		for ch := range sum {
+			sum[ch] += cc.c[ch] * cc.n
+		}
+	}
+	c := color.RGBA{
+		R: uint8((sum[0] + n/2) / n),
+		G: uint8((sum[1] + n/2) / n),
+		B: uint8((sum[2] + n/2) / n),
+		A: uint8((sum[3] + n/2) / n),
+	}
+	return color.NRGBAModel.Convert(c).(color.NRGBA)
+}
+
+// medianCut picks n colors representing the histogram.  Fully transparent
+// pixels always get an exact palette entry of their own.
+func (h histogram) medianCut(n int) color.Palette {
+	var p color.Palette
+	var all cutBox
+	for c, count := range h {
+		if c.A == 0 {
+			p = append(p, c)
+			continue
+		}
+		pc := color.RGBAModel.Convert(c).(color.RGBA)
+		all = append(all, cutColor{c: [4]int{int(pc.R), int(pc.G), int(pc.B), int(pc.A)}, n: count})
+	}
+	// Map iteration order is random; keep the output deterministic.
+	sort.Slice(all, func(i, j int) bool {
+		for ch := 0; ch < 4; ch++ {
+			if all[i].c[ch] != all[j].c[ch] {
+				return all[i].c[ch] < all[j].c[ch]
+			}
+		}
+		return false
+	})
+
+	boxes := []cutBox{all}
+	for len(boxes) < n-len(p) {
+		// Split the box with the largest spread, weighted by its pixel count.
+		bi, bestScore, bestCh := -1, 0, 0
+		for i, b := range boxes {
+			if len(b) < 2 {
+				continue
+			}
+			ch, r := b.widest()
+			if score := r * b.count(); score > bestScore {
+				bi, bestScore, bestCh = i, score, ch
+			}
+		}
+		if bi < 0 {
+			break
+		}
+		b := boxes[bi]
+		sort.SliceStable(b, func(i, j int) bool { return b[i].c[bestCh] < b[j].c[bestCh] })
+		// Split at the weighted median, keeping both halves non-empty.
+		half, acc, k := b.count()/2, 0, 1
+		for ; k < len(b)-1; k++ {
+			acc += b[k-1].n
+			if acc >= half {
+				break
+			}
+		}
+		boxes[bi] = b[:k]
+		boxes = append(boxes, b[k:])
+	}
+
+	seen := map[color.NRGBA]bool{}
+	for _, b := range boxes {
+		c := b.mean()
+		if !seen[c] {
+			seen[c] = true
+			p = append(p, c)
+		}
+	}
+	return p
+}
+
+// quantizer maps frames onto a palette that may not hold all their colors.
+type quantizer struct {
+	g     *GlobalPalette
+	opts  *QuantizeOptions
+	cache map[color.NRGBA]uint8
+}
+
+// index returns the palette index nearest to c.
+func (q *quantizer) index(c color.NRGBA) uint8 {
+	if c.A == 0 {
+		c = color.NRGBA{}
+	}
+	i, ok := q.cache[c]
+	if !ok {
+		i = uint8(q.g.Palette.Index(c))
+		q.cache[c] = i
+	}
+	return i
+}
+
+// bayer8 is the 8x8 Bayer threshold matrix.
+var bayer8 = [8][8]int{
+	{0, 32, 8, 40, 2, 34, 10, 42},
+	{48, 16, 56, 24, 50, 18, 58, 26},
+	{12, 44, 4, 36, 14, 46, 6, 38},
+	{60, 28, 52, 20, 62, 30, 54, 22},
+	{3, 35, 11, 43, 1, 33, 9, 41},
+	{51, 19, 59, 27, 49, 17, 57, 25},
+	{15, 47, 7, 39, 13, 45, 5, 37},
+	{63, 31, 55, 23, 61, 29, 53, 21},
+}
+
+func (q *quantizer) dither(m image.Image) *image.Paletted {
+	b := m.Bounds()
+	p := image.NewPaletted(b, q.g.Palette)
+	switch q.opts.Dither {
+	case Dither_FloydSteinberg:
+		draw.FloydSteinberg.Draw(p, b, m, b.Min)
+	case Dither_Ordered:
+		// Spread thresholds over roughly the distance between palette colors
+		// along one channel.
+		levels := 1
+		for (levels+1)*(levels+1)*(levels+1) <= len(q.g.Palette) {
+			levels++
+		}
+		spread := 256 / levels
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			i := p.PixOffset(b.Min.X, y)
+			for x := b.Min.X; x < b.Max.X; x++ {
+				c := nrgbaAt(m, x, y)
+				d := (bayer8[y&7][x&7]*2 - 63) * spread / 128
+				c.R, c.G, c.B = clamp8(int(c.R)+d), clamp8(int(c.G)+d), clamp8(int(c.B)+d)
+				if c.A != 0 && c.A != 0xff {
+					c.A = clamp8(int(c.A) + d)
+				}
+				p.Pix[i] = q.index(c)
+				i++
+			}
+		}
+	default:
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			i := p.PixOffset(b.Min.X, y)
+			for x := b.Min.X; x < b.Max.X; x++ {
+				p.Pix[i] = q.index(nrgbaAt(m, x, y))
+				i++
+			}
+		}
+	}
+	return p
+}
+
+// stabilize copies palette indices from the previous frame, prevP, wherever
+// the source pixel is within the tolerance of ref, the color that the previous
+// frame's index was chosen for.  Comparing against ref rather than the
+// previous frame's pixel stops a gradual change from keeping an index forever.
+// It returns the colors that p's indices were chosen for, to be the next ref.
+// prevP and ref are nil for the first frame.
+func (q *quantizer) stabilize(p *image.Paletted, m image.Image, prevP *image.Paletted, ref *image.NRGBA) *image.NRGBA {
+	b := p.Bounds()
+	next := image.NewNRGBA(b)
+	var keep image.Rectangle
+	if prevP != nil {
+		keep = b.Intersect(prevP.Bounds())
+	}
+	t := int(q.opts.Tolerance)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := nrgbaAt(m, x, y)
+			if (image.Point{x, y}).In(keep) {
+				c0 := ref.NRGBAAt(x, y)
+				if abs(int(c0.R)-int(c.R)) <= t && abs(int(c0.G)-int(c.G)) <= t &&
+					abs(int(c0.B)-int(c.B)) <= t && abs(int(c0.A)-int(c.A)) <= t {
+					p.Pix[p.PixOffset(x, y)] = prevP.Pix[prevP.PixOffset(x, y)]
+					c = c0
+				}
+			}
+			next.SetNRGBA(x, y, c)
+		}
+	}
+	return next
+}
+
+func clamp8(v int) uint8 {
+	if v < 0 {
+		return 0
+	}
+	if v > 0xff {
+		return 0xff
+	}
+	return uint8(v)
+}
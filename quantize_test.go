@@ -0,0 +1,236 @@
+package apng
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"testing"
+)
+
+// gradient returns a w x h image whose gray level rises from left to right,
+// plus d, with a translucent band along the top row.
+func gradient(w, h, d int) *image.NRGBA {
+	m := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			v := clamp8(x*255/(w-1) + d)
+			c := color.NRGBA{v, v, v, 0xff}
+			if y == 0 {
+				c.A = 0x80
+			}
+			m.SetNRGBA(x, y, c)
+		}
+	}
+	return m
+}
+
+func TestQuantizePaletteSize(t *testing.T) {
+	frames := []image.Image{gradient(64, 4, 0), gradient(64, 4, 40)}
+	for _, n := range []int{2, 3, 16, 0} {
+		for _, d := range []Dither{Dither_None, Dither_FloydSteinberg, Dither_Ordered} {
+			g, out, err := Quantize(frames, &QuantizeOptions{NumColors: n, Dither: d})
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := n
+			if n == 0 {
+				want = 256
+			}
+			if len(g.Palette) > want {
+				t.Errorf("NumColors %d, Dither %d: %d colors", n, d, len(g.Palette))
+			}
+			if len(out) != len(frames) {
+				t.Fatalf("NumColors %d, Dither %d: %d frames", n, d, len(out))
+			}
+			for i, p := range out {
+				if p.Bounds() != frames[i].Bounds() {
+					t.Errorf("NumColors %d, Dither %d, frame %d: bounds %v", n, d, i, p.Bounds())
+				}
+				for _, ci := range p.Pix {
+					if int(ci) >= len(g.Palette) {
+						t.Fatalf("NumColors %d, Dither %d, frame %d: index %d", n, d, i, ci)
+					}
+				}
+			}
+		}
+	}
+}
+
+// TestQuantizeExact checks that frames with few enough colors come back
+// exactly, whatever the dithering.
+func TestQuantizeExact(t *testing.T) {
+	colors := []color.NRGBA{
+		{0xff, 0, 0, 0xff},
+		{0, 0xff, 0, 0x80},
+		{0x12, 0x34, 0x56, 0x78},
+		{},
+	}
+	m := image.NewNRGBA(image.Rect(0, 0, 8, 8))
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			m.SetNRGBA(x, y, colors[(x+y*3)%len(colors)])
+		}
+	}
+	for _, d := range []Dither{Dither_None, Dither_FloydSteinberg, Dither_Ordered} {
+		g, out, err := Quantize([]image.Image{m}, &QuantizeOptions{NumColors: 4, Dither: d})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(g.Palette) != 4 {
+			t.Errorf("Dither %d: %d colors, want 4", d, len(g.Palette))
+		}
+		for y := 0; y < 8; y++ {
+			for x := 0; x < 8; x++ {
+				if got, want := color.NRGBAModel.Convert(out[0].At(x, y)), m.NRGBAAt(x, y); got != want {
+					t.Fatalf("Dither %d, pixel (%d, %d): got %v, want %v", d, x, y, got, want)
+				}
+			}
+		}
+	}
+}
+
+func TestQuantizeDither(t *testing.T) {
+	frames := []image.Image{gradient(64, 8, 0)}
+	_, none, err := Quantize(frames, &QuantizeOptions{NumColors: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range []Dither{Dither_FloydSteinberg, Dither_Ordered} {
+		_, out, err := Quantize(frames, &QuantizeOptions{NumColors: 4, Dither: d})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Equal(out[0].Pix, none[0].Pix) {
+			t.Errorf("Dither %d: same as Dither_None", d)
+		}
+	}
+}
+
+// TestQuantizeTolerance checks that pixels which change by at most the
+// tolerance keep the previous frame's palette index, and others do not.
+func TestQuantizeTolerance(t *testing.T) {
+	const w, h = 64, 4
+	prev := gradient(w, h, 0)
+	m := gradient(w, h, 0)
+	// Nudge the left half slightly, and invert the right half.
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := m.NRGBAAt(x, y)
+			if x < w/2 {
+				c.R, c.G, c.B = clamp8(int(c.R)+3), clamp8(int(c.G)+3), clamp8(int(c.B)+3)
+			} else {
+				c.R, c.G, c.B = 0xff-c.R, 0xff-c.G, 0xff-c.B
+			}
+			m.SetNRGBA(x, y, c)
+		}
+	}
+	frames := []image.Image{prev, m}
+
+	_, loose, err := Quantize(frames, &QuantizeOptions{NumColors: 4, Tolerance: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, strict, err := Quantize(frames, &QuantizeOptions{NumColors: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	small, large := 0, 0
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			i := loose[1].PixOffset(x, y)
+			before := loose[0].Pix[i]
+			switch {
+			case x < w/2:
+				if loose[1].Pix[i] != before {
+					t.Errorf("nudged pixel (%d, %d): index %d, want the previous %d", x, y, loose[1].Pix[i], before)
+				}
+				if strict[1].Pix[i] != before {
+					small++
+				}
+			default:
+				if loose[1].Pix[i] != strict[1].Pix[i] {
+					t.Errorf("inverted pixel (%d, %d): index %d, want %d as without a tolerance", x, y, loose[1].Pix[i], strict[1].Pix[i])
+				}
+				if loose[1].Pix[i] != before {
+					large++
+				}
+			}
+		}
+	}
+	// Otherwise the test shows nothing.
+	if small == 0 || large == 0 {
+		t.Errorf("%d nudged and %d inverted pixels changed index without a tolerance, want some of each", small, large)
+	}
+}
+
+// TestQuantizeDrift checks that a pixel which changes a little in every frame
+// keeps its index only until it has drifted beyond the tolerance from the
+// color that index was chosen for.
+func TestQuantizeDrift(t *testing.T) {
+	var frames []image.Image
+	for i := 0; i < 50; i++ {
+		m := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+		for j := 0; j < len(m.Pix); j += 4 {
+			m.Pix[j+2], m.Pix[j+3] = uint8(5*i), 0xff
+		}
+		frames = append(frames, m)
+	}
+	g, out, err := Quantize(frames, &QuantizeOptions{NumColors: 16, Tolerance: 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, p := range out {
+		want := frames[i].(*image.NRGBA).NRGBAAt(0, 0)
+		got := g.Palette[p.Pix[0]].(color.NRGBA)
+		// Within the tolerance, plus half the spacing of the palette colors.
+		if d := abs(int(got.B) - int(want.B)); d > 8+16 {
+			t.Errorf("frame %d: got %v for %v", i, got, want)
+		}
+	}
+}
+
+// TestQuantizeDeep checks that frames with more than 8 bits per channel are
+// quantized with their 8 bit colors, as the palette holds them, and can be
+// encoded.
+func TestQuantizeDeep(t *testing.T) {
+	r := image.Rect(0, 0, 8, 8)
+	gray := image.NewGray16(r)
+	rgba := image.NewRGBA64(r)
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			v := uint16(0x1234 * (x % 3))
+			gray.SetGray16(x, y, color.Gray16{v})
+			rgba.SetRGBA64(x, y, color.RGBA64{v, 0x5678, uint16(0x3456 * (y % 2)), 0xffff})
+		}
+	}
+	for _, m := range []image.Image{gray, rgba} {
+		_, out, err := Quantize([]image.Image{m}, &QuantizeOptions{NumColors: 16})
+		if err != nil {
+			t.Fatalf("%T: %v", m, err)
+		}
+		for y := 0; y < 8; y++ {
+			for x := 0; x < 8; x++ {
+				if got, want := color.NRGBAModel.Convert(out[0].At(x, y)), color.NRGBAModel.Convert(m.At(x, y)); got != want {
+					t.Fatalf("%T, pixel (%d, %d): got %v, want %v", m, x, y, got, want)
+				}
+			}
+		}
+
+		buf := bytes.NewBuffer(nil)
+		a := &Animation{Width: 8, Height: 8, Frames: []Frame{{Image: m}}}
+		if err := Encode(buf, a, &EncodeOptions{Quantize: &QuantizeOptions{NumColors: 16}}); err != nil {
+			t.Errorf("%T: %v", m, err)
+		}
+	}
+}
+
+func TestParseDither(t *testing.T) {
+	for _, d := range []Dither{Dither_None, Dither_FloydSteinberg, Dither_Ordered} {
+		if got, err := ParseDither(d.String()); got != d || err != nil {
+			t.Errorf("ParseDither(%q) = %v, %v", d.String(), got, err)
+		}
+	}
+	if _, err := ParseDither("atkinson"); err == nil {
+		t.Error("no error for an unknown dithering method")
+	}
+}
@@ -0,0 +1,67 @@
+package apng
+
+import (
+	"io"
+	"strconv"
+)
+
+// maxChunkLength is the largest data length allowed in a chunk, as per the PNG
+// spec.
+const maxChunkLength = 1<<31 - 1
+
+// RawChunk is a chunk of any type, written verbatim with the correct length
+// and CRC.  Use this for private or otherwise unsupported chunks, such as
+// per-frame application metadata.
+type RawChunk struct {
+	Type [4]byte
+	Data []byte
+}
+
+// Ancillary reports whether the chunk is ancillary, i.e. decoders may safely
+// ignore it.  This is bit 5 of the first byte of the type.
+func (c *RawChunk) Ancillary() bool {
+	return c.Type[0]&0x20 != 0
+}
+
+// Private reports whether the chunk type is private rather than registered.
+// This is bit 5 of the second byte of the type.
+func (c *RawChunk) Private() bool {
+	return c.Type[1]&0x20 != 0
+}
+
+// SafeToCopy reports whether editors that do not recognize the chunk may copy
+// it into a modified file.  This is bit 5 of the fourth byte of the type.
+func (c *RawChunk) SafeToCopy() bool {
+	return c.Type[3]&0x20 != 0
+}
+
+// Validate checks that the chunk type consists of ASCII letters with the
+// reserved bit clear, and that the data fits in a chunk.
+func (c *RawChunk) Validate() error {
+	return checkChunk(c.Type, len(c.Data))
+}
+
+// WriteTo encodes the chunk to the io.Writer.  This supports the io.WriterTo
+// interface.
+func (c *RawChunk) WriteTo(w io.Writer) (int64, error) {
+	if err := c.Validate(); err != nil {
+		return 0, err
+	}
+	return writeChunkTo(string(c.Type[:]), c.Data, w)
+}
+
+func checkChunk(t [4]byte, n int) error {
+	for _, b := range t {
+		if !('A' <= b && b <= 'Z' || 'a' <= b && b <= 'z') {
+			return FormatError("chunk type " + strconv.Quote(string(t[:])) + " is not four ASCII letters")
+		}
+	}
+	// The third letter must be uppercase in this version of the PNG spec.
+	if t[2]&0x20 != 0 {
+		return FormatError("chunk type " + strconv.Quote(string(t[:])) + " has the reserved bit set")
+	}
+	if n > maxChunkLength {
+		return FormatError("chunk " + strconv.Quote(string(t[:])) + " is too long")
+	}
+	return nil
+}
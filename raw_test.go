@@ -0,0 +1,52 @@
+package apng
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRawChunkValidate(t *testing.T) {
+	for _, tc := range []struct {
+		typ string
+		ok  bool
+	}{
+		{"prIv", true},
+		{"tEXt", true},
+		{"ABCD", true},
+		{"prIV", true},
+		{"priv", false}, // Reserved bit set
+		{"abcd", false},
+		{"pr1v", false},
+		{"pr v", false},
+		{"pr\xc9v", false},
+		{"\x00\x00\x00\x00", false},
+	} {
+		c := &RawChunk{Data: []byte{1, 2, 3}}
+		copy(c.Type[:], tc.typ)
+		err := c.Validate()
+		if (err == nil) != tc.ok {
+			t.Errorf("%q: got error %v, want ok %v", tc.typ, err, tc.ok)
+			continue
+		}
+		buf := bytes.NewBuffer(nil)
+		n, werr := c.WriteTo(buf)
+		if tc.ok != (werr == nil) {
+			t.Errorf("%q: WriteTo returned %v", tc.typ, werr)
+		}
+		if !tc.ok && (n != 0 || buf.Len() != 0) {
+			t.Errorf("%q: WriteTo wrote %d bytes of an invalid chunk", tc.typ, buf.Len())
+		}
+	}
+}
+
+// TestRawChunkTooLong checks the length limit directly, since a chunk that
+// long would need 2 GiB of data.
+func TestRawChunkTooLong(t *testing.T) {
+	typ := [4]byte{'p', 'r', 'I', 'v'}
+	if err := checkChunk(typ, maxChunkLength); err != nil {
+		t.Errorf("%d bytes: %v", maxChunkLength, err)
+	}
+	if err := checkChunk(typ, maxChunkLength+1); err == nil {
+		t.Errorf("%d bytes: no error", maxChunkLength+1)
+	}
+}
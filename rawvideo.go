@@ -0,0 +1,162 @@
+package apng
+
+import (
+	"fmt"
+	"image"
+	"io"
+)
+
+// PixelFormat is the layout of the pixels of raw video frames, named as per
+// ffmpeg's -pix_fmt.
+type PixelFormat int
+
+const (
+	PixelFormat_RGBA     = PixelFormat(0) // 8-bit red, green, blue and non-premultiplied alpha
+	PixelFormat_RGB24    = PixelFormat(1) // 8-bit red, green and blue
+	PixelFormat_Gray     = PixelFormat(2) // 8-bit gray
+	PixelFormat_RGBA64BE = PixelFormat(3) // 16-bit big-endian red, green, blue and non-premultiplied alpha
+)
+
+// pixelFormats maps pixel formats to their ffmpeg names.
+var pixelFormats = map[PixelFormat]string{
+	PixelFormat_RGBA:     "rgba",
+	PixelFormat_RGB24:    "rgb24",
+	PixelFormat_Gray:     "gray",
+	PixelFormat_RGBA64BE: "rgba64be",
+}
+
+// ParsePixelFormat returns the pixel format with the given ffmpeg name.
+func ParsePixelFormat(s string) (PixelFormat, error) {
+	for f, name := range pixelFormats {
+		if name == s {
+			return f, nil
+		}
+	}
+	return 0, UnsupportedError("pixel format " + s)
+}
+
+// String returns the ffmpeg name of the pixel format.
+func (f PixelFormat) String() string {
+	if name, ok := pixelFormats[f]; ok {
+		return name
+	}
+	return fmt.Sprintf("PixelFormat(%d)", int(f))
+}
+
+// BytesPerPixel returns the size of a pixel, or 0 for an unknown format.
+func (f PixelFormat) BytesPerPixel() int {
+	switch f {
+	case PixelFormat_RGBA:
+		return 4
+	case PixelFormat_RGB24:
+		return 3
+	case PixelFormat_Gray:
+		return 1
+	case PixelFormat_RGBA64BE:
+		return 8
+	}
+	return 0
+}
+
+// NewChunk_IHDR makes a header for width by height frames of the pixel
+// format, with the color type and bit depth that hold them exactly.
+func (f PixelFormat) NewChunk_IHDR(width, height int) *Chunk_IHDR {
+	c := &Chunk_IHDR{Width: uint32(width), Height: uint32(height), BitDepth: BitDepth_8}
+	switch f {
+	case PixelFormat_RGBA:
+		c.ColorType = ColorType_TrueColorAlpha
+	case PixelFormat_RGB24:
+		c.ColorType = ColorType_TrueColor
+	case PixelFormat_Gray:
+		c.ColorType = ColorType_Grayscale
+	case PixelFormat_RGBA64BE:
+		c.ColorType, c.BitDepth = ColorType_TrueColorAlpha, BitDepth_16
+	}
+	return c
+}
+
+// RawVideoReader reads raw video frames, such as those written by ffmpeg with
+// -f rawvideo: width by height pixels of the pixel format per frame, with
+// rows top to bottom and no padding or headers.  Like an Encoder, call Next
+// to advance to each frame before using Image or Err.
+type RawVideoReader struct {
+	r      io.Reader
+	format PixelFormat
+	rect   image.Rectangle
+	buf    []byte // A frame of RGB24 pixels, which are expanded to RGBA
+	m      image.Image
+	err    error
+}
+
+// NewRawVideoReader makes a new reader of width by height frames of the pixel
+// format from r.
+func NewRawVideoReader(r io.Reader, format PixelFormat, width, height int) *RawVideoReader {
+	rv := &RawVideoReader{r: r, format: format, rect: image.Rect(0, 0, width, height)}
+	switch {
+	case format.BytesPerPixel() == 0:
+		rv.err = UnsupportedError("pixel format " + format.String())
+	case width <= 0 || height <= 0:
+		rv.err = FormatError(fmt.Sprintf("invalid frame size %dx%d", width, height))
+	}
+	return rv
+}
+
+// Next reads the next frame and reports whether there was one.  It returns
+// false at the end of the input, or if a frame could not be read in full.
+func (rv *RawVideoReader) Next() bool {
+	if rv.err != nil {
+		return false
+	}
+	var pix []byte
+	switch rv.format {
+	case PixelFormat_RGBA:
+		m := image.NewNRGBA(rv.rect)
+		rv.m, pix = m, m.Pix
+	case PixelFormat_RGB24:
+		if rv.buf == nil {
+			rv.buf = make([]byte, 3*rv.rect.Dx()*rv.rect.Dy())
+		}
+		pix = rv.buf
+	case PixelFormat_Gray:
+		m := image.NewGray(rv.rect)
+		rv.m, pix = m, m.Pix
+	case PixelFormat_RGBA64BE:
+		// This is the layout of image.NRGBA64.
+		m := image.NewNRGBA64(rv.rect)
+		rv.m, pix = m, m.Pix
+	}
+	if _, err := io.ReadFull(rv.r, pix); err != nil {
+		rv.m = nil
+		if err == io.ErrUnexpectedEOF {
+			err = FormatError("partial frame at the end of the raw video")
+		}
+		rv.err = err
+		return false
+	}
+	if rv.format == PixelFormat_RGB24 {
+		m := image.NewRGBA(rv.rect)
+		for i, j := 0, 0; i < len(pix); i, j = i+3, j+4 {
+			m.Pix[j+0] = pix[i+0]
+			m.Pix[j+1] = pix[i+1]
+			m.Pix[j+2] = pix[i+2]
+			m.Pix[j+3] = 0xff
+		}
+		rv.m = m
+	}
+	return true
+}
+
+// Image returns the current frame.  Each frame is a new image, which the
+// reader does not change afterwards.
+func (rv *RawVideoReader) Image() image.Image {
+	return rv.m
+}
+
+// Err returns the error that stopped the reader, if any.  Reaching the end of
+// the input between frames is not an error.
+func (rv *RawVideoReader) Err() error {
+	if rv.err == io.EOF {
+		return nil
+	}
+	return rv.err
+}
@@ -0,0 +1,235 @@
+package apng
+
+import (
+	"bytes"
+	"image"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// rawFrames returns n frames of raw video in the pixel format, with a square
+// that moves across a still background, and the images they hold.
+func rawFrames(format PixelFormat, w, h, n int) ([]byte, []image.Image) {
+	var raw []byte
+	var frames []image.Image
+	bpp := format.BytesPerPixel()
+	for i := 0; i < n; i++ {
+		frame := make([]byte, w*h*bpp)
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				px := frame[(y*w+x)*bpp : (y*w+x+1)*bpp]
+				for j := range px {
+					px[j] = uint8(x*7 + y*13 + j*29)
+				}
+				if x >= i && x < i+3 && y >= i && y < i+2 {
+					for j := range px {
+						px[j] = uint8(0xf0 - j)
+					}
+				}
+			}
+		}
+		raw = append(raw, frame...)
+
+		var m image.Image
+		r := image.Rect(0, 0, w, h)
+		switch format {
+		case PixelFormat_RGBA:
+			m = &image.NRGBA{Pix: frame, Stride: 4 * w, Rect: r}
+		case PixelFormat_RGB24:
+			rgba := image.NewRGBA(r)
+			for j := 0; j < w*h; j++ {
+				copy(rgba.Pix[4*j:4*j+3], frame[3*j:3*j+3])
+				rgba.Pix[4*j+3] = 0xff
+			}
+			m = rgba
+		case PixelFormat_Gray:
+			m = &image.Gray{Pix: frame, Stride: w, Rect: r}
+		case PixelFormat_RGBA64BE:
+			m = &image.NRGBA64{Pix: frame, Stride: 8 * w, Rect: r}
+		}
+		frames = append(frames, m)
+	}
+	return raw, frames
+}
+
+func TestRawVideoReader(t *testing.T) {
+	for _, format := range []PixelFormat{PixelFormat_RGBA, PixelFormat_RGB24, PixelFormat_Gray, PixelFormat_RGBA64BE} {
+		raw, want := rawFrames(format, 7, 5, 3)
+		rv := NewRawVideoReader(bytes.NewReader(raw), format, 7, 5)
+		i := 0
+		for ; rv.Next(); i++ {
+			compareImages(t, rv.Image(), want[i], 0)
+		}
+		if err := rv.Err(); err != nil {
+			t.Errorf("%v: %v", format, err)
+		}
+		if i != len(want) {
+			t.Errorf("%v: got %d frames, want %d", format, i, len(want))
+		}
+
+		rv = NewRawVideoReader(bytes.NewReader(raw[:len(raw)-1]), format, 7, 5)
+		for rv.Next() {
+		}
+		if rv.Err() == nil {
+			t.Errorf("%v: no error for a partial frame", format)
+		}
+		if f, err := ParsePixelFormat(format.String()); f != format || err != nil {
+			t.Errorf("ParsePixelFormat(%q) = %v, %v", format.String(), f, err)
+		}
+	}
+	if _, err := ParsePixelFormat("yuv420p"); err == nil {
+		t.Error("no error for an unsupported pixel format")
+	}
+}
+
+func TestStreamEncoder(t *testing.T) {
+	const w, h, n = 9, 6, 4
+	for _, format := range []PixelFormat{PixelFormat_RGBA, PixelFormat_RGB24, PixelFormat_Gray, PixelFormat_RGBA64BE} {
+		for _, crop := range []bool{false, true} {
+			raw, want := rawFrames(format, w, h, n)
+			buf := bytes.NewBuffer(nil)
+			opts := &StreamOptions{NumFrames: n, NumPlays: 1, DelayNum: 1001, DelayDen: 30000, Crop: crop}
+			e, err := NewStreamEncoder(buf, format.NewChunk_IHDR(w, h), opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rv := NewRawVideoReader(bytes.NewReader(raw), format, w, h)
+			for rv.Next() {
+				if err := e.WriteFrame(rv.Image()); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := rv.Err(); err != nil {
+				t.Fatal(err)
+			}
+			if err := e.Close(); err != nil {
+				t.Fatal(err)
+			}
+			checkStream(t, buf, want, crop)
+		}
+	}
+}
+
+// checkStream checks that an APNG written by a StreamEncoder displays the
+// frames.
+func checkStream(t *testing.T, r io.Reader, want []image.Image, crop bool) {
+	t.Helper()
+	a, err := Decode(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(a.Frames) != len(want) {
+		t.Fatalf("got %d frames, want %d", len(a.Frames), len(want))
+	}
+	for i, f := range a.Frames {
+		if f.DelayNum != 1001 || f.DelayDen != 30000 {
+			t.Errorf("frame %d: got delay %d/%d", i, f.DelayNum, f.DelayDen)
+		}
+		if full := f.Image.Bounds() == a.Bounds(); full == (crop && i > 0) {
+			t.Errorf("frame %d: got bounds %v with crop %v", i, f.Image.Bounds(), crop)
+		}
+	}
+	c := a.NewCompositor()
+	for c.Next() {
+		compareImages(t, c.Image(), want[c.Frame()], 0)
+	}
+}
+
+func TestStreamEncoderSeek(t *testing.T) {
+	raw, want := rawFrames(PixelFormat_RGBA, 8, 8, 5)
+	if _, err := NewStreamEncoder(bytes.NewBuffer(nil), PixelFormat_RGBA.NewChunk_IHDR(8, 8), nil); err == nil {
+		t.Error("no error for an unknown frame count without seeking")
+	}
+
+	f, err := os.Create(filepath.Join(t.TempDir(), "stream.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	e, err := NewStreamEncoder(f, PixelFormat_RGBA.NewChunk_IHDR(8, 8), &StreamOptions{DelayNum: 1001, DelayDen: 30000, Crop: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rv := NewRawVideoReader(bytes.NewReader(raw), PixelFormat_RGBA, 8, 8)
+	for rv.Next() {
+		if err := e.WriteFrame(rv.Image()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := e.WriteFrame(image.NewNRGBA(image.Rect(0, 0, 8, 9))); err == nil {
+		t.Error("no error for a frame of the wrong size")
+	}
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	checkStream(t, f, want, true)
+
+	// The frame count must match when it is given.
+	e, err = NewStreamEncoder(bytes.NewBuffer(nil), PixelFormat_Gray.NewChunk_IHDR(2, 2), &StreamOptions{NumFrames: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.WriteFrame(image.NewGray(image.Rect(0, 0, 2, 2))); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Close(); err == nil {
+		t.Error("no error for too few frames")
+	}
+}
+
+// TestStreamEncoderColorKey checks that the frame count is filled in where
+// acTL was written when a color key follows it.
+func TestStreamEncoderColorKey(t *testing.T) {
+	_, frames := rawFrames(PixelFormat_RGBA, 8, 8, 3)
+	for _, m := range frames {
+		m := m.(*image.NRGBA)
+		for i := 3; i < len(m.Pix); i += 4 {
+			if m.Pix[i] < 0x80 {
+				m.Pix[i-3], m.Pix[i-2], m.Pix[i-1], m.Pix[i] = 0, 0, 0, 0
+			} else {
+				m.Pix[i] = 0xff
+			}
+		}
+	}
+	ihdr := &Chunk_IHDR{Width: 8, Height: 8, BitDepth: BitDepth_8, ColorType: ColorType_TrueColor}
+	trns, ok := ihdr.NewChunk_tRNS_Key(frames...)
+	if !ok || trns == nil {
+		t.Fatal("no color key")
+	}
+	ihdr.Transparency = trns
+
+	f, err := os.Create(filepath.Join(t.TempDir(), "stream.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	e, err := NewStreamEncoder(f, ihdr, &StreamOptions{DelayNum: 1001, DelayDen: 30000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range frames {
+		if err := e.WriteFrame(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range Validate(f) {
+		if p.Severity == Severity_Error {
+			t.Error(p)
+		}
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	checkStream(t, f, frames, false)
+}
@@ -0,0 +1,249 @@
+package apng
+
+import (
+	"bytes"
+	"hash/crc32"
+	"io"
+)
+
+// ChunkReader reads the chunks of a PNG or APNG stream one at a time, checking
+// their framing and CRCs.  Like an Encoder, call Next to advance to each chunk
+// before using Chunk, and check Err once Next returns false.
+type ChunkReader struct {
+	r      io.Reader
+	header bool  // Whether the PNG header has been read
+	offset int64 // Byte offset of the next chunk
+
+	chunk       *RawChunk
+	chunkOffset int64
+	crc         uint32
+	validCRC    bool
+	err         error
+}
+
+// NewChunkReader makes a new chunk reader for the PNG stream in r.  The PNG
+// header is read by the first call to Next.
+func NewChunkReader(r io.Reader) *ChunkReader {
+	return &ChunkReader{r: r}
+}
+
+// Next reads the next chunk, and reports whether there was one.  It returns
+// false at the end of the stream or on an error, including a missing PNG
+// header or a truncated chunk, but not a CRC mismatch; use ValidCRC for that.
+func (cr *ChunkReader) Next() bool {
+	if cr.err != nil {
+		return false
+	}
+	cr.chunk, cr.chunkOffset = nil, cr.offset
+	if !cr.header {
+		if err := cr.readHeader(); err != nil {
+			cr.err = err
+			return false
+		}
+		cr.header = true
+		cr.chunkOffset = cr.offset
+	}
+	if err := cr.readChunk(); err != nil {
+		cr.err = err
+		return false
+	}
+	return true
+}
+
+func (cr *ChunkReader) readHeader() error {
+	header := [len(PngHeader)]byte{}
+	if _, err := io.ReadFull(cr.r, header[:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	if string(header[:]) != PngHeader {
+		return FormatError("not a PNG file")
+	}
+	cr.offset = int64(len(header))
+	return nil
+}
+
+func (cr *ChunkReader) readChunk() error {
+	header := [8]byte{}
+	if n, err := io.ReadFull(cr.r, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF || err == io.EOF && n != 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	length := readUint32(header[0:4])
+	if length > maxChunkLength {
+		return FormatError("chunk length too large")
+	}
+	c := &RawChunk{}
+	copy(c.Type[:], header[4:8])
+
+	// Copy rather than allocating the length up front, so that a corrupt
+	// length on a short stream does not allocate gigabytes.
+	buf := bytes.NewBuffer(nil)
+	if _, err := io.CopyN(buf, cr.r, int64(length)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	c.Data = buf.Bytes()
+
+	footer := [4]byte{}
+	if _, err := io.ReadFull(cr.r, footer[:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	crc := crc32.NewIEEE()
+	crc.Write(c.Type[:])
+	crc.Write(c.Data)
+	cr.crc = readUint32(footer[:])
+	cr.validCRC = crc.Sum32() == cr.crc
+
+	cr.chunk = c
+	cr.offset += int64(len(header)) + int64(length) + int64(len(footer))
+	return nil
+}
+
+// Chunk returns the current chunk.  Its length is len(Data), and Parse turns
+// it into one of the typed chunks.
+func (cr *ChunkReader) Chunk() *RawChunk {
+	return cr.chunk
+}
+
+// Offset returns the byte offset of the current chunk in the stream.  Once
+// Next returns false, it is the offset at which reading stopped.
+func (cr *ChunkReader) Offset() int64 {
+	return cr.chunkOffset
+}
+
+// CRC returns the CRC stored in the stream for the current chunk.
+func (cr *ChunkReader) CRC() uint32 {
+	return cr.crc
+}
+
+// ValidCRC reports whether the current chunk's CRC matches its type and data.
+func (cr *ChunkReader) ValidCRC() bool {
+	return cr.validCRC
+}
+
+// Err returns the error that stopped Next, or nil if the stream ended cleanly
+// between chunks.
+func (cr *ChunkReader) Err() error {
+	if cr.err == io.EOF {
+		return nil
+	}
+	return cr.err
+}
+
+// Parse parses the chunk's data into the typed chunk for its type:
+// *Chunk_IHDR, *Chunk_PLTE, *Chunk_tRNS, Chunk_IDAT, *Chunk_IEND, *Chunk_acTL,
+// *Chunk_fcTL, *Chunk_fdAT or *Chunk_eXIf.  Chunks of any other type are
+// returned as they are.  The typed chunk shares the chunk's data.
+func (c *RawChunk) Parse() (io.WriterTo, error) {
+	switch string(c.Type[:]) {
+	case "IHDR":
+		return ParseChunk_IHDR(c.Data)
+	case "PLTE":
+		return ParseChunk_PLTE(c.Data)
+	case "tRNS":
+		return ParseChunk_tRNS(c.Data)
+	case "IDAT":
+		return Chunk_IDAT(c.Data), nil
+	case "IEND":
+		if len(c.Data) != 0 {
+			return nil, FormatError("bad IEND length")
+		}
+		return &Chunk_IEND{}, nil
+	case "acTL":
+		return ParseChunk_acTL(c.Data)
+	case "fcTL":
+		return ParseChunk_fcTL(c.Data)
+	case "fdAT":
+		return ParseChunk_fdAT(c.Data)
+	case "eXIf":
+		return NewChunk_eXIf(c.Data)
+	}
+	return c, nil
+}
+
+// ParseChunk_IHDR parses the data of an image header chunk.  The fields are
+// not checked; use Validate for that.
+func ParseChunk_IHDR(b []byte) (*Chunk_IHDR, error) {
+	if len(b) != sizeOfUint32*2+sizeOfBitDepth+sizeOfColorType+sizeOfCompressionMethod+sizeOfFilterMethod+sizeOfInterlaceMethod {
+		return nil, FormatError("bad IHDR length")
+	}
+	return &Chunk_IHDR{
+		Width:             readUint32(b[0:4]),
+		Height:            readUint32(b[4:8]),
+		BitDepth:          BitDepth(b[8]),
+		ColorType:         ColorType(b[9]),
+		CompressionMethod: CompressionMethod(b[10]),
+		FilterMethod:      FilterMethod(b[11]),
+		InterlaceMethod:   InterlaceMethod(b[12]),
+	}, nil
+}
+
+// ParseChunk_PLTE parses the data of a palette chunk, which must hold between
+// 1 and 256 entries.
+func ParseChunk_PLTE(b []byte) (*Chunk_PLTE, error) {
+	if len(b)%3 != 0 {
+		return nil, FormatError("bad PLTE length")
+	}
+	c := &Chunk_PLTE{data: b}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// ParseChunk_tRNS parses the data of a transparency chunk.  What the data
+// means depends on the image's color type, so its length is not checked.
+func ParseChunk_tRNS(b []byte) (*Chunk_tRNS, error) {
+	return &Chunk_tRNS{data: b}, nil
+}
+
+// ParseChunk_acTL parses the data of an animation control chunk.
+func ParseChunk_acTL(b []byte) (*Chunk_acTL, error) {
+	if len(b) != sizeOfUint32*2 {
+		return nil, FormatError("bad acTL length")
+	}
+	return &Chunk_acTL{
+		NumFrames: readUint32(b[0:4]),
+		NumPlays:  readUint32(b[4:8]),
+	}, nil
+}
+
+// ParseChunk_fcTL parses the data of a frame control chunk.  The fields are
+// not checked; use Validate for that.
+func ParseChunk_fcTL(b []byte) (*Chunk_fcTL, error) {
+	if len(b) != sizeOfUint32*5+sizeOfUint16*2+sizeOfDisposeOp+sizeOfBlendOp {
+		return nil, FormatError("bad fcTL length")
+	}
+	return &Chunk_fcTL{
+		SequenceNumber: readUint32(b[0:4]),
+		Width:          readUint32(b[4:8]),
+		Height:         readUint32(b[8:12]),
+		XOffset:        readUint32(b[12:16]),
+		YOffset:        readUint32(b[16:20]),
+		DelayNum:       readUint16(b[20:22]),
+		DelayDen:       readUint16(b[22:24]),
+		DisposeOp:      DisposeOp(b[24]),
+		BlendOp:        BlendOp(b[25]),
+	}, nil
+}
+
+// ParseChunk_fdAT parses the data of a frame data chunk.
+func ParseChunk_fdAT(b []byte) (*Chunk_fdAT, error) {
+	if len(b) < sizeOfUint32 {
+		return nil, FormatError("bad fdAT length")
+	}
+	return &Chunk_fdAT{
+		SequenceNumber: readUint32(b[0:4]),
+		Chunk_IDAT:     Chunk_IDAT(b[4:]),
+	}, nil
+}
@@ -0,0 +1,59 @@
+package apng_test
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+
+	"github.com/shutej/apng"
+)
+
+func ExampleChunkReader() {
+	// Writes a small APNG to read back...
+	buf := bytes.NewBuffer(nil)
+	buf.WriteString(apng.PngHeader)
+	ihdr := &apng.Chunk_IHDR{
+		Width:     16,
+		Height:    16,
+		BitDepth:  apng.BitDepth_8,
+		ColorType: apng.ColorType_Grayscale,
+	}
+	ihdr.WriteTo(buf)
+	(&apng.Chunk_acTL{NumFrames: 1}).WriteTo(buf)
+	seq := apng.NewSequenceNumbers()
+	(&apng.Chunk_fcTL{SequenceNumber: seq.Next(), Width: 16, Height: 16, DelayDen: 100}).WriteTo(buf)
+	e := ihdr.NewEncoder_IDAT(image.NewGray(image.Rect(0, 0, 16, 16)), apng.DefaultCompression)
+	for e.Next() {
+		e.Chunk().WriteTo(buf)
+	}
+	(&apng.Chunk_IEND{}).WriteTo(buf)
+
+	cr := apng.NewChunkReader(buf)
+	for cr.Next() {
+		c := cr.Chunk()
+		p, err := c.Parse()
+		if err != nil {
+			panic(err)
+		}
+		switch p := p.(type) {
+		case *apng.Chunk_IHDR:
+			fmt.Printf("IHDR %dx%d, bit depth %d, color type %d\n", p.Width, p.Height, p.BitDepth, p.ColorType)
+		case *apng.Chunk_acTL:
+			fmt.Printf("acTL %d frames, %d plays\n", p.NumFrames, p.NumPlays)
+		case *apng.Chunk_fcTL:
+			fmt.Printf("fcTL sequence number %d, delay %d/%d\n", p.SequenceNumber, p.DelayNum, p.DelayDen)
+		default:
+			fmt.Printf("%s, CRC valid: %v\n", c.Type, cr.ValidCRC())
+		}
+	}
+	if err := cr.Err(); err != nil {
+		panic(err)
+	}
+
+	// Output:
+	// IHDR 16x16, bit depth 8, color type 0
+	// acTL 1 frames, 0 plays
+	// fcTL sequence number 0, delay 0/100
+	// IDAT, CRC valid: true
+	// IEND, CRC valid: true
+}
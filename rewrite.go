@@ -0,0 +1,183 @@
+package apng
+
+import (
+	"fmt"
+	"io"
+)
+
+// RewriteFunc is called by Rewrite with each acTL, fcTL and ancillary chunk,
+// as a *Chunk_acTL, *Chunk_fcTL or *RawChunk.  It returns the chunk to write in
+// its place, which for acTL and fcTL must be of the same type, or nil to drop
+// the chunk.  The callback may change the chunk it is given and return it, but
+// not an fcTL's Width or Height, since the frame data is copied as it is, nor
+// the offsets of an fcTL before IDAT, whose frame must cover the whole image.
+type RewriteFunc func(c io.WriterTo) (io.WriterTo, error)
+
+// Rewrite copies a PNG or APNG from r to w, passing chunks through fn, without
+// decompressing any image data.  IHDR, PLTE, IDAT, IEND and unknown critical
+// chunks are copied as they are, and fdAT chunks keep their image data.
+//
+// Dropping an fcTL drops its frame, along with the frame's fdAT chunks; the
+// frames after it are not changed, so if they drew over it, the result may not
+// look as intended.  Dropping the fcTL before IDAT leaves IDAT as the default
+// image only.  Dropping acTL drops every frame, leaving a plain PNG.  Rewrite
+// renumbers the remaining fcTL and fdAT chunks, sets acTL's NumFrames to the
+// number of frames left, and drops acTL if there are none.  Every chunk is
+// written with a fresh CRC; Rewrite returns an error if any read has a bad one.
+func Rewrite(w io.Writer, r io.Reader, fn RewriteFunc) error {
+	rw := &rewriter{fn: fn}
+	cr := NewChunkReader(r)
+	for cr.Next() {
+		c := cr.Chunk()
+		if !cr.ValidCRC() {
+			return FormatError(fmt.Sprintf("%s at offset %d: CRC mismatch", c.Type, cr.Offset()))
+		}
+		if err := rw.chunk(c); err != nil {
+			return err
+		}
+		if rw.end {
+			break
+		}
+	}
+	if err := cr.Err(); err != nil {
+		return err
+	}
+	if !rw.end {
+		return FormatError("missing IEND")
+	}
+	return rw.writeTo(w)
+}
+
+type rewriter struct {
+	fn     RewriteFunc
+	ihdr   *Chunk_IHDR
+	chunks []io.WriterTo
+	actl   *Chunk_acTL
+
+	idat          bool // Whether IDAT was seen
+	dropAnimation bool // Whether acTL was dropped
+	dropFrame     bool // Whether the current frame's fcTL was dropped
+	end           bool
+}
+
+func (rw *rewriter) chunk(c *RawChunk) error {
+	name := string(c.Type[:])
+	if rw.ihdr == nil && name != "IHDR" {
+		return FormatError("first chunk is not IHDR")
+	}
+	switch name {
+	case "IHDR":
+		ihdr, err := ParseChunk_IHDR(c.Data)
+		if err != nil {
+			return err
+		}
+		rw.ihdr = ihdr
+	case "acTL":
+		actl, err := ParseChunk_acTL(c.Data)
+		if err != nil {
+			return err
+		}
+		out, err := rw.fn(actl)
+		if err != nil || out == nil {
+			rw.dropAnimation = true
+			return err
+		}
+		if rw.actl, _ = out.(*Chunk_acTL); rw.actl == nil {
+			return fmt.Errorf("apng: rewriting acTL returned a %T", out)
+		}
+		rw.chunks = append(rw.chunks, rw.actl)
+		return nil
+	case "fcTL":
+		if rw.dropAnimation {
+			return nil
+		}
+		fctl, err := ParseChunk_fcTL(c.Data)
+		if err != nil {
+			return err
+		}
+		width, height := fctl.Width, fctl.Height
+		out, err := rw.fn(fctl)
+		if err != nil || out == nil {
+			rw.dropFrame = true
+			return err
+		}
+		if fctl, _ = out.(*Chunk_fcTL); fctl == nil {
+			return fmt.Errorf("apng: rewriting fcTL returned a %T", out)
+		}
+		switch {
+		case fctl.Width != width:
+			return &ChunkError{"fcTL", "Width", fmt.Sprintf("rewriting changed it from %d to %d, but the frame data is copied as it is", width, fctl.Width)}
+		case fctl.Height != height:
+			return &ChunkError{"fcTL", "Height", fmt.Sprintf("rewriting changed it from %d to %d, but the frame data is copied as it is", height, fctl.Height)}
+		case rw.idat:
+		case fctl.Width != rw.ihdr.Width || fctl.Height != rw.ihdr.Height:
+			return &ChunkError{"fcTL", "Width", "the frame of the default image must be the size of the image"}
+		case fctl.XOffset != 0:
+			return &ChunkError{"fcTL", "XOffset", "the frame of the default image must be at (0, 0)"}
+		case fctl.YOffset != 0:
+			return &ChunkError{"fcTL", "YOffset", "the frame of the default image must be at (0, 0)"}
+		}
+		if err := fctl.Validate(rw.ihdr); err != nil {
+			return err
+		}
+		rw.dropFrame = false
+		rw.chunks = append(rw.chunks, fctl)
+		return nil
+	case "fdAT":
+		if rw.dropAnimation || rw.dropFrame {
+			return nil
+		}
+		fdat, err := ParseChunk_fdAT(c.Data)
+		if err != nil {
+			return err
+		}
+		rw.chunks = append(rw.chunks, fdat)
+		return nil
+	case "IDAT":
+		rw.idat = true
+	case "IEND":
+		rw.end = true
+	default:
+		if c.Ancillary() {
+			out, err := rw.fn(c)
+			if err != nil {
+				return err
+			}
+			if out != nil {
+				rw.chunks = append(rw.chunks, out)
+			}
+			return nil
+		}
+	}
+	rw.chunks = append(rw.chunks, c)
+	return nil
+}
+
+// writeTo numbers the frames and writes the chunks.
+func (rw *rewriter) writeTo(w io.Writer) error {
+	seq := NewSequenceNumbers()
+	numFrames := uint32(0)
+	for _, c := range rw.chunks {
+		switch c := c.(type) {
+		case *Chunk_fcTL:
+			c.SequenceNumber = seq.Next()
+			numFrames++
+		case *Chunk_fdAT:
+			c.SequenceNumber = seq.Next()
+		}
+	}
+	if _, err := io.WriteString(w, PngHeader); err != nil {
+		return err
+	}
+	cw := &chunkWriter{w: w}
+	for _, c := range rw.chunks {
+		if c == rw.actl {
+			if numFrames == 0 {
+				continue
+			}
+			rw.actl.NumFrames = numFrames
+		}
+		cw.write(c)
+	}
+	return cw.err
+}
@@ -0,0 +1,184 @@
+package apng
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestRewrite(t *testing.T) {
+	a := testAnimation(5)
+	a.Crop()
+	a.Chunks = []*RawChunk{
+		{Type: [4]byte{'t', 'E', 'X', 't'}, Data: []byte("Comment\x00hello")},
+		{Type: [4]byte{'p', 'r', 'V', 't'}, Data: []byte("private")},
+	}
+	buf := bytes.NewBuffer(nil)
+	if err := Encode(buf, a, nil); err != nil {
+		t.Fatal(err)
+	}
+	in := buf.Bytes()
+	rewrite := func(t *testing.T, fn RewriteFunc) *Animation {
+		t.Helper()
+		out := bytes.NewBuffer(nil)
+		if err := Rewrite(out, bytes.NewReader(in), fn); err != nil {
+			t.Fatal(err)
+		}
+		if problems := Validate(bytes.NewReader(out.Bytes())); problems != nil {
+			t.Errorf("problems: %v", problems)
+		}
+		got, err := Decode(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+
+	t.Run("Identity", func(t *testing.T) {
+		out := bytes.NewBuffer(nil)
+		if err := Rewrite(out, bytes.NewReader(in), func(c io.WriterTo) (io.WriterTo, error) { return c, nil }); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out.Bytes(), in) {
+			t.Error("output differs from input")
+		}
+	})
+
+	t.Run("Strip", func(t *testing.T) {
+		got := rewrite(t, func(c io.WriterTo) (io.WriterTo, error) {
+			if _, ok := c.(*RawChunk); ok {
+				return nil, nil
+			}
+			return c, nil
+		})
+		if len(got.Chunks) != 0 || len(got.Frames) != len(a.Frames) {
+			t.Errorf("got %d chunks and %d frames", len(got.Chunks), len(got.Frames))
+		}
+	})
+
+	t.Run("Timing", func(t *testing.T) {
+		got := rewrite(t, func(c io.WriterTo) (io.WriterTo, error) {
+			switch c := c.(type) {
+			case *Chunk_acTL:
+				c.NumPlays = 7
+			case *Chunk_fcTL:
+				c.DelayNum, c.DelayDen = 1, 30
+			}
+			return c, nil
+		})
+		if got.NumPlays != 7 {
+			t.Errorf("got NumPlays %d, want 7", got.NumPlays)
+		}
+		for i, f := range got.Frames {
+			if f.DelayNum != 1 || f.DelayDen != 30 {
+				t.Errorf("frame %d: got delay %d/%d", i, f.DelayNum, f.DelayDen)
+			}
+			compareImages(t, translate(cloneNRGBA(f.Image), f.Image.Bounds().Min.Mul(-1)), a.Frames[i].Image, 0)
+		}
+	})
+
+	t.Run("DropFrame", func(t *testing.T) {
+		got := rewrite(t, func(c io.WriterTo) (io.WriterTo, error) {
+			if c, ok := c.(*Chunk_fcTL); ok && c.SequenceNumber == 3 {
+				return nil, nil
+			}
+			return c, nil
+		})
+		if len(got.Frames) != len(a.Frames)-1 {
+			t.Fatalf("got %d frames, want %d", len(got.Frames), len(a.Frames)-1)
+		}
+		// Frame 2 has sequence number 3, after frame 1's fcTL and fdAT.
+		for i, j := range []int{0, 1, 3, 4} {
+			if got.Frames[i].Image.Bounds() != a.Frames[j].Image.Bounds() {
+				t.Errorf("frame %d: got bounds %v, want %v", i, got.Frames[i].Image.Bounds(), a.Frames[j].Image.Bounds())
+			}
+		}
+	})
+
+	t.Run("DropFirstFrame", func(t *testing.T) {
+		got := rewrite(t, func(c io.WriterTo) (io.WriterTo, error) {
+			if c, ok := c.(*Chunk_fcTL); ok && c.SequenceNumber == 0 {
+				return nil, nil
+			}
+			return c, nil
+		})
+		if got.Default == nil || len(got.Frames) != len(a.Frames)-1 {
+			t.Errorf("got default %v and %d frames", got.Default != nil, len(got.Frames))
+		}
+	})
+
+	t.Run("DropAnimation", func(t *testing.T) {
+		got := rewrite(t, func(c io.WriterTo) (io.WriterTo, error) {
+			if _, ok := c.(*Chunk_acTL); ok {
+				return nil, nil
+			}
+			return c, nil
+		})
+		if len(got.Frames) != 1 || got.Frames[0].Image.Bounds() != a.Bounds() {
+			t.Errorf("got %d frames, want the default image only", len(got.Frames))
+		}
+	})
+
+	t.Run("MoveFrame", func(t *testing.T) {
+		// Frame 2 has sequence number 3; move it to the bottom right corner.
+		r := a.Frames[2].Image.Bounds()
+		to := a.Bounds().Max.Sub(r.Size())
+		got := rewrite(t, func(c io.WriterTo) (io.WriterTo, error) {
+			if c, ok := c.(*Chunk_fcTL); ok && c.SequenceNumber == 3 {
+				c.XOffset, c.YOffset = uint32(to.X), uint32(to.Y)
+			}
+			return c, nil
+		})
+		if want := r.Sub(r.Min).Add(to); got.Frames[2].Image.Bounds() != want {
+			t.Errorf("got bounds %v, want %v", got.Frames[2].Image.Bounds(), want)
+		}
+	})
+
+	t.Run("Errors", func(t *testing.T) {
+		identity := func(c io.WriterTo) (io.WriterTo, error) { return c, nil }
+		bad := append([]byte(nil), in...)
+		bad[len(bad)-1] ^= 1
+		for name, b := range map[string][]byte{
+			"BadCRC":    bad,
+			"Truncated": in[:len(in)-12],
+		} {
+			if err := Rewrite(io.Discard, bytes.NewReader(b), identity); err == nil {
+				t.Errorf("%s: no error", name)
+			}
+		}
+		wrongType := func(c io.WriterTo) (io.WriterTo, error) {
+			if _, ok := c.(*Chunk_fcTL); ok {
+				return &RawChunk{Type: [4]byte{'f', 'c', 'T', 'L'}}, nil
+			}
+			return c, nil
+		}
+		if err := Rewrite(io.Discard, bytes.NewReader(in), wrongType); err == nil {
+			t.Error("no error for an fcTL replaced by a RawChunk")
+		}
+
+		// The frame data is copied as it is, so frames cannot change size,
+		// and the default image's frame must stay where it is.
+		for _, tc := range []struct {
+			name  string
+			seq   uint32
+			f     func(c *Chunk_fcTL)
+			field string
+		}{
+			{"Width", 3, func(c *Chunk_fcTL) { c.Width-- }, "Width"},
+			{"Height", 3, func(c *Chunk_fcTL) { c.Height-- }, "Height"},
+			{"DefaultSize", 0, func(c *Chunk_fcTL) { c.Width, c.Height = c.Width-1, c.Height-1 }, "Width"},
+			{"DefaultXOffset", 0, func(c *Chunk_fcTL) { c.XOffset = 1 }, "XOffset"},
+			{"DefaultYOffset", 0, func(c *Chunk_fcTL) { c.YOffset = 1 }, "YOffset"},
+		} {
+			err := Rewrite(io.Discard, bytes.NewReader(in), func(c io.WriterTo) (io.WriterTo, error) {
+				if c, ok := c.(*Chunk_fcTL); ok && c.SequenceNumber == tc.seq {
+					tc.f(c)
+				}
+				return c, nil
+			})
+			if ce, ok := err.(*ChunkError); !ok || ce.Chunk != "fcTL" || ce.Field != tc.field {
+				t.Errorf("%s: got %v, want a ChunkError for fcTL %s", tc.name, err, tc.field)
+			}
+		}
+	})
+}
@@ -0,0 +1,511 @@
+package apng
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+// roundTripFormats pairs each supported color type and bit depth with source
+// images it can represent up to the precision of its bit depth, as written
+// describes.
+var roundTripFormats = []struct {
+	name    string
+	ct      ColorType
+	bd      BitDepth
+	sources []string
+	opaque  bool // Whether alpha is dropped, so sources must be opaque
+}{
+	{"G8", ColorType_Grayscale, BitDepth_8, []string{"Gray", "Gray16"}, true},
+	{"G16", ColorType_Grayscale, BitDepth_16, []string{"Gray16", "Gray"}, true},
+	{"GA8", ColorType_GrayscaleAlpha, BitDepth_8, []string{"GrayNRGBA"}, false},
+	{"GA16", ColorType_GrayscaleAlpha, BitDepth_16, []string{"Gray16", "GrayNRGBA"}, false},
+	{"TC8", ColorType_TrueColor, BitDepth_8, []string{"OpaqueRGBA", "OpaqueNRGBA", "OpaqueRGBA64", "OpaqueNRGBA64", "YCbCr", "Opaque"}, true},
+	{"TC16", ColorType_TrueColor, BitDepth_16, []string{"OpaqueRGBA64", "OpaqueNRGBA64", "OpaqueRGBA", "Opaque"}, true},
+	{"P8", ColorType_Paletted, BitDepth_8, []string{"Paletted"}, false},
+	{"TCA8", ColorType_TrueColorAlpha, BitDepth_8, []string{"NRGBA", "RGBA", "NRGBA64", "RGBA64", "YCbCr", "NYCbCrA", "Image"}, false},
+	{"TCA16", ColorType_TrueColorAlpha, BitDepth_16, []string{"NRGBA64", "RGBA64", "NRGBA", "RGBA", "Image"}, false},
+}
+
+var roundTripLevels = []CompressionLevel{DefaultCompression, NoCompression, BestSpeed, BestCompression}
+
+var roundTripFilters = []FilterStrategy{FilterStrategy_Adaptive, FilterStrategy_None}
+
+var roundTripSizes = []image.Rectangle{
+	image.Rect(0, 0, 1, 1),
+	image.Rect(0, 0, 7, 3),
+	image.Rect(-5, 10, 45, 41),
+	image.Rect(0, 0, 300, 200),
+}
+
+// testSource makes an image of the named type with noisy content, so that the
+// filters and several IDAT chunks get exercised.
+func testSource(kind string, r image.Rectangle, seed int64) image.Image {
+	rnd := rand.New(rand.NewSource(seed))
+	noise := func(p []byte) {
+		for i := range p {
+			p[i] = uint8(rnd.Intn(256))
+		}
+	}
+	setOpaque := func(p []byte, bpp, alpha int) {
+		for i := alpha; i < len(p); i += bpp {
+			p[i] = 0xff
+			if alpha+1 < bpp {
+				p[i+1] = 0xff
+			}
+		}
+	}
+	// Some gradient keeps neighbouring pixels related, as in real images.
+	gradient := func(p []byte, stride int) {
+		for i := range p {
+			if (i/stride)%4 != 0 {
+				p[i] = uint8(i%stride) + uint8(i/stride)
+			}
+		}
+	}
+	switch kind {
+	case "Gray":
+		m := image.NewGray(r)
+		noise(m.Pix)
+		gradient(m.Pix, m.Stride)
+		return m
+	case "Gray16":
+		m := image.NewGray16(r)
+		noise(m.Pix)
+		return m
+	case "GrayNRGBA":
+		m := image.NewNRGBA(r)
+		noise(m.Pix)
+		for i := 0; i < len(m.Pix); i += 4 {
+			m.Pix[i+1], m.Pix[i+2] = m.Pix[i], m.Pix[i]
+		}
+		return m
+	case "RGBA", "OpaqueRGBA":
+		n := testSource("NRGBA", r, seed).(*image.NRGBA)
+		if kind == "OpaqueRGBA" {
+			setOpaque(n.Pix, 4, 3)
+		}
+		m := image.NewRGBA(r)
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			for x := r.Min.X; x < r.Max.X; x++ {
+				m.Set(x, y, n.At(x, y))
+			}
+		}
+		return m
+	case "NRGBA", "OpaqueNRGBA":
+		m := image.NewNRGBA(r)
+		noise(m.Pix)
+		gradient(m.Pix, m.Stride)
+		if kind == "OpaqueNRGBA" {
+			setOpaque(m.Pix, 4, 3)
+		}
+		return m
+	case "RGBA64", "OpaqueRGBA64":
+		n := testSource("NRGBA64", r, seed).(*image.NRGBA64)
+		if kind == "OpaqueRGBA64" {
+			setOpaque(n.Pix, 8, 6)
+		}
+		m := image.NewRGBA64(r)
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			for x := r.Min.X; x < r.Max.X; x++ {
+				m.Set(x, y, n.At(x, y))
+			}
+		}
+		return m
+	case "NRGBA64", "OpaqueNRGBA64":
+		m := image.NewNRGBA64(r)
+		noise(m.Pix)
+		if kind == "OpaqueNRGBA64" {
+			setOpaque(m.Pix, 8, 6)
+		}
+		return m
+	case "Paletted":
+		p := make(color.Palette, 200)
+		for i := range p {
+			p[i] = color.NRGBA{uint8(rnd.Intn(256)), uint8(rnd.Intn(256)), uint8(rnd.Intn(256)), uint8(rnd.Intn(256))}
+		}
+		m := image.NewPaletted(r, p)
+		for i := range m.Pix {
+			m.Pix[i] = uint8(rnd.Intn(len(p)))
+		}
+		return m
+	case "YCbCr":
+		m := image.NewYCbCr(r, image.YCbCrSubsampleRatio420)
+		noise(m.Y)
+		noise(m.Cb)
+		noise(m.Cr)
+		return m
+	case "NYCbCrA":
+		m := image.NewNYCbCrA(r, image.YCbCrSubsampleRatio422)
+		noise(m.Y)
+		noise(m.Cb)
+		noise(m.Cr)
+		noise(m.A)
+		return m
+	case "Image":
+		return opaque{testSource("NRGBA", r, seed)}
+	case "Opaque":
+		return opaque{testSource("OpaqueNRGBA", r, seed)}
+	}
+	panic("unknown image type " + kind)
+}
+
+// sameColor reports whether the alpha-premultiplied values of a and b differ
+// by at most tol in every channel.
+func sameColor(a, b color.Color, tol uint32) bool {
+	ar, ag, ab, aa := a.RGBA()
+	br, bg, bb, ba := b.RGBA()
+	d := func(x, y uint32) uint32 {
+		if x > y {
+			return x - y
+		}
+		return y - x
+	}
+	return d(ar, br) <= tol && d(ag, bg) <= tol && d(ab, bb) <= tol && d(aa, ba) <= tol
+}
+
+// compareImages checks that got matches want pixel for pixel.  got's bounds
+// start at the origin, as image/png decodes them.
+func compareImages(t *testing.T, got, want image.Image, tol uint32) {
+	t.Helper()
+	wb := want.Bounds()
+	if got.Bounds() != wb.Sub(wb.Min) {
+		t.Fatalf("bounds: got %v, want %v", got.Bounds(), wb.Sub(wb.Min))
+	}
+	for y := wb.Min.Y; y < wb.Max.Y; y++ {
+		for x := wb.Min.X; x < wb.Max.X; x++ {
+			g, w := got.At(x-wb.Min.X, y-wb.Min.Y), want.At(x, y)
+			if !sameColor(g, w, tol) {
+				t.Fatalf("pixel (%d, %d): got %v, want %v", x, y, g, w)
+			}
+		}
+	}
+}
+
+// written wraps an image to return its colors as the encoder writes them with
+// bit depth bd.  At 8 bits, that is their non-alpha-premultiplied 8 bit form,
+// taken from the high bytes of non-alpha-premultiplied 16 bit colors, and
+// from the 8 bit RGB conversion of non-alpha-premultiplied YCbCr ones.
+type written struct {
+	image.Image
+	bd BitDepth
+}
+
+func (m written) At(x, y int) color.Color {
+	c := m.Image.At(x, y)
+	if m.bd == BitDepth_16 {
+		return c
+	}
+	switch n := c.(type) {
+	case color.NRGBA64:
+		return color.NRGBA{uint8(n.R >> 8), uint8(n.G >> 8), uint8(n.B >> 8), uint8(n.A >> 8)}
+	case color.NYCbCrA:
+		r, g, b := color.YCbCrToRGB(n.Y, n.Cb, n.Cr)
+		return color.NRGBA{r, g, b, n.A}
+	}
+	return color.NRGBAModel.Convert(c)
+}
+
+// tolerance returns the largest expected difference after writing src with
+// bit depth bd, in alpha-premultiplied 16 bit units, compared to the colors
+// of written.
+func tolerance(src string, bd BitDepth) uint32 {
+	if bd == BitDepth_16 && (src == "RGBA" || src == "RGBA64") {
+		// Un-premultiplying translucent colors to 16 bits rounds.
+		return 1
+	}
+	return 0
+}
+
+// encodePNG writes a single image PNG with the given header.
+func encodePNG(t testing.TB, ihdr *Chunk_IHDR, m image.Image, cl CompressionLevel, f FilterStrategy) []byte {
+	buf := bytes.NewBuffer(nil)
+	buf.WriteString(PngHeader)
+	mustWrite(t, buf, ihdr)
+	if p, ok := m.(*image.Paletted); ok && ihdr.ColorType == ColorType_Paletted {
+		mustWrite(t, buf, NewChunk_PLTE(p.Palette))
+		mustWrite(t, buf, NewChunk_tRNS(p.Palette))
+	}
+	e := ihdr.newEncoder_IDAT(m, cl, f)
+	for e.Next() {
+		mustWrite(t, buf, e.Chunk())
+	}
+	if err := e.Err(); err != nil {
+		t.Fatal(err)
+	}
+	mustWrite(t, buf, &Chunk_IEND{})
+	return buf.Bytes()
+}
+
+func mustWrite(t testing.TB, w io.Writer, c io.WriterTo) {
+	if _, err := c.WriteTo(w); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, f := range roundTripFormats {
+		for _, src := range f.sources {
+			for _, r := range roundTripSizes {
+				m := testSource(src, r, 1)
+				ihdr := &Chunk_IHDR{
+					Width:     uint32(r.Dx()),
+					Height:    uint32(r.Dy()),
+					BitDepth:  f.bd,
+					ColorType: f.ct,
+				}
+				for _, cl := range roundTripLevels {
+					for _, fs := range roundTripFilters {
+						t.Run(fmt.Sprintf("%s/%s/%dx%d/%d/%d", f.name, src, r.Dx(), r.Dy(), cl, fs), func(t *testing.T) {
+							got, err := png.Decode(bytes.NewReader(encodePNG(t, ihdr, m, cl, fs)))
+							if err != nil {
+								t.Fatal(err)
+							}
+							compareImages(t, got, written{m, f.bd}, tolerance(src, f.bd))
+						})
+					}
+				}
+			}
+		}
+	}
+}
+
+// TestRoundTripColorKey checks that transparent pixels come back transparent
+// when a frame is written without alpha, using a tRNS color key.
+func TestRoundTripColorKey(t *testing.T) {
+	r := image.Rect(0, 0, 40, 30)
+	m := testSource("OpaqueNRGBA", r, 2).(*image.NRGBA)
+	for i := 0; i < len(m.Pix); i += 28 {
+		m.Pix[i+3] = 0
+	}
+	for _, ct := range []ColorType{ColorType_Grayscale, ColorType_TrueColor} {
+		for _, bd := range []BitDepth{BitDepth_8, BitDepth_16} {
+			ihdr := &Chunk_IHDR{Width: 40, Height: 30, BitDepth: bd, ColorType: ct}
+			trns, ok := ihdr.NewChunk_tRNS_Key(m)
+			if !ok || trns == nil {
+				t.Fatalf("ColorType %d, BitDepth %d: no color key", ct, bd)
+			}
+			ihdr.Transparency = trns
+
+			buf := bytes.NewBuffer(nil)
+			buf.WriteString(PngHeader)
+			mustWrite(t, buf, ihdr)
+			mustWrite(t, buf, trns)
+			e := ihdr.NewEncoder_IDAT(m, DefaultCompression)
+			for e.Next() {
+				mustWrite(t, buf, e.Chunk())
+			}
+			if err := e.Err(); err != nil {
+				t.Fatal(err)
+			}
+			mustWrite(t, buf, &Chunk_IEND{})
+
+			got, err := png.Decode(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for y := 0; y < 30; y++ {
+				for x := 0; x < 40; x++ {
+					_, _, _, a := got.At(x, y).RGBA()
+					if want := uint32(m.NRGBAAt(x, y).A) * 0x101; a != want {
+						t.Fatalf("ColorType %d, BitDepth %d, pixel (%d, %d): alpha %#x, want %#x", ct, bd, x, y, a, want)
+					}
+				}
+			}
+		}
+	}
+}
+
+// TestRoundTripAnalyze checks that Analyze picks an encoding that keeps every
+// pixel, up to the precision of its bit depth.
+func TestRoundTripAnalyze(t *testing.T) {
+	r := image.Rect(0, 0, 50, 40)
+	for _, src := range []string{"Gray", "Gray16", "GrayNRGBA", "OpaqueNRGBA", "NRGBA", "NRGBA64", "OpaqueRGBA64", "Paletted"} {
+		m := testSource(src, r, 3)
+		a := Analyze(m)
+		cm, err := a.Convert(m)
+		if err != nil {
+			t.Fatalf("%s: %v", src, err)
+		}
+		buf := bytes.NewBuffer(nil)
+		buf.WriteString(PngHeader)
+		mustWrite(t, buf, a.IHDR)
+		if a.PLTE != nil {
+			mustWrite(t, buf, a.PLTE)
+		}
+		if a.TRNS != nil {
+			mustWrite(t, buf, a.TRNS)
+		}
+		e := a.IHDR.NewEncoder_IDAT(cm, DefaultCompression)
+		for e.Next() {
+			mustWrite(t, buf, e.Chunk())
+		}
+		if err := e.Err(); err != nil {
+			t.Fatal(err)
+		}
+		mustWrite(t, buf, &Chunk_IEND{})
+		got, err := png.Decode(buf)
+		if err != nil {
+			t.Fatalf("%s: %v", src, err)
+		}
+		compareImages(t, got, written{m, a.IHDR.BitDepth}, tolerance(src, a.IHDR.BitDepth))
+	}
+}
+
+// testFrame is one frame of a generated APNG.
+type testFrame struct {
+	fctl Chunk_fcTL
+	m    image.Image
+}
+
+// encodeAPNG writes an APNG whose frames are all encoded with fdAT, after a
+// default image that is not part of the animation unless defaultFrame is set.
+func encodeAPNG(t testing.TB, ihdr *Chunk_IHDR, plte *color.Palette, frames []testFrame, defaultFrame bool, cl CompressionLevel) []byte {
+	buf := bytes.NewBuffer(nil)
+	buf.WriteString(PngHeader)
+	mustWrite(t, buf, ihdr)
+	mustWrite(t, buf, &Chunk_acTL{NumFrames: uint32(len(frames))})
+	if plte != nil {
+		mustWrite(t, buf, NewChunk_PLTE(*plte))
+		mustWrite(t, buf, NewChunk_tRNS(*plte))
+	}
+	seq := NewSequenceNumbers()
+	encode := func(e Encoder) {
+		for e.Next() {
+			mustWrite(t, buf, e.Chunk())
+		}
+		if err := e.Err(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !defaultFrame {
+		encode(ihdr.NewEncoder_IDAT(frames[0].m, cl))
+	}
+	for i, f := range frames {
+		f.fctl.SequenceNumber = seq.Next()
+		mustWrite(t, buf, &f.fctl)
+		if i == 0 && defaultFrame {
+			encode(ihdr.NewEncoder_IDAT(f.m, cl))
+		} else {
+			encode(f.fctl.NewEncoder_fdAT(ihdr, seq, f.m, cl))
+		}
+	}
+	mustWrite(t, buf, &Chunk_IEND{})
+	return buf.Bytes()
+}
+
+// decodeFrames reads an APNG with a ChunkReader, and decodes the image data of
+// each fcTL by repackaging it as a standalone PNG for image/png.
+func decodeFrames(t *testing.T, b []byte) ([]*Chunk_fcTL, []image.Image) {
+	cr := NewChunkReader(bytes.NewReader(b))
+	var ihdr *Chunk_IHDR
+	var header []*RawChunk // PLTE and tRNS, to copy into each frame
+	var fctls []*Chunk_fcTL
+	var data [][]byte
+	for cr.Next() {
+		c := cr.Chunk()
+		if !cr.ValidCRC() {
+			t.Fatalf("%s: bad CRC", c.Type)
+		}
+		p, err := c.Parse()
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch p := p.(type) {
+		case *Chunk_IHDR:
+			ihdr = p
+		case *Chunk_PLTE, *Chunk_tRNS:
+			header = append(header, c)
+		case *Chunk_fcTL:
+			fctls = append(fctls, p)
+			data = append(data, nil)
+		case Chunk_IDAT:
+			if len(fctls) > 0 {
+				data[len(data)-1] = append(data[len(data)-1], p...)
+			}
+		case *Chunk_fdAT:
+			data[len(data)-1] = append(data[len(data)-1], p.Chunk_IDAT...)
+		}
+	}
+	if err := cr.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	frames := make([]image.Image, len(fctls))
+	for i, fctl := range fctls {
+		buf := bytes.NewBuffer(nil)
+		buf.WriteString(PngHeader)
+		frameIHDR := *ihdr
+		frameIHDR.Width, frameIHDR.Height = fctl.Width, fctl.Height
+		mustWrite(t, buf, &frameIHDR)
+		for _, c := range header {
+			mustWrite(t, buf, c)
+		}
+		mustWrite(t, buf, Chunk_IDAT(data[i]))
+		mustWrite(t, buf, &Chunk_IEND{})
+		var err error
+		if frames[i], err = png.Decode(buf); err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+	}
+	return fctls, frames
+}
+
+func TestRoundTripAPNG(t *testing.T) {
+	canvas := image.Rect(0, 0, 120, 90)
+	for _, f := range roundTripFormats {
+		src := f.sources[0]
+		for _, defaultFrame := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s/%s/default=%v", f.name, src, defaultFrame), func(t *testing.T) {
+				ihdr := &Chunk_IHDR{Width: 120, Height: 90, BitDepth: f.bd, ColorType: f.ct}
+				var plte *color.Palette
+				var frames []testFrame
+				for i, r := range []image.Rectangle{canvas, image.Rect(10, 20, 70, 50), image.Rect(119, 89, 120, 90), canvas} {
+					m := testSource(src, canvas, int64(i))
+					if p, ok := m.(*image.Paletted); ok {
+						// Every frame must share the first frame's palette.
+						if plte == nil {
+							plte = &p.Palette
+						}
+						p.Palette = *plte
+					}
+					frames = append(frames, testFrame{
+						fctl: Chunk_fcTL{
+							Width:    uint32(r.Dx()),
+							Height:   uint32(r.Dy()),
+							XOffset:  uint32(r.Min.X),
+							YOffset:  uint32(r.Min.Y),
+							DelayNum: uint16(i),
+							DelayDen: 30,
+						},
+						// Pass the whole canvas, which the fcTL encoder crops.
+						m: m,
+					})
+				}
+				b := encodeAPNG(t, ihdr, plte, frames, defaultFrame, DefaultCompression)
+				if problems := Validate(bytes.NewReader(b)); problems != nil {
+					t.Fatal(problems)
+				}
+				fctls, got := decodeFrames(t, b)
+				if len(got) != len(frames) {
+					t.Fatalf("got %d frames, want %d", len(got), len(frames))
+				}
+				for i, fr := range frames {
+					// encodeAPNG numbers the frames, so ignore SequenceNumber,
+					// which Validate has checked.
+					fr.fctl.SequenceNumber = fctls[i].SequenceNumber
+					if *fctls[i] != fr.fctl {
+						t.Errorf("frame %d: got %+v, want %+v", i, *fctls[i], fr.fctl)
+					}
+					r := image.Rect(0, 0, int(fr.fctl.Width), int(fr.fctl.Height)).Add(image.Pt(int(fr.fctl.XOffset), int(fr.fctl.YOffset)))
+					compareImages(t, got[i], written{subImage(fr.m, r), f.bd}, tolerance(src, f.bd))
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package apng
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"io"
+)
+
+// StreamOptions controls how a StreamEncoder writes an APNG.
+type StreamOptions struct {
+	// NumFrames is the number of frames that will be written.  If it is 0,
+	// the writer must be an io.WriteSeeker, and the count is filled in by
+	// Close.
+	NumFrames uint32
+	NumPlays  uint32 // Number of times to loop the animation. 0 indicates infinite looping.
+
+	// DelayNum and DelayDen are the delay of every frame, in seconds.  A
+	// DelayDen of 0 is treated as 100.
+	DelayNum, DelayDen uint16
+
+	CompressionLevel CompressionLevel
+
+	// Crop, if set, encodes only the region of each frame that differs from
+	// the frame before it, as per Animation.Crop.
+	Crop bool
+}
+
+// StreamEncoder writes an APNG one frame at a time, for animations too long to
+// hold in memory as an Animation, such as video piped from ffmpeg.  Every
+// frame covers the whole image, and is written as soon as it is given.
+type StreamEncoder struct {
+	ws   io.WriteSeeker // The underlying writer, if the frame count is filled in by Close
+	bw   *bufio.Writer
+	cw   *chunkWriter
+	ihdr *Chunk_IHDR
+	opts StreamOptions
+	seq  *SequenceNumbers
+
+	n          uint32      // Number of frames written
+	prev       image.Image // The previous frame, for cropping
+	actlOffset int64
+}
+
+// NewStreamEncoder makes a new encoder that writes to w an APNG with the given
+// header, and writes the PNG signature, IHDR, acTL and the IHDR's color key,
+// if any.  A nil opts is the same
+// as a zero StreamOptions.  Write each frame with WriteFrame, then call Close.
+func NewStreamEncoder(w io.Writer, ihdr *Chunk_IHDR, opts *StreamOptions) (*StreamEncoder, error) {
+	if opts == nil {
+		opts = &StreamOptions{}
+	}
+	if err := ihdr.Validate(); err != nil {
+		return nil, err
+	}
+	e := &StreamEncoder{ihdr: ihdr, opts: *opts, seq: NewSequenceNumbers()}
+	if opts.NumFrames == 0 {
+		ws, ok := w.(io.WriteSeeker)
+		if !ok {
+			return nil, FormatError("the number of frames is needed when the writer cannot seek")
+		}
+		offset, err := ws.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, err
+		}
+		e.ws, e.actlOffset = ws, offset
+	}
+	e.bw = bufio.NewWriter(w)
+	e.cw = &chunkWriter{w: e.bw}
+	n, err := io.WriteString(e.bw, PngHeader)
+	if err != nil {
+		return nil, err
+	}
+	m, err := ihdr.WriteTo(e.bw)
+	if err != nil {
+		return nil, err
+	}
+	// acTL follows whatever has been written before it.
+	e.actlOffset += int64(n) + m
+	// Close fills in an unknown frame count, which must not be 0 meanwhile.
+	numFrames := opts.NumFrames
+	if numFrames == 0 {
+		numFrames = 1
+	}
+	e.cw.write(&Chunk_acTL{NumFrames: numFrames, NumPlays: opts.NumPlays})
+	if ihdr.Transparency != nil {
+		e.cw.write(ihdr.Transparency)
+	}
+	if e.cw.err != nil {
+		return nil, e.cw.err
+	}
+	return e, nil
+}
+
+// WriteFrame encodes the next frame, which must be the size of the header.
+// With Crop set, the encoder keeps m to compare the next frame against, so the
+// caller must not reuse m's pixel buffer for the next frame.
+func (e *StreamEncoder) WriteFrame(m image.Image) error {
+	if e.cw.err != nil {
+		return e.cw.err
+	}
+	b := m.Bounds()
+	if uint32(b.Dx()) != e.ihdr.Width || uint32(b.Dy()) != e.ihdr.Height {
+		return &SizeError{"IHDR", e.ihdr.Width, e.ihdr.Height, b}
+	}
+	if e.opts.NumFrames != 0 && e.n == e.opts.NumFrames {
+		return FormatError(fmt.Sprintf("more than the %d frames in acTL", e.opts.NumFrames))
+	}
+	f := &Frame{Image: m, DelayNum: e.opts.DelayNum, DelayDen: e.opts.DelayDen}
+	if e.opts.Crop && e.prev != nil && e.prev.Bounds() == b {
+		r := diffBounds(e.prev, m)
+		if r.Empty() {
+			r = image.Rect(0, 0, 1, 1).Add(b.Min)
+		}
+		f.Image = subImage(m, r)
+	}
+	fctl := f.fcTL(e.seq.Next())
+	// The offsets are from the top left of the frame, which need not be at
+	// (0, 0).
+	r := f.Image.Bounds().Sub(b.Min)
+	fctl.XOffset, fctl.YOffset = uint32(r.Min.X), uint32(r.Min.Y)
+	e.cw.write(fctl)
+	if e.cw.err != nil {
+		return e.cw.err
+	}
+	if e.n == 0 {
+		e.cw.encode(e.ihdr.NewEncoder_IDAT(m, e.opts.CompressionLevel))
+	} else {
+		e.cw.encode(fctl.NewEncoder_fdAT(e.ihdr, e.seq, m, e.opts.CompressionLevel))
+	}
+	e.n++
+	e.prev = m
+	return e.cw.err
+}
+
+// Close writes IEND and flushes the output.  If the number of frames was not
+// given, it then fills it in.  It returns an error if no frames were written,
+// or fewer than the number given.
+func (e *StreamEncoder) Close() error {
+	if e.cw.err != nil {
+		return e.cw.err
+	}
+	switch {
+	case e.n == 0:
+		return FormatError("animation has no frames")
+	case e.opts.NumFrames != 0 && e.n != e.opts.NumFrames:
+		return FormatError(fmt.Sprintf("%d frames written, but acTL has %d", e.n, e.opts.NumFrames))
+	}
+	e.cw.write(&Chunk_IEND{})
+	if e.cw.err != nil {
+		return e.cw.err
+	}
+	if err := e.bw.Flush(); err != nil {
+		return err
+	}
+	if e.ws == nil {
+		return nil
+	}
+	end, err := e.ws.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := e.ws.Seek(e.actlOffset, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := (&Chunk_acTL{NumFrames: e.n, NumPlays: e.opts.NumPlays}).WriteTo(e.ws); err != nil {
+		return err
+	}
+	_, err = e.ws.Seek(end, io.SeekStart)
+	return err
+}
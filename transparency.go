@@ -0,0 +1,175 @@
+package apng
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+)
+
+// NewChunk_tRNS_Key checks whether the frames can be encoded without an alpha
+// channel using a single transparent color key, for an IHDR whose ColorType is
+// grayscale or truecolor.  That is the case when every pixel is either fully
+// opaque or fully transparent, and some color in the IHDR's bit depth is not
+// used by any opaque pixel.  The color of the first transparent pixel is
+// preferred as the key, so chroma-keyed NRGBA frames keep their key color.
+//
+// On success, set the returned chunk as the IHDR's Transparency, so that
+// encoders write transparent pixels as the key, and write the chunk itself
+// after the IHDR, before the image data.  If every pixel is opaque, no key is
+// needed and it returns nil, true.  Analyze does all of this for the frames it
+// is given.
+func (c *Chunk_IHDR) NewChunk_tRNS_Key(frames ...image.Image) (*Chunk_tRNS, bool) {
+	cb := c.cb()
+	var used keySet
+	switch cb {
+	case cbG8:
+		used = newBitKeySet(8)
+	case cbG16:
+		used = newBitKeySet(16)
+	case cbTC8:
+		used = newBitKeySet(24)
+	case cbTC16:
+		used = mapKeySet{}
+	default:
+		return nil, false
+	}
+
+	var preferred uint64
+	hasTransparent := false
+	for _, m := range frames {
+		b := m.Bounds()
+		nrgba, _ := m.(*image.NRGBA)
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				var s uint64
+				var a uint16
+				if nrgba != nil && cb == cbTC8 {
+					p := nrgba.Pix[nrgba.PixOffset(x, y):]
+					s = uint64(p[0])<<16 | uint64(p[1])<<8 | uint64(p[2])
+					a = uint16(p[3]) * 0x101
+				} else {
+					n := color.NRGBA64Model.Convert(m.At(x, y)).(color.NRGBA64)
+					a, n.A = n.A, 0xffff
+					s = keySample(cb, n)
+				}
+				switch a {
+				case 0:
+					if !hasTransparent {
+						preferred, hasTransparent = s, true
+					}
+				case 0xffff:
+					used.add(s)
+				default:
+					return nil, false
+				}
+			}
+		}
+	}
+	if !hasTransparent {
+		return nil, true
+	}
+
+	s, ok := preferred, !used.has(preferred)
+	if !ok {
+		s, ok = used.unused()
+	}
+	if !ok {
+		return nil, false
+	}
+	switch cb {
+	case cbG8, cbG16:
+		return NewChunk_tRNS_Gray(uint16(s)), true
+	case cbTC8:
+		return NewChunk_tRNS_RGB(uint16(s>>16&0xff), uint16(s>>8&0xff), uint16(s&0xff)), true
+	default:
+		return NewChunk_tRNS_RGB(uint16(s>>32), uint16(s>>16), uint16(s)), true
+	}
+}
+
+// alphaError returns an error if the pixel at (x, y), with 16 bit alpha a,
+// cannot be written in a color type without an alpha channel: that is if it is
+// not fully opaque, unless there is a color key and it is fully transparent.
+// The encoders check this as they convert each pixel, rather than dropping
+// alpha silently.
+func alphaError(x, y int, a uint32, key []byte) error {
+	switch {
+	case a == 0xffff || a == 0 && key != nil:
+		return nil
+	case a == 0:
+		return UnsupportedError(fmt.Sprintf("transparent pixel at (%d, %d) in a color type without alpha or a color key", x, y))
+	}
+	return UnsupportedError(fmt.Sprintf("translucent pixel at (%d, %d) in a color type without alpha", x, y))
+}
+
+// keySample packs the samples of an opaque color as the encoder writes them
+// for cb.
+func keySample(cb int, c color.NRGBA64) uint64 {
+	switch cb {
+	case cbG8:
+		return uint64(color.GrayModel.Convert(c).(color.Gray).Y)
+	case cbG16:
+		return uint64(color.Gray16Model.Convert(c).(color.Gray16).Y)
+	case cbTC8:
+		return uint64(c.R>>8)<<16 | uint64(c.G>>8)<<8 | uint64(c.B>>8)
+	default:
+		return uint64(c.R)<<32 | uint64(c.G)<<16 | uint64(c.B)
+	}
+}
+
+// A keySet is a set of packed samples.
+type keySet interface {
+	add(s uint64)
+	has(s uint64) bool
+	// unused returns the smallest sample not in the set, if any.
+	unused() (uint64, bool)
+}
+
+// bitKeySet is a keySet for samples of up to 24 bits.
+type bitKeySet []uint64
+
+func newBitKeySet(bits uint) bitKeySet {
+	return make(bitKeySet, (1<<bits+63)/64)
+}
+
+func (k bitKeySet) add(s uint64) {
+	k[s/64] |= 1 << (s % 64)
+}
+
+func (k bitKeySet) has(s uint64) bool {
+	return k[s/64]&(1<<(s%64)) != 0
+}
+
+func (k bitKeySet) unused() (uint64, bool) {
+	for i, w := range k {
+		if w == ^uint64(0) {
+			continue
+		}
+		for j := uint64(0); j < 64; j++ {
+			if w&(1<<j) == 0 {
+				return uint64(i)*64 + j, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// mapKeySet is a keySet for 48 bit truecolor samples.
+type mapKeySet map[uint64]struct{}
+
+func (k mapKeySet) add(s uint64) {
+	k[s] = struct{}{}
+}
+
+func (k mapKeySet) has(s uint64) bool {
+	_, ok := k[s]
+	return ok
+}
+
+func (k mapKeySet) unused() (uint64, bool) {
+	// There are fewer entries than possible samples, so this terminates.
+	for s := uint64(0); ; s++ {
+		if !k.has(s) {
+			return s, true
+		}
+	}
+}
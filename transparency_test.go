@@ -0,0 +1,126 @@
+package apng
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"strings"
+	"testing"
+)
+
+// TestIHDRTransparency checks that an IHDR writes only itself, leaving its
+// color key to be written as a chunk of its own before the image data, and
+// refuses a color key for a color type that does not take one.
+func TestIHDRTransparency(t *testing.T) {
+	trns := NewChunk_tRNS_RGB(1, 2, 3)
+	ihdr := &Chunk_IHDR{Width: 1, Height: 1, BitDepth: BitDepth_8, ColorType: ColorType_TrueColor, Transparency: trns}
+	got := bytes.NewBuffer(nil)
+	n, err := ihdr.WriteTo(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := bytes.NewBuffer(nil)
+	writeChunkTo("IHDR", ihdr.data(), want)
+	if !bytes.Equal(got.Bytes(), want.Bytes()) || n != int64(want.Len()) {
+		t.Errorf("wrote %d bytes %x, want %x", n, got.Bytes(), want.Bytes())
+	}
+
+	// Encode writes the color key of a gray frame once, after acTL and
+	// before IDAT.
+	m := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 4; x++ {
+			v := uint8(16*y + x)
+			m.SetNRGBA(x, y, color.NRGBA{v, v, v, 0xff})
+		}
+	}
+	m.SetNRGBA(1, 1, color.NRGBA{})
+	buf := bytes.NewBuffer(nil)
+	if err := Encode(buf, &Animation{Width: 4, Height: 4, Frames: []Frame{{Image: m}}}, nil); err != nil {
+		t.Fatal(err)
+	}
+	var order []string
+	cr := NewChunkReader(buf)
+	for cr.Next() {
+		if s := string(cr.Chunk().Type[:]); s != "fcTL" {
+			order = append(order, s)
+		}
+	}
+	if s := strings.Join(order, " "); s != "IHDR acTL tRNS IDAT IEND" {
+		t.Errorf("got chunks %s", s)
+	}
+
+	for _, tc := range []struct {
+		ct   ColorType
+		trns *Chunk_tRNS
+	}{
+		{ColorType_Grayscale, NewChunk_tRNS_RGB(1, 2, 3)},
+		{ColorType_TrueColor, NewChunk_tRNS_Gray(1)},
+		{ColorType_TrueColorAlpha, NewChunk_tRNS_RGB(1, 2, 3)},
+		{ColorType_Paletted, NewChunk_tRNS(color.Palette{color.Transparent})},
+	} {
+		ihdr := &Chunk_IHDR{Width: 1, Height: 1, BitDepth: BitDepth_8, ColorType: tc.ct, Transparency: tc.trns}
+		err := ihdr.Validate()
+		if ce, ok := err.(*ChunkError); !ok || ce.Chunk != "IHDR" || ce.Field != "Transparency" {
+			t.Errorf("ColorType %d: got %v, want an IHDR Transparency error", tc.ct, err)
+		}
+		buf := bytes.NewBuffer(nil)
+		if _, err := ihdr.WriteTo(buf); err == nil || buf.Len() != 0 {
+			t.Errorf("ColorType %d: wrote %d bytes, error %v", tc.ct, buf.Len(), err)
+		}
+	}
+}
+
+// TestEncoderAlpha checks that the encoders refuse pixels that a color type
+// without an alpha channel cannot represent, rather than dropping their alpha.
+func TestEncoderAlpha(t *testing.T) {
+	r := image.Rect(0, 0, 4, 4)
+	opaqueM := image.NewNRGBA(r)
+	for i := range opaqueM.Pix {
+		opaqueM.Pix[i] = 0xff
+	}
+	keyed := image.NewNRGBA(r)
+	copy(keyed.Pix, opaqueM.Pix)
+	keyed.SetNRGBA(1, 2, color.NRGBA{})
+	translucent := image.NewNRGBA(r)
+	copy(translucent.Pix, opaqueM.Pix)
+	translucent.SetNRGBA(3, 0, color.NRGBA{0x10, 0x20, 0x30, 0x80})
+
+	for _, ct := range []ColorType{ColorType_Grayscale, ColorType_TrueColor} {
+		for _, bd := range []BitDepth{BitDepth_8, BitDepth_16} {
+			for _, tc := range []struct {
+				name string
+				m    image.Image
+				key  bool
+				ok   bool
+			}{
+				{"Opaque", opaqueM, false, true},
+				{"Opaque", opaque{opaqueM}, false, true},
+				{"Transparent", keyed, false, false},
+				{"TransparentKey", keyed, true, true},
+				{"Translucent", translucent, false, false},
+				{"TranslucentKey", opaque{translucent}, true, false},
+			} {
+				ihdr := &Chunk_IHDR{Width: 4, Height: 4, BitDepth: bd, ColorType: ct}
+				if tc.key {
+					trns, ok := ihdr.NewChunk_tRNS_Key(keyed)
+					if !ok || trns == nil {
+						t.Fatalf("ColorType %d, BitDepth %d: no color key", ct, bd)
+					}
+					ihdr.Transparency = trns
+				}
+				for _, e := range []Encoder{
+					ihdr.NewEncoder_IDAT(tc.m, DefaultCompression),
+					ihdr.NewEncoder_fdAT(NewSequenceNumbers(), tc.m, DefaultCompression),
+				} {
+					for e.Next() {
+					}
+					err := e.Err()
+					if _, unsupported := err.(UnsupportedError); tc.ok && err != nil || !tc.ok && !unsupported {
+						t.Errorf("ColorType %d, BitDepth %d, %s %T: got %v, want ok %v", ct, bd, tc.name, tc.m, err, tc.ok)
+					}
+				}
+			}
+		}
+	}
+}
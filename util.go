@@ -4,6 +4,11 @@
 
 package apng
 
+import (
+	"fmt"
+	"image"
+)
+
 const PngHeader = "\x89PNG\r\n\x1a\n"
 
 // Filter type, as per the PNG spec.
@@ -117,3 +122,39 @@ func filter(cr *[nFilter][]byte, pr []byte, bpp int) int {
 
 	return filter
 }
+
+// A FormatError reports that the input is not a valid PNG or APNG.
+type FormatError string
+
+func (e FormatError) Error() string { return "apng: invalid format: " + string(e) }
+
+// An UnsupportedError reports that the input uses a valid but unimplemented
+// PNG feature.
+type UnsupportedError string
+
+func (e UnsupportedError) Error() string { return "apng: unsupported feature: " + string(e) }
+
+// A ChunkError reports a chunk field whose value the PNG or APNG spec does not
+// allow, so that writing the chunk would produce an invalid stream.
+type ChunkError struct {
+	Chunk   string // Type of the chunk, e.g. "IHDR"
+	Field   string // Name of the offending field
+	Message string
+}
+
+func (e *ChunkError) Error() string {
+	return "apng: invalid " + e.Chunk + " " + e.Field + ": " + e.Message
+}
+
+// A SizeError reports that an image's size does not match the size given in the
+// chunk it is being encoded for.
+type SizeError struct {
+	Chunk  string // Type of the chunk, "IHDR" or "fcTL"
+	Width  uint32 // Width in the chunk
+	Height uint32 // Height in the chunk
+	Bounds image.Rectangle
+}
+
+func (e *SizeError) Error() string {
+	return fmt.Sprintf("apng: %dx%d image does not match %s size %dx%d", e.Bounds.Dx(), e.Bounds.Dy(), e.Chunk, e.Width, e.Height)
+}
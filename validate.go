@@ -0,0 +1,337 @@
+package apng
+
+import (
+	"fmt"
+	"io"
+)
+
+// Severity is how serious a Problem found by Validate is.
+type Severity int
+
+const (
+	Severity_Warning = Severity(0) // Valid, but probably not what was meant
+	Severity_Error   = Severity(1) // A violation of the PNG or APNG spec
+)
+
+func (s Severity) String() string {
+	switch s {
+	case Severity_Warning:
+		return "warning"
+	case Severity_Error:
+		return "error"
+	}
+	return fmt.Sprintf("Severity(%d)", int(s))
+}
+
+// Problem is an issue with a PNG or APNG stream found by Validate.
+type Problem struct {
+	Offset   int64  // Byte offset of the chunk in the stream
+	Chunk    string // Type of the chunk, or "" for the stream as a whole
+	Severity Severity
+	Message  string
+}
+
+func (p Problem) String() string {
+	if p.Chunk == "" {
+		return fmt.Sprintf("%d: %v: %s", p.Offset, p.Severity, p.Message)
+	}
+	return fmt.Sprintf("%d: %v: %s: %s", p.Offset, p.Severity, p.Chunk, p.Message)
+}
+
+// Validate reads a PNG or APNG stream from r and checks its structure: chunk
+// CRCs and ordering, the IHDR fields, that the number of fcTL chunks matches
+// acTL, that fcTL and fdAT sequence numbers count up from 0 without gaps, and
+// that every frame lies within the image, with the frame for the default image
+// covering all of it.  It also warns about DisposeOp_Previous on the first
+// frame and a zero DelayDen, which decoders treat as DisposeOp_Background and
+// 100 respectively.  Pixel data is not decompressed.  Validate returns nil if
+// it finds no problems.
+func Validate(r io.Reader) []Problem {
+	v := &validator{}
+	cr := NewChunkReader(r)
+	for cr.Next() {
+		v.offset = cr.Offset()
+		v.chunk(cr.Chunk(), cr.ValidCRC())
+	}
+	v.offset = cr.Offset()
+	if err := cr.Err(); err != nil {
+		v.errorf("", "%v", err)
+		return v.problems
+	}
+	v.end()
+	return v.problems
+}
+
+// Where the IDAT chunks are relative to the current chunk.
+const (
+	idatBefore = iota
+	idatDuring
+	idatAfter
+)
+
+type validator struct {
+	problems []Problem
+	offset   int64
+
+	nChunks    int
+	ihdr       *Chunk_IHDR
+	paletteLen int
+	seen       map[string]bool
+	idat       int
+	actl       *Chunk_acTL
+	seq        uint32
+
+	// The most recent fcTL, whether any image data has followed it, and
+	// whether that data is the default image.
+	fctl        *Chunk_fcTL
+	fctlData    bool
+	fctlDefault bool
+	numFrames   uint32
+}
+
+func (v *validator) errorf(name, format string, args ...interface{}) {
+	v.problems = append(v.problems, Problem{
+		Offset:   v.offset,
+		Chunk:    name,
+		Severity: Severity_Error,
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+func (v *validator) warnf(name, format string, args ...interface{}) {
+	v.problems = append(v.problems, Problem{
+		Offset:   v.offset,
+		Chunk:    name,
+		Severity: Severity_Warning,
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+func (v *validator) chunk(c *RawChunk, crcOK bool) {
+	name := string(c.Type[:])
+	if v.seen == nil {
+		v.seen = map[string]bool{}
+	}
+	v.nChunks++
+
+	if !crcOK {
+		v.errorf(name, "CRC mismatch")
+	}
+	if err := c.Validate(); err != nil {
+		v.errorf(name, "%v", err)
+	}
+	if v.nChunks == 1 && name != "IHDR" {
+		v.errorf(name, "first chunk is not IHDR")
+	}
+	if v.seen["IEND"] {
+		v.errorf(name, "chunk after IEND")
+	}
+	if v.idat == idatDuring && name != "IDAT" {
+		v.idat = idatAfter
+	}
+	once := func() bool {
+		if v.seen[name] {
+			v.errorf(name, "more than one %s chunk", name)
+			return false
+		}
+		return true
+	}
+	beforeIDAT := func() {
+		if v.idat != idatBefore {
+			v.errorf(name, "%s after IDAT", name)
+		}
+	}
+	defer func() { v.seen[name] = true }()
+
+	switch name {
+	case "IHDR":
+		if !once() {
+			return
+		}
+		ihdr, err := ParseChunk_IHDR(c.Data)
+		if err != nil {
+			v.errorf(name, "%v", err)
+			return
+		}
+		v.ihdr = ihdr
+		v.checkIHDR(ihdr)
+
+	case "PLTE":
+		if !once() {
+			return
+		}
+		beforeIDAT()
+		if v.seen["tRNS"] {
+			v.errorf(name, "PLTE after tRNS")
+		}
+		if len(c.Data)%3 != 0 || len(c.Data) == 0 || len(c.Data) > 3*256 {
+			v.errorf(name, "bad PLTE length %d", len(c.Data))
+		}
+		v.paletteLen = len(c.Data) / 3
+		if v.ihdr != nil {
+			switch v.ihdr.ColorType {
+			case ColorType_Grayscale, ColorType_GrayscaleAlpha:
+				v.errorf(name, "PLTE in a grayscale image")
+			case ColorType_Paletted:
+				if v.ihdr.BitDepth < BitDepth_8 && v.paletteLen > 1<<v.ihdr.BitDepth {
+					v.errorf(name, "%d palette entries for bit depth %d", v.paletteLen, v.ihdr.BitDepth)
+				}
+			}
+		}
+
+	case "tRNS":
+		if !once() {
+			return
+		}
+		beforeIDAT()
+		if v.ihdr == nil {
+			return
+		}
+		switch v.ihdr.ColorType {
+		case ColorType_Grayscale:
+			if len(c.Data) != sizeOfUint16 {
+				v.errorf(name, "bad tRNS length %d for a grayscale image", len(c.Data))
+			}
+		case ColorType_TrueColor:
+			if len(c.Data) != sizeOfUint16*3 {
+				v.errorf(name, "bad tRNS length %d for a truecolor image", len(c.Data))
+			}
+		case ColorType_Paletted:
+			if !v.seen["PLTE"] {
+				v.errorf(name, "tRNS before PLTE")
+			} else if len(c.Data) > v.paletteLen {
+				v.errorf(name, "%d tRNS entries for %d palette entries", len(c.Data), v.paletteLen)
+			}
+		default:
+			v.errorf(name, "tRNS in an image with an alpha channel")
+		}
+
+	case "acTL":
+		if !once() {
+			return
+		}
+		beforeIDAT()
+		actl, err := ParseChunk_acTL(c.Data)
+		if err != nil {
+			v.errorf(name, "%v", err)
+			return
+		}
+		v.actl = actl
+		if actl.NumFrames == 0 {
+			v.errorf(name, "NumFrames is 0")
+		}
+
+	case "fcTL":
+		fctl, err := ParseChunk_fcTL(c.Data)
+		if err != nil {
+			v.errorf(name, "%v", err)
+			return
+		}
+		if v.actl == nil {
+			v.errorf(name, "fcTL without a preceding acTL")
+		}
+		v.sequence(name, fctl.SequenceNumber)
+		v.endFrame()
+		v.fctl, v.fctlData, v.fctlDefault = fctl, false, v.idat == idatBefore
+		v.numFrames++
+		v.checkFCTL(fctl)
+
+	case "IDAT":
+		if v.idat == idatAfter {
+			v.errorf(name, "IDAT chunks are not consecutive")
+		}
+		if !v.seen["PLTE"] && v.ihdr != nil && v.ihdr.ColorType == ColorType_Paletted && !v.seen["IDAT"] {
+			v.errorf(name, "missing PLTE in a paletted image")
+		}
+		v.idat = idatDuring
+		if v.fctl != nil && v.fctlDefault {
+			v.fctlData = true
+		}
+
+	case "fdAT":
+		fdat, err := ParseChunk_fdAT(c.Data)
+		if err != nil {
+			v.errorf(name, "%v", err)
+			return
+		}
+		if v.actl == nil {
+			v.errorf(name, "fdAT without a preceding acTL")
+		}
+		v.sequence(name, fdat.SequenceNumber)
+		switch {
+		case v.idat == idatBefore:
+			v.errorf(name, "fdAT before IDAT")
+		case v.fctl == nil || v.fctlDefault:
+			v.errorf(name, "fdAT without a preceding fcTL")
+		}
+		v.fctlData = true
+
+	case "IEND":
+		if !once() {
+			return
+		}
+		if len(c.Data) != 0 {
+			v.errorf(name, "IEND has data")
+		}
+
+	default:
+		if !c.Ancillary() {
+			v.errorf(name, "unknown critical chunk")
+		}
+	}
+}
+
+func (v *validator) sequence(name string, seq uint32) {
+	if seq != v.seq {
+		v.errorf(name, "sequence number %d, want %d", seq, v.seq)
+	}
+	v.seq = seq + 1
+}
+
+// endFrame checks that the most recent fcTL, if any, was followed by image
+// data.
+func (v *validator) endFrame() {
+	if v.fctl != nil && !v.fctlData {
+		v.errorf("fcTL", "frame %d has no image data", v.numFrames-1)
+	}
+}
+
+func (v *validator) checkIHDR(ihdr *Chunk_IHDR) {
+	if err := ihdr.Validate(); err != nil {
+		v.errorf("IHDR", "%v", err)
+	}
+}
+
+func (v *validator) checkFCTL(fctl *Chunk_fcTL) {
+	const name = "fcTL"
+	if err := fctl.Validate(v.ihdr); err != nil {
+		v.errorf(name, "frame %d: %v", v.numFrames-1, err)
+	}
+	if v.ihdr != nil {
+		if v.idat == idatBefore && (fctl.XOffset != 0 || fctl.YOffset != 0 || fctl.Width != v.ihdr.Width || fctl.Height != v.ihdr.Height) {
+			v.errorf(name, "frame %d is the default image but does not cover it", v.numFrames-1)
+		}
+	}
+	if v.numFrames == 1 && fctl.DisposeOp == DisposeOp_Previous {
+		v.warnf(name, "first frame uses DisposeOp_Previous, which is treated as DisposeOp_Background")
+	}
+	if fctl.DelayDen == 0 {
+		v.warnf(name, "frame %d has DelayDen 0, which is treated as 100", v.numFrames-1)
+	}
+}
+
+func (v *validator) end() {
+	v.endFrame()
+	if v.ihdr == nil {
+		v.errorf("", "missing IHDR")
+	}
+	if !v.seen["IDAT"] {
+		v.errorf("", "missing IDAT")
+	}
+	if !v.seen["IEND"] {
+		v.errorf("", "missing IEND")
+	}
+	if v.actl != nil && v.actl.NumFrames != v.numFrames {
+		v.errorf("acTL", "NumFrames is %d, but there are %d fcTL chunks", v.actl.NumFrames, v.numFrames)
+	}
+}
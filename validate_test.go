@@ -0,0 +1,260 @@
+package apng
+
+import (
+	"bytes"
+	"image"
+	"io"
+	"strings"
+	"testing"
+)
+
+// rawChunk returns c as written, as a RawChunk.
+func rawChunk(t *testing.T, c io.WriterTo) *RawChunk {
+	t.Helper()
+	buf := bytes.NewBufferString(PngHeader)
+	if _, err := c.WriteTo(buf); err != nil {
+		t.Fatal(err)
+	}
+	cr := NewChunkReader(buf)
+	if !cr.Next() {
+		t.Fatal(cr.Err())
+	}
+	return cr.Chunk()
+}
+
+// validChunks returns the chunks of a valid two frame APNG, whose first frame
+// is the default image:
+//
+//	0 IHDR, 1 acTL, 2 fcTL, 3 IDAT, 4 fcTL, 5 fdAT, 6 IEND
+func validChunks(t *testing.T) []*RawChunk {
+	ihdr := &Chunk_IHDR{Width: 4, Height: 4, BitDepth: BitDepth_8, ColorType: ColorType_TrueColorAlpha}
+	seq := NewSequenceNumbers()
+	cs := []*RawChunk{
+		rawChunk(t, ihdr),
+		rawChunk(t, &Chunk_acTL{NumFrames: 2}),
+	}
+	encode := func(e Encoder) {
+		for e.Next() {
+			cs = append(cs, rawChunk(t, e.Chunk()))
+		}
+		if err := e.Err(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fctl := &Chunk_fcTL{SequenceNumber: seq.Next(), Width: 4, Height: 4, DelayNum: 1, DelayDen: 10}
+	cs = append(cs, rawChunk(t, fctl))
+	encode(ihdr.NewEncoder_IDAT(image.NewNRGBA(image.Rect(0, 0, 4, 4)), DefaultCompression))
+	fctl = &Chunk_fcTL{SequenceNumber: seq.Next(), Width: 2, Height: 2, XOffset: 1, YOffset: 1, DelayNum: 1, DelayDen: 10}
+	cs = append(cs, rawChunk(t, fctl))
+	encode(fctl.NewEncoder_fdAT(ihdr, seq, image.NewNRGBA(image.Rect(0, 0, 2, 2)), DefaultCompression))
+	cs = append(cs, rawChunk(t, &Chunk_IEND{}))
+	if len(cs) != 7 {
+		t.Fatalf("got %d chunks, want 7", len(cs))
+	}
+	return cs
+}
+
+func TestValidate(t *testing.T) {
+	type want struct {
+		chunk    string
+		severity Severity
+		message  string
+	}
+	// Helpers to change the valid chunks.
+	fcTL := func(t *testing.T, cs []*RawChunk, i int, f func(*Chunk_fcTL)) {
+		c, err := ParseChunk_fcTL(cs[i].Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f(c)
+		cs[i] = rawChunk(t, c)
+	}
+	remove := func(cs []*RawChunk, i int) []*RawChunk {
+		return append(cs[:i:i], cs[i+1:]...)
+	}
+	move := func(cs []*RawChunk, from, to int) []*RawChunk {
+		c := cs[from]
+		cs = remove(cs, from)
+		return append(cs[:to:to], append([]*RawChunk{c}, cs[to:]...)...)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		change func(t *testing.T, cs []*RawChunk) []*RawChunk
+		crc    bool // Whether to corrupt the CRC of IHDR
+		want   []want
+	}{
+		{name: "Valid"},
+		{
+			name: "NumFramesMismatch",
+			change: func(t *testing.T, cs []*RawChunk) []*RawChunk {
+				cs[1] = rawChunk(t, &Chunk_acTL{NumFrames: 3})
+				return cs
+			},
+			want: []want{{"acTL", Severity_Error, "NumFrames is 3, but there are 2 fcTL chunks"}},
+		},
+		{
+			name: "SequenceGap",
+			change: func(t *testing.T, cs []*RawChunk) []*RawChunk {
+				fcTL(t, cs, 4, func(c *Chunk_fcTL) { c.SequenceNumber = 2 })
+				return cs
+			},
+			want: []want{
+				{"fcTL", Severity_Error, "sequence number 2, want 1"},
+				{"fdAT", Severity_Error, "sequence number 2, want 3"},
+			},
+		},
+		{
+			name: "SequenceOrder",
+			change: func(t *testing.T, cs []*RawChunk) []*RawChunk {
+				fcTL(t, cs, 2, func(c *Chunk_fcTL) { c.SequenceNumber = 1 })
+				fcTL(t, cs, 4, func(c *Chunk_fcTL) { c.SequenceNumber = 0 })
+				return cs
+			},
+			want: []want{
+				{"fcTL", Severity_Error, "sequence number 1, want 0"},
+				{"fcTL", Severity_Error, "sequence number 0, want 2"},
+				{"fdAT", Severity_Error, "sequence number 2, want 1"},
+			},
+		},
+		{
+			name: "FrameOutOfBounds",
+			change: func(t *testing.T, cs []*RawChunk) []*RawChunk {
+				fcTL(t, cs, 4, func(c *Chunk_fcTL) { c.XOffset = 3 })
+				return cs
+			},
+			want: []want{{"fcTL", Severity_Error, "frame 1: apng: invalid fcTL XOffset: 3 plus Width 2 exceeds image width 4"}},
+		},
+		{
+			name: "DefaultFrameSize",
+			change: func(t *testing.T, cs []*RawChunk) []*RawChunk {
+				fcTL(t, cs, 2, func(c *Chunk_fcTL) { c.Width = 3 })
+				return cs
+			},
+			want: []want{{"fcTL", Severity_Error, "frame 0 is the default image but does not cover it"}},
+		},
+		{
+			name: "DefaultFrameOffset",
+			change: func(t *testing.T, cs []*RawChunk) []*RawChunk {
+				fcTL(t, cs, 2, func(c *Chunk_fcTL) { c.Width, c.Height, c.XOffset, c.YOffset = 3, 3, 1, 1 })
+				return cs
+			},
+			want: []want{{"fcTL", Severity_Error, "frame 0 is the default image but does not cover it"}},
+		},
+		{
+			name: "DelayDen",
+			change: func(t *testing.T, cs []*RawChunk) []*RawChunk {
+				fcTL(t, cs, 4, func(c *Chunk_fcTL) { c.DelayDen = 0 })
+				return cs
+			},
+			want: []want{{"fcTL", Severity_Warning, "frame 1 has DelayDen 0, which is treated as 100"}},
+		},
+		{
+			name: "DisposePrevious",
+			change: func(t *testing.T, cs []*RawChunk) []*RawChunk {
+				fcTL(t, cs, 2, func(c *Chunk_fcTL) { c.DisposeOp = DisposeOp_Previous })
+				return cs
+			},
+			want: []want{{"fcTL", Severity_Warning, "first frame uses DisposeOp_Previous"}},
+		},
+		{
+			name: "BadCRC",
+			crc:  true,
+			want: []want{{"IHDR", Severity_Error, "CRC mismatch"}},
+		},
+		{
+			name: "IHDRNotFirst",
+			change: func(t *testing.T, cs []*RawChunk) []*RawChunk {
+				return move(cs, 1, 0)
+			},
+			want: []want{{"acTL", Severity_Error, "first chunk is not IHDR"}},
+		},
+		{
+			name: "acTLAfterIDAT",
+			change: func(t *testing.T, cs []*RawChunk) []*RawChunk {
+				return move(cs, 1, 3)
+			},
+			want: []want{
+				{"fcTL", Severity_Error, "fcTL without a preceding acTL"},
+				{"acTL", Severity_Error, "acTL after IDAT"},
+			},
+		},
+		{
+			name: "fdATWithoutfcTL",
+			change: func(t *testing.T, cs []*RawChunk) []*RawChunk {
+				return remove(cs, 4)
+			},
+			want: []want{
+				{"fdAT", Severity_Error, "sequence number 2, want 1"},
+				{"fdAT", Severity_Error, "fdAT without a preceding fcTL"},
+				{"acTL", Severity_Error, "NumFrames is 2, but there are 1 fcTL chunks"},
+			},
+		},
+		{
+			name: "FrameWithoutData",
+			change: func(t *testing.T, cs []*RawChunk) []*RawChunk {
+				return remove(cs, 5)
+			},
+			want: []want{{"fcTL", Severity_Error, "frame 1 has no image data"}},
+		},
+		{
+			name: "IDATNotConsecutive",
+			change: func(t *testing.T, cs []*RawChunk) []*RawChunk {
+				return append(cs[:6:6], cs[3], cs[6])
+			},
+			want: []want{{"IDAT", Severity_Error, "IDAT chunks are not consecutive"}},
+		},
+		{
+			name: "ChunkAfterIEND",
+			change: func(t *testing.T, cs []*RawChunk) []*RawChunk {
+				return append(cs, &RawChunk{Type: [4]byte{'t', 'E', 'X', 't'}, Data: []byte("a\x00b")})
+			},
+			want: []want{{"tEXt", Severity_Error, "chunk after IEND"}},
+		},
+		{
+			name: "MissingIEND",
+			change: func(t *testing.T, cs []*RawChunk) []*RawChunk {
+				return cs[:6]
+			},
+			want: []want{{"", Severity_Error, "missing IEND"}},
+		},
+		{
+			name: "UnknownCritical",
+			change: func(t *testing.T, cs []*RawChunk) []*RawChunk {
+				return append(cs[:2:2], append([]*RawChunk{{Type: [4]byte{'C', 'r', 'I', 't'}}}, cs[2:]...)...)
+			},
+			want: []want{{"CrIt", Severity_Error, "unknown critical chunk"}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cs := validChunks(t)
+			if tc.change != nil {
+				cs = tc.change(t, cs)
+			}
+			buf := bytes.NewBuffer(nil)
+			buf.WriteString(PngHeader)
+			for _, c := range cs {
+				mustWrite(t, buf, c)
+			}
+			b := buf.Bytes()
+			if tc.crc {
+				b[len(PngHeader)+8+13] ^= 1
+			}
+
+			problems := Validate(bytes.NewReader(b))
+			if len(problems) != len(tc.want) {
+				t.Errorf("got %d problems, want %d", len(problems), len(tc.want))
+			}
+			for i, p := range problems {
+				if i >= len(tc.want) {
+					t.Errorf("unexpected %v", p)
+					continue
+				}
+				w := tc.want[i]
+				if p.Chunk != w.chunk || p.Severity != w.severity || !strings.Contains(p.Message, w.message) {
+					t.Errorf("got %v, want %v: %s: %s", p, w.severity, w.chunk, w.message)
+				}
+			}
+		})
+	}
+}
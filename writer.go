@@ -7,6 +7,7 @@ package apng
 import (
 	"bufio"
 	"compress/zlib"
+	"fmt"
 	"hash/crc32"
 	"image"
 	"image/color"
@@ -42,6 +43,46 @@ const (
 	// compression level, although that is not implemented yet.
 )
 
+// compressionLevels maps compression levels to the names the commands use.
+var compressionLevels = map[CompressionLevel]string{
+	DefaultCompression: "default",
+	NoCompression:      "none",
+	BestSpeed:          "speed",
+	BestCompression:    "best",
+}
+
+// ParseCompressionLevel returns the compression level with the given name:
+// "default", "none", "speed" or "best".
+func ParseCompressionLevel(s string) (CompressionLevel, error) {
+	for l, name := range compressionLevels {
+		if name == s {
+			return l, nil
+		}
+	}
+	return 0, UnsupportedError("compression level " + s)
+}
+
+// String returns the name of the compression level.
+func (l CompressionLevel) String() string {
+	if name, ok := compressionLevels[l]; ok {
+		return name
+	}
+	return fmt.Sprintf("CompressionLevel(%d)", int(l))
+}
+
+// FilterStrategy is how the encoders choose the filter type of each row.  It is
+// set through EncodeOptions; the encoders made by NewEncoder_IDAT and
+// NewEncoder_fdAT use FilterStrategy_Adaptive.
+type FilterStrategy int
+
+const (
+	// Each row takes the filter type that minimizes the sum of absolute
+	// differences, as per image/png.
+	FilterStrategy_Adaptive = FilterStrategy(0)
+	// No row is filtered, which often compresses paletted images better.
+	FilterStrategy_None = FilterStrategy(1)
+)
+
 // ColorType is the type of color of the image, per the PNG spec.
 type ColorType uint8
 
@@ -105,6 +146,12 @@ type Chunk_IHDR struct {
 	CompressionMethod CompressionMethod
 	FilterMethod      FilterMethod
 	InterlaceMethod   InterlaceMethod
+
+	// Transparency is the single color key tRNS chunk for grayscale and
+	// truecolor images, if any.  Encoders use it to write fully transparent
+	// pixels as the color key.  It is not written by WriteTo: write it as its
+	// own chunk, after any PLTE and before the image data.
+	Transparency *Chunk_tRNS
 }
 
 // A cb is a combination of color type and bit depth.
@@ -143,13 +190,83 @@ func (c *Chunk_IHDR) cb() int {
 		return cbTCA16
 	case c.ColorType == ColorType_Grayscale && c.BitDepth == BitDepth_16:
 		return cbG16
+	case c.ColorType == ColorType_GrayscaleAlpha && c.BitDepth == BitDepth_8:
+		return cbGA8
+	case c.ColorType == ColorType_GrayscaleAlpha && c.BitDepth == BitDepth_16:
+		return cbGA16
 	}
 	return cbInvalid
 }
 
+// key returns the color key samples to write for fully transparent pixels, or
+// nil if there is no color key.
+func (c *Chunk_IHDR) key() []byte {
+	if c.Transparency == nil {
+		return nil
+	}
+	switch c.ColorType {
+	case ColorType_Grayscale:
+		if len(c.Transparency.data) == sizeOfUint16 {
+			return c.Transparency.data
+		}
+	case ColorType_TrueColor:
+		if len(c.Transparency.data) == sizeOfUint16*3 {
+			return c.Transparency.data
+		}
+	}
+	return nil
+}
+
+// Validate checks the IHDR fields against the PNG spec, and that Transparency,
+// if set, is a color key for the color type.
+func (c *Chunk_IHDR) Validate() error {
+	switch {
+	case c.Width == 0 || c.Width > maxChunkLength:
+		return &ChunkError{"IHDR", "Width", fmt.Sprintf("%d is not between 1 and 2^31-1", c.Width)}
+	case c.Height == 0 || c.Height > maxChunkLength:
+		return &ChunkError{"IHDR", "Height", fmt.Sprintf("%d is not between 1 and 2^31-1", c.Height)}
+	case !validColorTypeBitDepth(c.ColorType, c.BitDepth):
+		return &ChunkError{"IHDR", "BitDepth", fmt.Sprintf("%d is not allowed with ColorType %d", c.BitDepth, c.ColorType)}
+	case c.CompressionMethod != CompressionMethod_Default:
+		return &ChunkError{"IHDR", "CompressionMethod", fmt.Sprintf("unknown method %d", c.CompressionMethod)}
+	case c.FilterMethod != FilterMethod_Default:
+		return &ChunkError{"IHDR", "FilterMethod", fmt.Sprintf("unknown method %d", c.FilterMethod)}
+	case c.InterlaceMethod > InterlaceMethd_Interlaced:
+		return &ChunkError{"IHDR", "InterlaceMethod", fmt.Sprintf("unknown method %d", c.InterlaceMethod)}
+	case c.Transparency != nil && c.key() == nil:
+		return &ChunkError{"IHDR", "Transparency", fmt.Sprintf("%d bytes is not a color key for ColorType %d", len(c.Transparency.data), c.ColorType)}
+	}
+	return nil
+}
+
+// validColorTypeBitDepth reports whether the PNG spec allows the combination.
+func validColorTypeBitDepth(ct ColorType, bd BitDepth) bool {
+	switch ct {
+	case ColorType_Grayscale:
+		return bd == BitDepth_1 || bd == BitDepth_2 || bd == BitDepth_4 || bd == BitDepth_8 || bd == BitDepth_16
+	case ColorType_Paletted:
+		return bd == BitDepth_1 || bd == BitDepth_2 || bd == BitDepth_4 || bd == BitDepth_8
+	case ColorType_TrueColor, ColorType_GrayscaleAlpha, ColorType_TrueColorAlpha:
+		return bd == BitDepth_8 || bd == BitDepth_16
+	}
+	return false
+}
+
 // WriteTo encodes the IHDR chunk to the io.Writer.  This supports the
-// io.WriterTo interface.
+// io.WriterTo interface.  It returns an error without writing anything if the chunk fails
+// Validate, or asks for interlacing, which the encoders do not support.
 func (c *Chunk_IHDR) WriteTo(w io.Writer) (int64, error) {
+	if err := c.Validate(); err != nil {
+		return 0, err
+	}
+	if c.InterlaceMethod != InterlaceMethd_NonInterlaced {
+		return 0, UnsupportedError("interlacing")
+	}
+	return writeChunkTo("IHDR", c.data(), w)
+}
+
+// data returns the chunk data for the IHDR fields.
+func (c *Chunk_IHDR) data() []byte {
 	buf := [sizeOfUint32*2 + sizeOfBitDepth + sizeOfColorType + sizeOfCompressionMethod + sizeOfFilterMethod + sizeOfInterlaceMethod]byte{}
 	writeUint32(buf[0:4], c.Width)
 	writeUint32(buf[4:8], c.Height)
@@ -158,7 +275,7 @@ func (c *Chunk_IHDR) WriteTo(w io.Writer) (int64, error) {
 	buf[10] = byte(c.CompressionMethod)
 	buf[11] = byte(c.FilterMethod)
 	buf[12] = byte(c.InterlaceMethod)
-	return writeChunkTo("IHDR", buf[0:len(buf)], w)
+	return buf[0:len(buf)]
 }
 
 // Chunk_PLTE is the palette chunk, as per the PNG spec.  Write this after IHDR
@@ -181,9 +298,27 @@ func NewChunk_PLTE(p color.Palette) *Chunk_PLTE {
 	return chunk
 }
 
+// Bytes returns the palette entries, as three bytes of red, green and blue each.
+func (c *Chunk_PLTE) Bytes() []byte {
+	return c.data
+}
+
+// Validate checks that the palette has between 1 and 256 entries, as per the
+// PNG spec.
+func (c *Chunk_PLTE) Validate() error {
+	if len(c.data) == 0 || len(c.data) > 3*256 {
+		return &ChunkError{"PLTE", "entries", fmt.Sprintf("%d is not between 1 and 256", len(c.data)/3)}
+	}
+	return nil
+}
+
 // WriteTo encodes the palette chunk to the io.Writer.  This supports the
-// io.WriterTo interface.
+// io.WriterTo interface.  It returns an error without writing anything if the
+// chunk fails Validate.
 func (c *Chunk_PLTE) WriteTo(w io.Writer) (int64, error) {
+	if err := c.Validate(); err != nil {
+		return 0, err
+	}
 	return writeChunkTo("PLTE", c.data, w)
 }
 
@@ -193,18 +328,61 @@ type Chunk_tRNS struct {
 	data []byte
 }
 
-// NewChunk_tRNS makes a new transparency chunk from a color.Palette.
+// NewChunk_tRNS makes a new transparency chunk from a color.Palette.  Trailing
+// fully opaque entries are left out, as per the PNG spec, so order the palette
+// with its translucent colors first to keep the chunk short.  At least one
+// entry is kept, since decoders reject an empty tRNS chunk, so a fully opaque
+// palette gives a chunk of one opaque entry; such a palette needs no tRNS
+// chunk at all.
 func NewChunk_tRNS(p color.Palette) *Chunk_tRNS {
 	chunk := &Chunk_tRNS{
 		data: make([]byte, len(p)),
 	}
+	n := 0
 	for i, c := range p {
 		c1 := color.NRGBAModel.Convert(c).(color.NRGBA)
 		chunk.data[i] = c1.A
+		if c1.A != 0xff {
+			n = i + 1
+		}
+	}
+	if n == 0 && len(p) > 0 {
+		n = 1
+	}
+	chunk.data = chunk.data[:n]
+	return chunk
+}
+
+// NewChunk_tRNS_Gray makes a new transparency chunk for a grayscale image, in
+// which pixels with gray level y are fully transparent.  The gray level is in
+// the image's bit depth.
+func NewChunk_tRNS_Gray(y uint16) *Chunk_tRNS {
+	chunk := &Chunk_tRNS{
+		data: make([]byte, sizeOfUint16),
+	}
+	writeUint16(chunk.data[0:2], y)
+	return chunk
+}
+
+// NewChunk_tRNS_RGB makes a new transparency chunk for a truecolor image, in
+// which pixels with color r, g, b are fully transparent.  The samples are in
+// the image's bit depth.
+func NewChunk_tRNS_RGB(r, g, b uint16) *Chunk_tRNS {
+	chunk := &Chunk_tRNS{
+		data: make([]byte, sizeOfUint16*3),
 	}
+	writeUint16(chunk.data[0:2], r)
+	writeUint16(chunk.data[2:4], g)
+	writeUint16(chunk.data[4:6], b)
 	return chunk
 }
 
+// Bytes returns the transparency data: an alpha value per palette entry, or a
+// big-endian gray level or red, green and blue color key.
+func (c *Chunk_tRNS) Bytes() []byte {
+	return c.data
+}
+
 // WriteTo encodes the transparency chunk to the io.Writer.  This supports the
 // io.WriterTo interface.
 func (c *Chunk_tRNS) WriteTo(w io.Writer) (int64, error) {
@@ -227,9 +405,21 @@ type Chunk_acTL struct {
 	NumPlays  uint32 // Number of times to loop this APNG. 0 indicates infinite looping.
 }
 
+// Validate checks that there is at least one frame, as per the APNG spec.
+func (c *Chunk_acTL) Validate() error {
+	if c.NumFrames == 0 {
+		return &ChunkError{"acTL", "NumFrames", "must not be 0"}
+	}
+	return nil
+}
+
 // WriteTo encodes the animation control chunk to the io.Writer.  This supports
-// the io.WriterTo interface.
+// the io.WriterTo interface.  It returns an error without writing anything if
+// the chunk fails Validate.
 func (c *Chunk_acTL) WriteTo(w io.Writer) (int64, error) {
+	if err := c.Validate(); err != nil {
+		return 0, err
+	}
 	buf := [sizeOfUint32 * 2]byte{}
 	writeUint32(buf[0:4], c.NumFrames)
 	writeUint32(buf[4:8], c.NumPlays)
@@ -247,6 +437,22 @@ const (
 	DisposeOp_Previous   = DisposeOp(2)
 )
 
+// disposeOps maps dispose operators to the names the commands use.
+var disposeOps = map[DisposeOp]string{
+	DisposeOp_None:       "none",
+	DisposeOp_Background: "background",
+	DisposeOp_Previous:   "previous",
+}
+
+// String returns the name of the dispose operator: "none", "background" or
+// "previous".
+func (op DisposeOp) String() string {
+	if name, ok := disposeOps[op]; ok {
+		return name
+	}
+	return fmt.Sprintf("DisposeOp(%d)", uint8(op))
+}
+
 // BlendOp is the blend operator, as per the APNG spec.
 type BlendOp uint8
 
@@ -257,6 +463,20 @@ const (
 	BlendOp_Over   = BlendOp(1)
 )
 
+// blendOps maps blend operators to the names the commands use.
+var blendOps = map[BlendOp]string{
+	BlendOp_Source: "source",
+	BlendOp_Over:   "over",
+}
+
+// String returns the name of the blend operator: "source" or "over".
+func (op BlendOp) String() string {
+	if name, ok := blendOps[op]; ok {
+		return name
+	}
+	return fmt.Sprintf("BlendOp(%d)", uint8(op))
+}
+
 // Chunk_fcTL is the frame control chunk, as per the APNG spec.
 type Chunk_fcTL struct {
 	SequenceNumber uint32    // Sequence number of the animation chunk, starting from 0
@@ -270,9 +490,38 @@ type Chunk_fcTL struct {
 	BlendOp        BlendOp   // Type of frame area rendering for this frame
 }
 
+// Validate checks the frame control fields against the APNG spec.  If ihdr is
+// not nil, it also checks that the frame lies within the image.
+func (c *Chunk_fcTL) Validate(ihdr *Chunk_IHDR) error {
+	width, height := uint64(maxChunkLength), uint64(maxChunkLength)
+	if ihdr != nil {
+		width, height = uint64(ihdr.Width), uint64(ihdr.Height)
+	}
+	switch {
+	case c.Width == 0:
+		return &ChunkError{"fcTL", "Width", "must not be 0"}
+	case c.Height == 0:
+		return &ChunkError{"fcTL", "Height", "must not be 0"}
+	case uint64(c.XOffset)+uint64(c.Width) > width:
+		return &ChunkError{"fcTL", "XOffset", fmt.Sprintf("%d plus Width %d exceeds image width %d", c.XOffset, c.Width, width)}
+	case uint64(c.YOffset)+uint64(c.Height) > height:
+		return &ChunkError{"fcTL", "YOffset", fmt.Sprintf("%d plus Height %d exceeds image height %d", c.YOffset, c.Height, height)}
+	case c.DisposeOp > DisposeOp_Previous:
+		return &ChunkError{"fcTL", "DisposeOp", fmt.Sprintf("unknown operator %d", c.DisposeOp)}
+	case c.BlendOp > BlendOp_Over:
+		return &ChunkError{"fcTL", "BlendOp", fmt.Sprintf("unknown operator %d", c.BlendOp)}
+	}
+	return nil
+}
+
 // WriteTo encodes the frame control chunk to the io.Writer.  This supports the
-// io.WriterTo interface.
+// io.WriterTo interface.  It returns an error without writing anything if the
+// chunk fails Validate; since the IHDR is not known here, call Validate with
+// it to check the frame bounds as well.
 func (c *Chunk_fcTL) WriteTo(w io.Writer) (int64, error) {
+	if err := c.Validate(nil); err != nil {
+		return 0, err
+	}
 	buf := [sizeOfUint32*5 + sizeOfUint16*2 + sizeOfDisposeOp + sizeOfBlendOp]byte{}
 	writeUint32(buf[0:4], c.SequenceNumber)
 	writeUint32(buf[4:8], c.Width)
@@ -316,8 +565,10 @@ type atom struct {
 
 type atomWriter chan *atom
 
+// Write sends a copy of b, since the caller may reuse b as soon as Write
+// returns, while the receiver is still writing out its chunk.
 func (aw atomWriter) Write(b []byte) (int, error) {
-	aw <- &atom{buf: b}
+	aw <- &atom{buf: append([]byte(nil), b...)}
 	return len(b), nil
 }
 
@@ -334,7 +585,30 @@ type Encoder_IDAT struct {
 }
 
 // NewEncoder_IDAT makes a new image data encoder for the given image and compression level.
+// The image must be the same size as the header and not empty; if it is not,
+// the encoder's Err returns a *SizeError.
 func (c *Chunk_IHDR) NewEncoder_IDAT(m image.Image, cl CompressionLevel) Encoder {
+	return c.newEncoder_IDAT(m, cl, FilterStrategy_Adaptive)
+}
+
+func (c *Chunk_IHDR) newEncoder_IDAT(m image.Image, cl CompressionLevel, f FilterStrategy) Encoder {
+	if b := m.Bounds(); b.Empty() || uint32(b.Dx()) != c.Width || uint32(b.Dy()) != c.Height {
+		return errEncoder(&SizeError{"IHDR", c.Width, c.Height, b})
+	}
+	return c.encodeImage(m, cl, f)
+}
+
+// errEncoder returns an Encoder that yields no chunks, only err.
+func errEncoder(err error) Encoder {
+	aw := make(atomWriter, 1)
+	aw <- &atom{err: err}
+	close(aw)
+	return &Encoder_IDAT{aw: aw}
+}
+
+// encodeImage returns an Encoder for the image data of m, which must fit in
+// the image described by c.
+func (c *Chunk_IHDR) encodeImage(m image.Image, cl CompressionLevel, f FilterStrategy) Encoder {
 	aw := make(atomWriter)
 	go func() {
 		defer close(aw)
@@ -344,7 +618,7 @@ func (c *Chunk_IHDR) NewEncoder_IDAT(m image.Image, cl CompressionLevel) Encoder
 			aw <- &atom{err: err}
 			return
 		}
-		if err := writeImage(zw, m, c.cb(), cl != NoCompression); err != nil {
+		if err := writeImage(zw, m, c.cb(), c.key(), cl != NoCompression && f == FilterStrategy_Adaptive); err != nil {
 			aw <- &atom{err: err}
 			return
 		}
@@ -399,14 +673,71 @@ type Encoder_fdAT struct {
 }
 
 // NewEncoder_fdAT makes a new frame data encoder for the given sequence
-// numbers, image, and compression level.
+// numbers, image, and compression level.  The image must be no larger than the
+// header and not empty; if it is, the encoder's Err returns a *SizeError.  Use
+// Chunk_fcTL.NewEncoder_fdAT to also check the image against the frame.
 func (c *Chunk_IHDR) NewEncoder_fdAT(seq *SequenceNumbers, m image.Image, cl CompressionLevel) Encoder {
+	if b := m.Bounds(); b.Empty() || uint32(b.Dx()) > c.Width || uint32(b.Dy()) > c.Height {
+		return errEncoder(&SizeError{"IHDR", c.Width, c.Height, b})
+	}
 	return &Encoder_fdAT{
 		seq:          seq,
-		encoder_IDAT: c.NewEncoder_IDAT(m, cl),
+		encoder_IDAT: c.encodeImage(m, cl, FilterStrategy_Adaptive),
 	}
 }
 
+// NewEncoder_fdAT makes a new frame data encoder for the frame described by c,
+// in the image described by ihdr.  The image must either be the size of the
+// frame, or the size of the whole image, in which case only the frame's region
+// at XOffset, YOffset is encoded.  This allows passing a full frame buffer.
+// Otherwise the encoder's Err returns a *SizeError.  If ihdr is nil, or the
+// frame does not fit in the image, it returns a *ChunkError.
+func (c *Chunk_fcTL) NewEncoder_fdAT(ihdr *Chunk_IHDR, seq *SequenceNumbers, m image.Image, cl CompressionLevel) Encoder {
+	return c.newEncoder_fdAT(ihdr, seq, m, cl, FilterStrategy_Adaptive)
+}
+
+func (c *Chunk_fcTL) newEncoder_fdAT(ihdr *Chunk_IHDR, seq *SequenceNumbers, m image.Image, cl CompressionLevel, f FilterStrategy) Encoder {
+	if ihdr == nil {
+		return errEncoder(&ChunkError{"fcTL", "ihdr", "an image header is needed to encode frame data"})
+	}
+	if err := c.Validate(ihdr); err != nil {
+		return errEncoder(err)
+	}
+	b := m.Bounds()
+	switch {
+	case uint32(b.Dx()) == c.Width && uint32(b.Dy()) == c.Height:
+	case uint32(b.Dx()) == ihdr.Width && uint32(b.Dy()) == ihdr.Height:
+		r := image.Rect(0, 0, int(c.Width), int(c.Height))
+		m = subImage(m, r.Add(b.Min).Add(image.Pt(int(c.XOffset), int(c.YOffset))))
+	default:
+		return errEncoder(&SizeError{"fcTL", c.Width, c.Height, b})
+	}
+	return &Encoder_fdAT{
+		seq:          seq,
+		encoder_IDAT: ihdr.encodeImage(m, cl, f),
+	}
+}
+
+// subImage returns the part of m within r, which must lie within m's bounds.
+func subImage(m image.Image, r image.Rectangle) image.Image {
+	if s, ok := m.(interface {
+		SubImage(image.Rectangle) image.Image
+	}); ok {
+		return s.SubImage(r)
+	}
+	return &region{m, r}
+}
+
+// region is the part of an image that does not implement SubImage.
+type region struct {
+	image.Image
+	r image.Rectangle
+}
+
+func (r *region) Bounds() image.Rectangle {
+	return r.r
+}
+
 // Next is used to advance the encoder to the next chunk.  Call this before
 // using either Chunk or Err.
 func (e *Encoder_fdAT) Next() bool {
@@ -444,6 +775,16 @@ func writeUint32(b []uint8, u uint32) {
 
 const sizeOfUint32 = 4
 
+// Big-endian.
+func readUint16(b []uint8) uint16 {
+	return uint16(b[0])<<8 | uint16(b[1])
+}
+
+// Big-endian.
+func readUint32(b []uint8) uint32 {
+	return uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3])
+}
+
 func writeChunkTo(name string, b []byte, w io.Writer) (int64, error) {
 	header := [8]byte{}
 	footer := [4]byte{}
@@ -471,7 +812,31 @@ func writeChunkTo(name string, b []byte, w io.Writer) (int64, error) {
 	return int64(hl + bl + fl), err
 }
 
-func writeImage(w io.Writer, m image.Image, cb int, applyFilter bool) error {
+// toNRGBA64 converts c to non-alpha-premultiplied form.  Unlike
+// color.NRGBA64Model, it keeps the exact values of a color.NRGBA, rather than
+// rounding them through alpha-premultiplied form.
+func toNRGBA64(c color.Color) color.NRGBA64 {
+	if n, ok := c.(color.NRGBA); ok {
+		return color.NRGBA64{
+			R: uint16(n.R) * 0x101,
+			G: uint16(n.G) * 0x101,
+			B: uint16(n.B) * 0x101,
+			A: uint16(n.A) * 0x101,
+		}
+	}
+	return color.NRGBA64Model.Convert(c).(color.NRGBA64)
+}
+
+// grayNRGBA64 returns the non-alpha-premultiplied gray level of c, using the
+// same weights as color.Gray16Model.
+func grayNRGBA64(c color.NRGBA64) uint16 {
+	return uint16((19595*uint32(c.R) + 38470*uint32(c.G) + 7471*uint32(c.B) + 1<<15) >> 16)
+}
+
+// writeImage writes the filtered rows of m.  If key is not nil, it holds the
+// big-endian color key samples from a tRNS chunk, and fully transparent pixels
+// are written as the key in the grayscale and truecolor modes.
+func writeImage(w io.Writer, m image.Image, cb int, key []byte, applyFilter bool) error {
 	bpp := 0 // Bytes per pixel.
 
 	switch cb {
@@ -489,6 +854,12 @@ func writeImage(w io.Writer, m image.Image, cb int, applyFilter bool) error {
 		bpp = 8
 	case cbG16:
 		bpp = 2
+	case cbGA8:
+		bpp = 2
+	case cbGA16:
+		bpp = 4
+	default:
+		return UnsupportedError("color type and bit depth combination")
 	}
 	// cr[*] and pr are the bytes for the current and previous row.
 	// cr[0] is unfiltered (or equivalently, filtered with the ftNone filter).
@@ -506,109 +877,178 @@ func writeImage(w io.Writer, m image.Image, cb int, applyFilter bool) error {
 	gray, _ := m.(*image.Gray)
 	rgba, _ := m.(*image.RGBA)
 	paletted, _ := m.(*image.Paletted)
+	pi, _ := m.(image.PalettedImage)
+	if cb == cbP8 && pi == nil {
+		return UnsupportedError("paletted color type for an image without a palette")
+	}
 	nrgba, _ := m.(*image.NRGBA)
+	fast := rowConverter(m, cb, key)
 
 	for y := b.Min.Y; y < b.Max.Y; y++ {
 		// Convert from colors to bytes.
-		i := 1
-		switch cb {
-		case cbG8:
-			if gray != nil {
-				offset := (y - b.Min.Y) * gray.Stride
-				copy(cr[0][1:], gray.Pix[offset:offset+b.Dx()])
-			} else {
+		if fast != nil {
+			if err := fast(cr[0][1:], y); err != nil {
+				return err
+			}
+		} else {
+			i := 1
+			switch cb {
+			case cbG8:
+				if gray != nil {
+					offset := (y - b.Min.Y) * gray.Stride
+					copy(cr[0][1:], gray.Pix[offset:offset+b.Dx()])
+				} else {
+					for x := b.Min.X; x < b.Max.X; x++ {
+						c := m.At(x, y)
+						_, _, _, a := c.RGBA()
+						if err := alphaError(x, y, a, key); err != nil {
+							return err
+						}
+						if a == 0 {
+							cr[0][i] = key[1]
+						} else {
+							cr[0][i] = color.GrayModel.Convert(c).(color.Gray).Y
+						}
+						i++
+					}
+				}
+			case cbTC8:
+				cr0 := cr[0]
+				stride, pix := 0, []byte(nil)
+				if rgba != nil {
+					stride, pix = rgba.Stride, rgba.Pix
+				} else if nrgba != nil {
+					stride, pix = nrgba.Stride, nrgba.Pix
+				}
+				if stride != 0 {
+					j0 := (y - b.Min.Y) * stride
+					j1 := j0 + b.Dx()*4
+					for j := j0; j < j1; j += 4 {
+						if err := alphaError(b.Min.X+(j-j0)/4, y, uint32(pix[j+3])*0x101, key); err != nil {
+							return err
+						}
+						if pix[j+3] == 0 {
+							cr0[i+0] = key[1]
+							cr0[i+1] = key[3]
+							cr0[i+2] = key[5]
+						} else {
+							cr0[i+0] = pix[j+0]
+							cr0[i+1] = pix[j+1]
+							cr0[i+2] = pix[j+2]
+						}
+						i += 3
+					}
+				} else {
+					for x := b.Min.X; x < b.Max.X; x++ {
+						r, g, b, a := m.At(x, y).RGBA()
+						if err := alphaError(x, y, a, key); err != nil {
+							return err
+						}
+						if a == 0 {
+							cr0[i+0] = key[1]
+							cr0[i+1] = key[3]
+							cr0[i+2] = key[5]
+						} else {
+							cr0[i+0] = uint8(r >> 8)
+							cr0[i+1] = uint8(g >> 8)
+							cr0[i+2] = uint8(b >> 8)
+						}
+						i += 3
+					}
+				}
+			case cbP8:
+				if paletted != nil {
+					offset := (y - b.Min.Y) * paletted.Stride
+					copy(cr[0][1:], paletted.Pix[offset:offset+b.Dx()])
+				} else {
+					for x := b.Min.X; x < b.Max.X; x++ {
+						cr[0][i] = pi.ColorIndexAt(x, y)
+						i += 1
+					}
+				}
+			case cbTCA8:
+				if nrgba != nil {
+					offset := (y - b.Min.Y) * nrgba.Stride
+					copy(cr[0][1:], nrgba.Pix[offset:offset+b.Dx()*4])
+				} else {
+					// Convert from image.Image (which is alpha-premultiplied) to PNG's non-alpha-premultiplied.
+					for x := b.Min.X; x < b.Max.X; x++ {
+						c := color.NRGBAModel.Convert(m.At(x, y)).(color.NRGBA)
+						cr[0][i+0] = c.R
+						cr[0][i+1] = c.G
+						cr[0][i+2] = c.B
+						cr[0][i+3] = c.A
+						i += 4
+					}
+				}
+			case cbG16:
 				for x := b.Min.X; x < b.Max.X; x++ {
-					c := color.GrayModel.Convert(m.At(x, y)).(color.Gray)
-					cr[0][i] = c.Y
-					i++
+					c := m.At(x, y)
+					_, _, _, a := c.RGBA()
+					if err := alphaError(x, y, a, key); err != nil {
+						return err
+					}
+					if a == 0 {
+						cr[0][i+0] = key[0]
+						cr[0][i+1] = key[1]
+					} else {
+						c := color.Gray16Model.Convert(c).(color.Gray16)
+						cr[0][i+0] = uint8(c.Y >> 8)
+						cr[0][i+1] = uint8(c.Y)
+					}
+					i += 2
 				}
-			}
-		case cbTC8:
-			// We have previously verified that the alpha value is fully opaque.
-			cr0 := cr[0]
-			stride, pix := 0, []byte(nil)
-			if rgba != nil {
-				stride, pix = rgba.Stride, rgba.Pix
-			} else if nrgba != nil {
-				stride, pix = nrgba.Stride, nrgba.Pix
-			}
-			if stride != 0 {
-				j0 := (y - b.Min.Y) * stride
-				j1 := j0 + b.Dx()*4
-				for j := j0; j < j1; j += 4 {
-					cr0[i+0] = pix[j+0]
-					cr0[i+1] = pix[j+1]
-					cr0[i+2] = pix[j+2]
-					i += 3
+			case cbTC16:
+				for x := b.Min.X; x < b.Max.X; x++ {
+					r, g, b, a := m.At(x, y).RGBA()
+					if err := alphaError(x, y, a, key); err != nil {
+						return err
+					}
+					if a == 0 {
+						copy(cr[0][i:i+6], key)
+						i += 6
+						continue
+					}
+					cr[0][i+0] = uint8(r >> 8)
+					cr[0][i+1] = uint8(r)
+					cr[0][i+2] = uint8(g >> 8)
+					cr[0][i+3] = uint8(g)
+					cr[0][i+4] = uint8(b >> 8)
+					cr[0][i+5] = uint8(b)
+					i += 6
 				}
-			} else {
+			case cbGA8:
 				for x := b.Min.X; x < b.Max.X; x++ {
-					r, g, b, _ := m.At(x, y).RGBA()
-					cr0[i+0] = uint8(r >> 8)
-					cr0[i+1] = uint8(g >> 8)
-					cr0[i+2] = uint8(b >> 8)
-					i += 3
+					c := toNRGBA64(m.At(x, y))
+					cr[0][i+0] = uint8(grayNRGBA64(c) >> 8)
+					cr[0][i+1] = uint8(c.A >> 8)
+					i += 2
 				}
-			}
-		case cbP8:
-			if paletted != nil {
-				offset := (y - b.Min.Y) * paletted.Stride
-				copy(cr[0][1:], paletted.Pix[offset:offset+b.Dx()])
-			} else {
-				pi := m.(image.PalettedImage)
+			case cbGA16:
 				for x := b.Min.X; x < b.Max.X; x++ {
-					cr[0][i] = pi.ColorIndexAt(x, y)
-					i += 1
+					c := toNRGBA64(m.At(x, y))
+					g := grayNRGBA64(c)
+					cr[0][i+0] = uint8(g >> 8)
+					cr[0][i+1] = uint8(g)
+					cr[0][i+2] = uint8(c.A >> 8)
+					cr[0][i+3] = uint8(c.A)
+					i += 4
 				}
-			}
-		case cbTCA8:
-			if nrgba != nil {
-				offset := (y - b.Min.Y) * nrgba.Stride
-				copy(cr[0][1:], nrgba.Pix[offset:offset+b.Dx()*4])
-			} else {
+			case cbTCA16:
 				// Convert from image.Image (which is alpha-premultiplied) to PNG's non-alpha-premultiplied.
 				for x := b.Min.X; x < b.Max.X; x++ {
-					c := color.NRGBAModel.Convert(m.At(x, y)).(color.NRGBA)
-					cr[0][i+0] = c.R
-					cr[0][i+1] = c.G
-					cr[0][i+2] = c.B
-					cr[0][i+3] = c.A
-					i += 4
+					c := toNRGBA64(m.At(x, y))
+					cr[0][i+0] = uint8(c.R >> 8)
+					cr[0][i+1] = uint8(c.R)
+					cr[0][i+2] = uint8(c.G >> 8)
+					cr[0][i+3] = uint8(c.G)
+					cr[0][i+4] = uint8(c.B >> 8)
+					cr[0][i+5] = uint8(c.B)
+					cr[0][i+6] = uint8(c.A >> 8)
+					cr[0][i+7] = uint8(c.A)
+					i += 8
 				}
 			}
-		case cbG16:
-			for x := b.Min.X; x < b.Max.X; x++ {
-				c := color.Gray16Model.Convert(m.At(x, y)).(color.Gray16)
-				cr[0][i+0] = uint8(c.Y >> 8)
-				cr[0][i+1] = uint8(c.Y)
-				i += 2
-			}
-		case cbTC16:
-			// We have previously verified that the alpha value is fully opaque.
-			for x := b.Min.X; x < b.Max.X; x++ {
-				r, g, b, _ := m.At(x, y).RGBA()
-				cr[0][i+0] = uint8(r >> 8)
-				cr[0][i+1] = uint8(r)
-				cr[0][i+2] = uint8(g >> 8)
-				cr[0][i+3] = uint8(g)
-				cr[0][i+4] = uint8(b >> 8)
-				cr[0][i+5] = uint8(b)
-				i += 6
-			}
-		case cbTCA16:
-			// Convert from image.Image (which is alpha-premultiplied) to PNG's non-alpha-premultiplied.
-			for x := b.Min.X; x < b.Max.X; x++ {
-				c := color.NRGBA64Model.Convert(m.At(x, y)).(color.NRGBA64)
-				cr[0][i+0] = uint8(c.R >> 8)
-				cr[0][i+1] = uint8(c.R)
-				cr[0][i+2] = uint8(c.G >> 8)
-				cr[0][i+3] = uint8(c.G)
-				cr[0][i+4] = uint8(c.B >> 8)
-				cr[0][i+5] = uint8(c.B)
-				cr[0][i+6] = uint8(c.A >> 8)
-				cr[0][i+7] = uint8(c.A)
-				i += 8
-			}
 		}
 
 		// Apply the filter.
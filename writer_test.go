@@ -0,0 +1,277 @@
+package apng
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+// TestEncoder_IDATChunks checks that image data spanning several IDAT chunks
+// is written intact, although the encoder reuses its buffers between chunks.
+// The chunks are only written once they have all been encoded, so that they
+// would be overwritten if they shared the encoder's buffers.
+func TestEncoder_IDATChunks(t *testing.T) {
+	r := image.Rect(0, 0, 256, 256)
+	m := image.NewNRGBA(r)
+	rand.New(rand.NewSource(1)).Read(m.Pix)
+	ihdr := &Chunk_IHDR{Width: 256, Height: 256, BitDepth: BitDepth_8, ColorType: ColorType_TrueColorAlpha}
+
+	buf := bytes.NewBuffer(nil)
+	buf.WriteString(PngHeader)
+	if _, err := ihdr.WriteTo(buf); err != nil {
+		t.Fatal(err)
+	}
+	var chunks []io.WriterTo
+	e := ihdr.NewEncoder_IDAT(m, NoCompression)
+	for e.Next() {
+		chunks = append(chunks, e.Chunk())
+	}
+	if err := e.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) < 2 {
+		t.Fatalf("got %d IDAT chunks, want several", len(chunks))
+	}
+	for _, c := range chunks {
+		if _, err := c.WriteTo(buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := (&Chunk_IEND{}).WriteTo(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := png.Decode(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g, ok := got.(*image.NRGBA); !ok || !bytes.Equal(g.Pix, m.Pix) {
+		t.Fatal("decoded pixels differ")
+	}
+}
+
+// TestChunkValidate checks that Validate reports the offending field of each
+// chunk, and that WriteTo refuses to write an invalid chunk.
+func TestChunkValidate(t *testing.T) {
+	ihdr := func(f func(c *Chunk_IHDR)) *Chunk_IHDR {
+		c := &Chunk_IHDR{Width: 4, Height: 4, BitDepth: BitDepth_8, ColorType: ColorType_TrueColor}
+		f(c)
+		return c
+	}
+	palette := func(n int) color.Palette {
+		p := make(color.Palette, n)
+		for i := range p {
+			p[i] = color.Gray{uint8(i)}
+		}
+		return p
+	}
+	fctl := func(f func(c *Chunk_fcTL)) *Chunk_fcTL {
+		c := &Chunk_fcTL{Width: 2, Height: 2, XOffset: 1, YOffset: 1, DelayDen: 10}
+		f(c)
+		return c
+	}
+	for _, tc := range []struct {
+		name string
+		c    interface {
+			WriteTo(io.Writer) (int64, error)
+		}
+		field string
+	}{
+		{name: "IHDR", c: ihdr(func(c *Chunk_IHDR) {})},
+		{name: "IHDRWidth", c: ihdr(func(c *Chunk_IHDR) { c.Width = 0 }), field: "Width"},
+		{name: "IHDRWidthTooBig", c: ihdr(func(c *Chunk_IHDR) { c.Width = maxChunkLength + 1 }), field: "Width"},
+		{name: "IHDRHeight", c: ihdr(func(c *Chunk_IHDR) { c.Height = 0 }), field: "Height"},
+		{name: "IHDRBitDepth", c: ihdr(func(c *Chunk_IHDR) { c.BitDepth = BitDepth_4 }), field: "BitDepth"},
+		{name: "IHDRPaletted16", c: ihdr(func(c *Chunk_IHDR) { c.ColorType, c.BitDepth = ColorType_Paletted, BitDepth_16 }), field: "BitDepth"},
+		{name: "IHDRColorType", c: ihdr(func(c *Chunk_IHDR) { c.ColorType = 1 }), field: "BitDepth"},
+		{name: "IHDRCompressionMethod", c: ihdr(func(c *Chunk_IHDR) { c.CompressionMethod = 1 }), field: "CompressionMethod"},
+		{name: "IHDRFilterMethod", c: ihdr(func(c *Chunk_IHDR) { c.FilterMethod = 1 }), field: "FilterMethod"},
+		{name: "IHDRInterlaceMethod", c: ihdr(func(c *Chunk_IHDR) { c.InterlaceMethod = 2 }), field: "InterlaceMethod"},
+		{name: "PLTE", c: NewChunk_PLTE(palette(256))},
+		{name: "PLTEEmpty", c: NewChunk_PLTE(palette(0)), field: "entries"},
+		{name: "PLTETooLong", c: NewChunk_PLTE(palette(257)), field: "entries"},
+		{name: "acTL", c: &Chunk_acTL{NumFrames: 1}},
+		{name: "acTLNumFrames", c: &Chunk_acTL{}, field: "NumFrames"},
+		{name: "fcTL", c: fctl(func(c *Chunk_fcTL) {})},
+		{name: "fcTLWidth", c: fctl(func(c *Chunk_fcTL) { c.Width = 0 }), field: "Width"},
+		{name: "fcTLHeight", c: fctl(func(c *Chunk_fcTL) { c.Height = 0 }), field: "Height"},
+		{name: "fcTLXOffset", c: fctl(func(c *Chunk_fcTL) { c.XOffset = maxChunkLength }), field: "XOffset"},
+		{name: "fcTLYOffset", c: fctl(func(c *Chunk_fcTL) { c.YOffset = maxChunkLength }), field: "YOffset"},
+		{name: "fcTLDisposeOp", c: fctl(func(c *Chunk_fcTL) { c.DisposeOp = 3 }), field: "DisposeOp"},
+		{name: "fcTLBlendOp", c: fctl(func(c *Chunk_fcTL) { c.BlendOp = 2 }), field: "BlendOp"},
+	} {
+		var err error
+		switch c := tc.c.(type) {
+		case *Chunk_IHDR:
+			err = c.Validate()
+		case *Chunk_PLTE:
+			err = c.Validate()
+		case *Chunk_acTL:
+			err = c.Validate()
+		case *Chunk_fcTL:
+			err = c.Validate(nil)
+		}
+		buf := bytes.NewBuffer(nil)
+		n, werr := tc.c.WriteTo(buf)
+		if tc.field == "" {
+			if err != nil || werr != nil {
+				t.Errorf("%s: Validate returned %v, WriteTo %v", tc.name, err, werr)
+			}
+			continue
+		}
+		chunk := tc.name[:4]
+		if ce, ok := err.(*ChunkError); !ok || ce.Chunk != chunk || ce.Field != tc.field {
+			t.Errorf("%s: got %v, want a ChunkError for %s %s", tc.name, err, chunk, tc.field)
+		}
+		if werr == nil || n != 0 || buf.Len() != 0 {
+			t.Errorf("%s: WriteTo wrote %d bytes, returned %v", tc.name, buf.Len(), werr)
+		}
+	}
+}
+
+// TestChunkValidateImage checks fcTL's Validate against the image bounds.
+func TestChunkValidateImage(t *testing.T) {
+	ihdr := &Chunk_IHDR{Width: 4, Height: 3, BitDepth: BitDepth_8, ColorType: ColorType_TrueColor}
+	for _, tc := range []struct {
+		fctl  Chunk_fcTL
+		field string
+	}{
+		{Chunk_fcTL{Width: 4, Height: 3}, ""},
+		{Chunk_fcTL{Width: 1, Height: 1, XOffset: 3, YOffset: 2}, ""},
+		{Chunk_fcTL{Width: 5, Height: 3}, "XOffset"},
+		{Chunk_fcTL{Width: 2, Height: 1, XOffset: 3}, "XOffset"},
+		{Chunk_fcTL{Width: 4, Height: 4}, "YOffset"},
+		{Chunk_fcTL{Width: 1, Height: 2, YOffset: 2}, "YOffset"},
+	} {
+		err := tc.fctl.Validate(ihdr)
+		if tc.field == "" {
+			if err != nil {
+				t.Errorf("%+v: %v", tc.fctl, err)
+			}
+			continue
+		}
+		if ce, ok := err.(*ChunkError); !ok || ce.Chunk != "fcTL" || ce.Field != tc.field {
+			t.Errorf("%+v: got %v, want a ChunkError for fcTL %s", tc.fctl, err, tc.field)
+		}
+	}
+}
+
+// TestIHDRInterlaced checks that WriteTo refuses interlacing, which is valid
+// but which the encoders do not support.
+func TestIHDRInterlaced(t *testing.T) {
+	ihdr := &Chunk_IHDR{Width: 4, Height: 4, BitDepth: BitDepth_8, ColorType: ColorType_TrueColor, InterlaceMethod: InterlaceMethd_Interlaced}
+	if err := ihdr.Validate(); err != nil {
+		t.Errorf("Validate: %v", err)
+	}
+	buf := bytes.NewBuffer(nil)
+	n, err := ihdr.WriteTo(buf)
+	if _, ok := err.(UnsupportedError); !ok {
+		t.Errorf("WriteTo: got %v, want an UnsupportedError", err)
+	}
+	if n != 0 || buf.Len() != 0 {
+		t.Errorf("WriteTo wrote %d bytes", buf.Len())
+	}
+}
+
+// TestEncoderSize checks that the encoders refuse images of the wrong size
+// with a *SizeError, and frames without an image header with a *ChunkError.
+func TestEncoderSize(t *testing.T) {
+	ihdr := &Chunk_IHDR{Width: 4, Height: 3, BitDepth: BitDepth_8, ColorType: ColorType_TrueColor}
+	fctl := &Chunk_fcTL{Width: 2, Height: 2, XOffset: 1, YOffset: 1, DelayDen: 10}
+	img := func(w, h int) image.Image { return image.NewGray(image.Rect(0, 0, w, h)) }
+	check := func(name string, e Encoder, chunk string) {
+		t.Helper()
+		drainEncoder(e)
+		err := e.Err()
+		if chunk == "" {
+			if err != nil {
+				t.Errorf("%s: %v", name, err)
+			}
+			return
+		}
+		if se, ok := err.(*SizeError); !ok || se.Chunk != chunk {
+			t.Errorf("%s: got %v, want a *SizeError for %s", name, err, chunk)
+		}
+	}
+
+	check("IDAT", ihdr.NewEncoder_IDAT(img(4, 3), DefaultCompression), "")
+	check("IDATSmall", ihdr.NewEncoder_IDAT(img(3, 3), DefaultCompression), "IHDR")
+	check("IDATLarge", ihdr.NewEncoder_IDAT(img(4, 4), DefaultCompression), "IHDR")
+	check("IDATEmpty", ihdr.NewEncoder_IDAT(img(0, 0), DefaultCompression), "IHDR")
+
+	check("IHDRfdAT", ihdr.NewEncoder_fdAT(NewSequenceNumbers(), img(2, 3), DefaultCompression), "")
+	check("IHDRfdATLarge", ihdr.NewEncoder_fdAT(NewSequenceNumbers(), img(5, 3), DefaultCompression), "IHDR")
+	check("IHDRfdATEmpty", ihdr.NewEncoder_fdAT(NewSequenceNumbers(), img(0, 3), DefaultCompression), "IHDR")
+
+	check("fcTLfdATFrame", fctl.NewEncoder_fdAT(ihdr, NewSequenceNumbers(), img(2, 2), DefaultCompression), "")
+	check("fcTLfdATCanvas", fctl.NewEncoder_fdAT(ihdr, NewSequenceNumbers(), img(4, 3), DefaultCompression), "")
+	check("fcTLfdATOther", fctl.NewEncoder_fdAT(ihdr, NewSequenceNumbers(), img(3, 2), DefaultCompression), "fcTL")
+
+	e := fctl.NewEncoder_fdAT(nil, NewSequenceNumbers(), img(2, 2), DefaultCompression)
+	drainEncoder(e)
+	if ce, ok := e.Err().(*ChunkError); !ok || ce.Chunk != "fcTL" {
+		t.Errorf("nil ihdr: got %v, want a *ChunkError", e.Err())
+	}
+}
+
+// TestEncoderGrayAlphaNRGBA checks that translucent color.NRGBA pixels keep
+// their exact gray level when written with gray and alpha.
+func TestEncoderGrayAlphaNRGBA(t *testing.T) {
+	m := image.NewNRGBA(image.Rect(0, 0, 16, 16))
+	for i := 0; i < len(m.Pix); i += 4 {
+		v := uint8(i / 4)
+		m.Pix[i+0], m.Pix[i+1], m.Pix[i+2], m.Pix[i+3] = v, v, v, uint8(i/64+1)
+	}
+	// Wrapped, so that the encoder goes through At.
+	src := opaque{m}
+	for _, bd := range []BitDepth{BitDepth_8, BitDepth_16} {
+		ihdr := &Chunk_IHDR{Width: 16, Height: 16, BitDepth: bd, ColorType: ColorType_GrayscaleAlpha}
+		got, err := png.Decode(bytes.NewReader(encodePNG(t, ihdr, src, DefaultCompression, FilterStrategy_Adaptive)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for y := 0; y < 16; y++ {
+			for x := 0; x < 16; x++ {
+				g, w := toNRGBA64(got.At(x, y)), toNRGBA64(m.At(x, y))
+				if g != w {
+					t.Fatalf("BitDepth %d, pixel (%d, %d): got %v, want %v", bd, x, y, g, w)
+				}
+			}
+		}
+	}
+}
+
+func TestParseCompressionLevel(t *testing.T) {
+	for _, l := range []CompressionLevel{DefaultCompression, NoCompression, BestSpeed, BestCompression} {
+		if got, err := ParseCompressionLevel(l.String()); got != l || err != nil {
+			t.Errorf("ParseCompressionLevel(%q) = %v, %v", l.String(), got, err)
+		}
+	}
+	if _, err := ParseCompressionLevel("9"); err == nil {
+		t.Error("no error for an unknown compression level")
+	}
+}
+
+func TestOpString(t *testing.T) {
+	for _, tc := range []struct {
+		op   fmt.Stringer
+		want string
+	}{
+		{DisposeOp_None, "none"},
+		{DisposeOp_Background, "background"},
+		{DisposeOp_Previous, "previous"},
+		{DisposeOp(3), "DisposeOp(3)"},
+		{BlendOp_Source, "source"},
+		{BlendOp_Over, "over"},
+		{BlendOp(2), "BlendOp(2)"},
+	} {
+		if got := tc.op.String(); got != tc.want {
+			t.Errorf("got %q, want %q", got, tc.want)
+		}
+	}
+}